@@ -20,11 +20,14 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 
 	"github.com/golang/glog"
 	"github.com/kubic-project/registries-operator/pkg/apis"
 	"github.com/kubic-project/registries-operator/pkg/controller"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/renstrom/dedent"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -48,6 +51,7 @@ var Build string
 // newCmdManager runs the manager
 func newCmdManager(out io.Writer) *cobra.Command {
 	var kubeconfigFile = ""
+	var jobPodConfigFile = ""
 
 	cmd := &cobra.Command{
 		Use:   "manager",
@@ -55,6 +59,32 @@ func newCmdManager(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			var err error
 
+			switch regcfg.InstallMode {
+			case regcfg.InstallModeJob, regcfg.InstallModeAgent, regcfg.InstallModeBatch:
+			default:
+				fmt.Fprintf(os.Stderr, "error: unknown --install-mode '%s'\n", regcfg.InstallMode)
+				os.Exit(1)
+			}
+			if err := node.ValidateReloadPolicy(node.ReloadPolicy(regcfg.RuntimeReloadPolicy)); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --runtime-reload: %v\n", err)
+				os.Exit(1)
+			}
+			if err := node.ValidateRuntimeTargets(regcfg.RuntimeTargets); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --runtime-targets: %v\n", err)
+				os.Exit(1)
+			}
+			if len(jobPodConfigFile) > 0 {
+				regcfg.JobPod, err = regcfg.LoadJobPodConfig(jobPodConfigFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: invalid --jobs-pod-config: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			if len(regcfg.JobNamespace) == 0 {
+				fmt.Fprintf(os.Stderr, "error: --jobs-namespace cannot be empty\n")
+				os.Exit(1)
+			}
+
 			glog.V(1).Infof("[kubic] getting a kubeconfig to talk to the API server")
 			if len(kubeconfigFile) > 0 {
 				glog.V(3).Infof("[kubic] setting KUBECONFIG to '%s'", kubeconfigFile)
@@ -78,6 +108,11 @@ func newCmdManager(out io.Writer) *cobra.Command {
 			err = controller.AddToManager(mgr)
 			kubeadmutil.CheckErr(err)
 
+			if len(regcfg.MetricsAddr) > 0 {
+				glog.V(1).Infof("[kubic] serving metrics at %s", regcfg.MetricsAddr)
+				go serveMetrics(regcfg.MetricsAddr)
+			}
+
 			glog.V(1).Infof("[kubic] starting the controller")
 			err = mgr.Start(signals.SetupSignalHandler())
 			kubeadmutil.CheckErr(err)
@@ -88,10 +123,36 @@ func newCmdManager(out io.Writer) *cobra.Command {
 	flagSet.StringVar(&kubeconfigFile, "kubeconfig", "", "Use this kubeconfig file for talking to the API server (not necessary when running in the kuberentes cluster).")
 	flagSet.StringVar(&regcfg.DefaultPrefix, "prefix", regcfg.DefaultPrefix, "A prefix for all the resources created by the operator.")
 	flagSet.IntVar(&regcfg.DefaultDeployNumReplicas, "replicas", regcfg.DefaultDeployNumReplicas, "Default number of replicas in the Dex Deployment.")
+	flagSet.StringVar(&regcfg.InstallMode, "install-mode", regcfg.InstallMode, fmt.Sprintf("How certificates are installed in the nodes: '%s' (one-shot Jobs), '%s' (the node agents DaemonSet) or '%s' (one-shot Jobs for all the registries in each node).", regcfg.InstallModeJob, regcfg.InstallModeAgent, regcfg.InstallModeBatch))
+	flagSet.StringVar(&regcfg.NodeImage, "node-image", regcfg.NodeImage, "Image used in the Jobs that run the operator's node commands.")
+	flagSet.IntSliceVar(&regcfg.CertExpiryWarningDays, "cert-expiry-warnings", regcfg.CertExpiryWarningDays, "Days before the expiration of a certificate when a warning is emitted.")
+	flagSet.DurationVar(&regcfg.HealthProbePeriod, "health-probe-period", regcfg.HealthProbePeriod, "Time between probes of the registries (disabled when 0).")
+	flagSet.DurationVar(&regcfg.DriftCheckPeriod, "drift-check-period", regcfg.DriftCheckPeriod, "Time between verifications of the certificates installed in the nodes (disabled when 0). Every verification runs a Job per node and Registry (a Job per node in the batch mode).")
+	flagSet.StringVar(&regcfg.RuntimeReloadPolicy, "runtime-reload", regcfg.RuntimeReloadPolicy, fmt.Sprintf("Reload the runtimes in the nodes after modifying their configuration: '%s', '%s' or '%s' (the Jobs will run privileged in the host PID namespace).", node.ReloadNever, node.ReloadOnly, node.ReloadRestart))
+	flagSet.StringSliceVar(&regcfg.RuntimeTargets, "runtime-targets", regcfg.RuntimeTargets, fmt.Sprintf("Runtime targets configured in the nodes (%v), unless overridden with a label in the node (detected from the runtime of every node when empty).", node.RuntimeTargetNames()))
+	flagSet.StringVar(&jobPodConfigFile, "jobs-pod-config", "", "YAML file with overrides for the pod template of the Jobs (image, imagePullSecrets, resources, tolerations, priorityClassName, securityContext, containerSecurityContext and appArmorProfile).")
+	flagSet.StringVar(&regcfg.JobNamespace, "jobs-namespace", regcfg.JobNamespace, "Namespace where the Jobs are launched (the certificate Secrets are copied to this namespace when needed).")
+	flagSet.IntVar(&regcfg.JobSuccessfulHistoryLimit, "successful-jobs-history-limit", regcfg.JobSuccessfulHistoryLimit, "Successful Jobs kept for every Registry once processed (no limit when negative).")
+	flagSet.IntVar(&regcfg.JobFailedHistoryLimit, "failed-jobs-history-limit", regcfg.JobFailedHistoryLimit, "Failed Jobs kept for every Registry once processed (no limit when negative).")
+	flagSet.IntVar(&regcfg.JobTTLSecondsAfterFinished, "jobs-ttl-seconds-after-finished", regcfg.JobTTLSecondsAfterFinished, "Seconds the finished Jobs are kept within the history limits (forever when 0).")
+	flagSet.BoolVar(&regcfg.NodeReadinessTaint, "node-readiness-taint", regcfg.NodeReadinessTaint, "Remove the 'registries.kubic.opensuse.org/not-ready' taint from the nodes once all the certificates have been installed in them (the nodes must be registered with this taint).")
+	flagSet.IntVar(&regcfg.InstallRetryLimit, "install-retry-limit", regcfg.InstallRetryLimit, "Failed installations of a certificate in a node before giving up in that node, until the Registry or its Secret change (retried forever when 0).")
+	flagSet.DurationVar(&regcfg.InstallRetryBackoff, "install-retry-backoff", regcfg.InstallRetryBackoff, "Delay before retrying a failed installation, doubled after every failure.")
+	flagSet.DurationVar(&regcfg.InstallRetryMaxBackoff, "install-retry-max-backoff", regcfg.InstallRetryMaxBackoff, "Maximum delay before retrying a failed installation.")
+	flagSet.StringVar(&regcfg.MetricsAddr, "metrics-addr", regcfg.MetricsAddr, "Address where the Prometheus metrics are served (disabled when empty).")
 
 	return cmd
 }
 
+// serveMetrics serves the Prometheus metrics at "/metrics"
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when serving metrics: %s", err)
+	}
+}
+
 func newCmdVersion(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "version",
@@ -122,6 +183,7 @@ func main() {
 
 	cmds.ResetFlags()
 	cmds.AddCommand(newCmdManager(os.Stdout))
+	cmds.AddCommand(newCmdNode(os.Stdout))
 	cmds.AddCommand(newCmdVersion(os.Stdout))
 
 	err := cmds.Execute()
@@ -0,0 +1,283 @@
+/*
+Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	kubeadmutil "k8s.io/kubernetes/cmd/kubeadm/app/util"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/signals"
+
+	"github.com/kubic-project/registries-operator/pkg/apis"
+	"github.com/kubic-project/registries-operator/pkg/controller/agent"
+	"github.com/kubic-project/registries-operator/pkg/node"
+)
+
+// newCmdNode runs commands in a node
+func newCmdNode(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "node",
+		Short: "Run commands in a node of the cluster (used by the Jobs launched by the operator).",
+	}
+
+	cmd.AddCommand(newCmdNodeAgent(out))
+	cmd.AddCommand(newCmdNodeInstall(out))
+	cmd.AddCommand(newCmdNodeRemove(out))
+	cmd.AddCommand(newCmdNodeProbe(out))
+	cmd.AddCommand(newCmdNodeVerify(out))
+	cmd.AddCommand(newCmdNodeConverge(out))
+
+	return cmd
+}
+
+// newCmdNodeAgent runs the node agent
+func newCmdNodeAgent(out io.Writer) *cobra.Command {
+	var nodeName = os.Getenv("NODE_NAME")
+	var root = "/"
+	var reload = string(node.ReloadNever)
+	var targets = []string{}
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Run the node agent, installing the certificates of the registries in this node (used by the agents DaemonSet).",
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+
+			if len(nodeName) == 0 {
+				fmt.Fprintf(os.Stderr, "error: no --node-name provided\n")
+				os.Exit(1)
+			}
+			if err := node.ValidateReloadPolicy(node.ReloadPolicy(reload)); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --runtime-reload: %v\n", err)
+				os.Exit(1)
+			}
+			if err := node.ValidateRuntimeTargets(targets); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --runtime-targets: %v\n", err)
+				os.Exit(1)
+			}
+
+			glog.V(1).Infof("[kubic] getting a kubeconfig to talk to the API server")
+			kubeconfig, err := config.GetConfig()
+			kubeadmutil.CheckErr(err)
+
+			glog.V(1).Infof("[kubic] creating a new manager for the agent in node '%s'", nodeName)
+			mgr, err := manager.New(kubeconfig, manager.Options{})
+			kubeadmutil.CheckErr(err)
+
+			glog.V(1).Infof("[kubic] setting up the scheme for all the resources")
+			err = apis.AddToScheme(mgr.GetScheme())
+			kubeadmutil.CheckErr(err)
+
+			glog.V(1).Infof("[kubic] setting up the node agent")
+			err = agent.Add(mgr, nodeName, root, targets, node.ReloadPolicy(reload))
+			kubeadmutil.CheckErr(err)
+
+			glog.V(1).Infof("[kubic] starting the node agent")
+			err = mgr.Start(signals.SetupSignalHandler())
+			kubeadmutil.CheckErr(err)
+		},
+	}
+
+	flagSet := cmd.Flags()
+	flagSet.StringVar(&nodeName, "node-name", nodeName, "The name of this node.")
+	flagSet.StringVar(&root, "root", root, "The root filesystem of the node (where the certificates are installed).")
+	flagSet.StringSliceVar(&targets, "runtime-targets", targets, fmt.Sprintf("Runtime targets configured in this node (%v), unless overridden with a label in the node (detected from the runtime of the node when empty).", node.RuntimeTargetNames()))
+	flagSet.StringVar(&reload, "runtime-reload", reload, fmt.Sprintf("Reload the runtimes after modifying their configuration: '%s', '%s' or '%s' (needs the host PID namespace and a privileged container).", node.ReloadNever, node.ReloadOnly, node.ReloadRestart))
+
+	return cmd
+}
+
+// newCmdNodeInstall installs a certificate in the node
+func newCmdNodeInstall(out io.Writer) *cobra.Command {
+	return newCmdNodeInstallSpec(out, "install",
+		"Install the certificate of a registry in this node.",
+		node.Install)
+}
+
+// newCmdNodeRemove removes a certificate from the node
+func newCmdNodeRemove(out io.Writer) *cobra.Command {
+	return newCmdNodeInstallSpec(out, "remove",
+		"Remove the certificate of a registry from this node.",
+		node.Remove)
+}
+
+// newCmdNodeInstallSpec returns a command that runs `action` with a node.InstallSpec
+func newCmdNodeInstallSpec(out io.Writer, use string, short string, action func(string, string, node.InstallSpec) (node.InstallResult, error)) *cobra.Command {
+	var specJSON = ""
+	var root = "/"
+	var nodeName = os.Getenv("NODE_NAME")
+	var terminationLog = node.DefaultTerminationMessagePath
+
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			spec := node.InstallSpec{}
+			if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --spec: %v\n", err)
+				os.Exit(1)
+			}
+
+			// the result is reported to the controller, even when the action fails
+			res, err := action(root, nodeName, spec)
+			if err := node.WriteTerminationMessage(terminationLog, res); err != nil {
+				glog.V(1).Infof("[kubic] ERROR: could not write the termination message: %s", err)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(out, "%s: done\n", spec.HostPort)
+		},
+	}
+
+	flagSet := cmd.Flags()
+	flagSet.StringVar(&specJSON, "spec", specJSON, "The specification (in JSON) of the certificate (ie, '{\"hostPort\": \"registry.suse.de:5000\", \"caFile\": \"/secrets/ca.crt\"}').")
+	flagSet.StringVar(&root, "root", root, "The root filesystem of the node (where the certificates are installed).")
+	flagSet.StringVar(&nodeName, "node-name", nodeName, "The name of this node.")
+	flagSet.StringVar(&terminationLog, "termination-log", terminationLog, "File where the result is written.")
+
+	return cmd
+}
+
+// newCmdNodeProbe probes a registry from the node
+func newCmdNodeProbe(out io.Writer) *cobra.Command {
+	var hostPort = ""
+	var caFile = ""
+	var nodeName = os.Getenv("NODE_NAME")
+	var terminationLog = node.DefaultTerminationMessagePath
+	var timeout = 10 * time.Second
+
+	cmd := &cobra.Command{
+		Use:   "probe",
+		Short: "Try a TLS handshake with a registry using the certificate installed in the node.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(hostPort) == 0 {
+				fmt.Fprintf(os.Stderr, "error: no --host-port provided\n")
+				os.Exit(1)
+			}
+
+			res := node.Probe(nodeName, hostPort, caFile, timeout)
+			fmt.Fprintf(out, "%s reachable from %s: %t %s\n", hostPort, nodeName, res.Reachable, res.Error)
+
+			// a failed probe is not an error: it is reported to the controller
+			if err := node.WriteTerminationMessage(terminationLog, res); err != nil {
+				glog.V(1).Infof("[kubic] ERROR: could not write the termination message: %s", err)
+			}
+		},
+	}
+
+	flagSet := cmd.Flags()
+	flagSet.StringVar(&hostPort, "host-port", hostPort, "The registry HOST:PORT address.")
+	flagSet.StringVar(&caFile, "ca-file", caFile, "The CA.crt installed in the node.")
+	flagSet.StringVar(&nodeName, "node-name", nodeName, "The name of this node.")
+	flagSet.StringVar(&terminationLog, "termination-log", terminationLog, "File where the result is written.")
+	flagSet.DurationVar(&timeout, "timeout", timeout, "Timeout for connecting to the registry.")
+
+	return cmd
+}
+
+// newCmdNodeVerify reports the certificate installed in the node for a registry
+func newCmdNodeVerify(out io.Writer) *cobra.Command {
+	var specJSON = ""
+	var root = "/"
+	var nodeName = os.Getenv("NODE_NAME")
+	var terminationLog = node.DefaultTerminationMessagePath
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Report the hash of the certificate installed in this node for a registry.",
+		Run: func(cmd *cobra.Command, args []string) {
+			spec := node.InstallSpec{}
+			if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --spec: %v\n", err)
+				os.Exit(1)
+			}
+
+			res, err := node.Verify(root, nodeName, spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(out, "%s in %s: '%s'\n", spec.HostPort, nodeName, res.Hash)
+
+			if err := node.WriteTerminationMessage(terminationLog, res); err != nil {
+				fmt.Fprintf(os.Stderr, "error: could not write the termination message: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	flagSet := cmd.Flags()
+	flagSet.StringVar(&specJSON, "spec", specJSON, "The specification (in JSON) of the certificate (ie, '{\"hostPort\": \"registry.suse.de:5000\"}').")
+	flagSet.StringVar(&root, "root", root, "The root filesystem of the node (where the certificates are installed).")
+	flagSet.StringVar(&nodeName, "node-name", nodeName, "The name of this node.")
+	flagSet.StringVar(&terminationLog, "termination-log", terminationLog, "File where the result is written.")
+
+	return cmd
+}
+
+// newCmdNodeConverge converges the node for all the registries
+func newCmdNodeConverge(out io.Writer) *cobra.Command {
+	var stateJSON = ""
+	var root = "/"
+	var nodeName = os.Getenv("NODE_NAME")
+	var terminationLog = node.DefaultTerminationMessagePath
+
+	cmd := &cobra.Command{
+		Use:   "converge",
+		Short: "Install (and remove) the certificates of all the registries in this node.",
+		Run: func(cmd *cobra.Command, args []string) {
+			state := node.NodeState{}
+			if err := json.Unmarshal([]byte(stateJSON), &state); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --state: %v\n", err)
+				os.Exit(1)
+			}
+			if err := state.Validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid --state: %v\n", err)
+				os.Exit(1)
+			}
+
+			// the failures in some registries are reported to the controller
+			res := node.Converge(root, nodeName, state)
+			for _, rr := range res.Registries {
+				fmt.Fprintf(out, "%s in %s: '%s' %s\n", rr.Name, nodeName, rr.Hash, rr.Error)
+			}
+
+			if err := node.WriteTerminationMessage(terminationLog, res); err != nil {
+				fmt.Fprintf(os.Stderr, "error: could not write the termination message: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	flagSet := cmd.Flags()
+	flagSet.StringVar(&stateJSON, "state", stateJSON, "The desired state (in JSON) of the node (ie, '{\"install\": [{\"name\": \"suse\", \"hostPort\": \"registry.suse.de:5000\", \"caFile\": \"/secrets/suse/ca.crt\"}]}').")
+	flagSet.StringVar(&root, "root", root, "The root filesystem of the node (where the certificates are installed).")
+	flagSet.StringVar(&nodeName, "node-name", nodeName, "The name of this node.")
+	flagSet.StringVar(&terminationLog, "termination-log", terminationLog, "File where the result is written.")
+
+	return cmd
+}
@@ -2,6 +2,7 @@ module github.com/kubic-project/registries-operator
 
 require (
 	cloud.google.com/go v0.30.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/docker/distribution v2.6.2+incompatible // indirect
 	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/go-logr/logr v0.1.0 // indirect
@@ -20,6 +21,7 @@ require (
 	github.com/json-iterator/go v1.1.5 // indirect
 	github.com/markbates/inflect v1.0.4 // indirect
 	github.com/mattbaird/jsonpatch v0.0.0-20171005235357-81af80346b1a // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
 	github.com/onsi/ginkgo v1.6.0
@@ -27,6 +29,10 @@ require (
 	github.com/pborman/uuid v0.0.0-20180906182336-adf5a7427709 // indirect
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
 	github.com/pkg/errors v0.8.0 // indirect
+	github.com/prometheus/client_golang v0.9.0
+	github.com/prometheus/client_model v0.0.0-20170216185247-6f3806018612 // indirect
+	github.com/prometheus/common v0.0.0-20181126121408-4724e9255275 // indirect
+	github.com/prometheus/procfs v0.0.0-20181204211112-1dc9a6cbc91a // indirect
 	github.com/renstrom/dedent v1.0.0
 	github.com/spf13/afero v1.1.2 // indirect
 	github.com/spf13/cobra v0.0.3
@@ -39,7 +45,7 @@ require (
 	golang.org/x/crypto v0.0.0-20180222182404-49796115aa4b // indirect
 	golang.org/x/net v0.0.0-20181005035420-146acd28ed58
 	golang.org/x/oauth2 v0.0.0-20181003184128-c57b0facaced // indirect
-	golang.org/x/sys v0.0.0-20181005133103-4497e2df6f9e // indirect
+	golang.org/x/sys v0.0.0-20181005133103-4497e2df6f9e
 	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2 // indirect
 	golang.org/x/tools v0.0.0-20181130052023-1c3d964395ce // indirect
 	google.golang.org/appengine v1.2.0 // indirect
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package v1beta1
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RegistryConditionType is a valid value for RegistryCondition.Type
+type RegistryConditionType string
+
+const (
+	// RegistryCertificateExpiring means that the certificate for this Registry
+	// has expired or will expire soon
+	RegistryCertificateExpiring RegistryConditionType = "CertificateExpiring"
+
+	// RegistryCertificateVerified means that the registry presented a certificate
+	// that could be verified with the certificate of this Registry
+	RegistryCertificateVerified RegistryConditionType = "CertificateVerified"
+
+	// RegistryCertificateDrifted means that the certificate installed in some
+	// Nodes does not match the certificate of this Registry anymore
+	RegistryCertificateDrifted RegistryConditionType = "CertificateDrifted"
+
+	// RegistryFailed means that the installation of the certificate has failed
+	// too many times, and it will not be retried until the Registry (or its Secret) changes
+	RegistryFailed RegistryConditionType = "Failed"
+)
+
+// RegistryCondition contains details for the current condition of this Registry
+type RegistryCondition struct {
+	// Type is the type of the condition
+	Type RegistryConditionType `json:"type"`
+
+	// Status is the status of the condition (one of True, False, Unknown)
+	Status v1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition transitioned from one status to another
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a unique, one-word, CamelCase reason for the condition's last transition
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human-readable message indicating details about last transition
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// GetCondition returns the condition with the given type (or nil if not found)
+func (status *RegistryStatus) GetCondition(conditionType RegistryConditionType) *RegistryCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition sets the condition with the given type, returning true when
+// the status or the reason of the condition have changed
+func (status *RegistryStatus) SetCondition(conditionType RegistryConditionType, conditionStatus v1.ConditionStatus, reason, message string) bool {
+	cond := status.GetCondition(conditionType)
+	if cond == nil {
+		status.Conditions = append(status.Conditions, RegistryCondition{Type: conditionType})
+		cond = &status.Conditions[len(status.Conditions)-1]
+	}
+
+	changed := cond.Status != conditionStatus || cond.Reason != reason
+	if cond.Status != conditionStatus {
+		cond.LastTransitionTime = metav1.Now()
+	}
+	cond.Status = conditionStatus
+	cond.Reason = reason
+	cond.Message = message
+
+	return changed
+}
+
+// RemoveCondition removes the condition with the given type
+func (status *RegistryStatus) RemoveCondition(conditionType RegistryConditionType) {
+	var res []RegistryCondition
+	for _, cond := range status.Conditions {
+		if cond.Type != conditionType {
+			res = append(res, cond)
+		}
+	}
+	status.Conditions = res
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package v1beta1
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+)
+
+func TestSetCondition(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	status := RegistryStatus{}
+
+	changed := status.SetCondition(RegistryCertificateExpiring, v1.ConditionFalse, "Valid", "valid")
+	g.Expect(changed).Should(BeTrue())
+	g.Expect(status.Conditions).Should(HaveLen(1))
+
+	//setting the same status and reason is not a change
+	changed = status.SetCondition(RegistryCertificateExpiring, v1.ConditionFalse, "Valid", "still valid")
+	g.Expect(changed).Should(BeFalse())
+	g.Expect(status.GetCondition(RegistryCertificateExpiring).Message).Should(Equal("still valid"))
+
+	changed = status.SetCondition(RegistryCertificateExpiring, v1.ConditionTrue, "Expired", "expired")
+	g.Expect(changed).Should(BeTrue())
+	g.Expect(status.Conditions).Should(HaveLen(1))
+
+	status.RemoveCondition(RegistryCertificateExpiring)
+	g.Expect(status.GetCondition(RegistryCertificateExpiring)).Should(BeNil())
+}
@@ -38,12 +38,65 @@ type RegistrySpec struct {
 	// Name of the certificate (stored in a Secret) to use for this registry
 	// +optional
 	Certificate *v1.SecretReference `json:"certificate,omitempty"`
+
+	// Credentials is a Secret (of type "kubernetes.io/basic-auth") with the
+	// username and password used when probing the registry
+	// +optional
+	Credentials *v1.SecretReference `json:"credentials,omitempty"`
+
+	// Preflight enables a TLS check against HostPort (using the certificate)
+	// before the certificate is installed in the Nodes
+	// +optional
+	Preflight *RegistryPreflight `json:"preflight,omitempty"`
+
+	// NodeProbe enables a TLS check against HostPort from every Node,
+	// using the certificate installed in the Node
+	// +optional
+	NodeProbe bool `json:"nodeProbe,omitempty"`
+
+	// Insecure disables the verification of the registry certificate in the Nodes
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Mirrors are the HOST:PORT addresses of some mirrors of this registry,
+	// tried (in order) before the registry (Docker only supports mirrors for Docker Hub)
+	// +optional
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// Blocked forbids pulling images from this registry in the Nodes
+	// (only supported by CRI-O and podman)
+	// +optional
+	Blocked bool `json:"blocked,omitempty"`
+
+	// SystemTrust installs the CA.crt in the system trust store of the Nodes
+	// too (detected from the OS of the Node), so it is trusted by other tools
+	// +optional
+	SystemTrust bool `json:"systemTrust,omitempty"`
+}
+
+// RegistryPreflight defines the checks performed before installing a certificate
+type RegistryPreflight struct {
+	// IgnoreFailure installs the certificate even when the check fails
+	// +optional
+	IgnoreFailure bool `json:"ignoreFailure,omitempty"`
 }
 
 // RegistryStatus defines the observed state of Registry
 type RegistryStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	Certificate RegistryCertificateStatus
+
+	// Conditions is the list of conditions observed for this Registry
+	// +optional
+	Conditions []RegistryCondition `json:"conditions,omitempty"`
+
+	// Health is the result of the last probe of the registry
+	// +optional
+	Health *RegistryHealthStatus `json:"health,omitempty"`
+
+	// Nodes is the status of this Registry in each Node
+	// +optional
+	Nodes []RegistryNodeStatus `json:"nodes,omitempty"`
 }
 
 // RegistryCertificateStatus defines the observed state of Registry
@@ -57,6 +110,84 @@ type RegistryCertificateStatus struct {
 
 	// Number of Nodes where this has been installed
 	NumNodes int
+
+	// NotAfter is the expiration time of the certificate (when the CA.crt
+	// contains a bundle, the expiration time of the first certificate to expire)
+	// +optional
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+}
+
+// RegistryHealthStatus is the result of probing the "/v2/" endpoint of the registry
+type RegistryHealthStatus struct {
+	// Reachable is true when the registry returned a valid response
+	Reachable bool `json:"reachable"`
+
+	// StatusCode is the HTTP status code returned by the registry
+	// +optional
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// AuthChallenge is the authentication scheme requested by the registry (ie, "Basic", "Bearer")
+	// +optional
+	AuthChallenge string `json:"authChallenge,omitempty"`
+
+	// Latency is the time it took to get a response from the registry
+	// +optional
+	Latency metav1.Duration `json:"latency,omitempty"`
+
+	// Error is the error found when probing the registry
+	// +optional
+	Error string `json:"error,omitempty"`
+
+	// LastProbeTime is the last time the registry was probed
+	// +optional
+	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
+}
+
+// RegistryNodeStatus defines the observed state of Registry in a Node
+type RegistryNodeStatus struct {
+	// Name is the name of the Node
+	Name string `json:"name"`
+
+	// CurrentHash is the hash of the certificate installed in the Node
+	// +optional
+	CurrentHash string `json:"currentHash,omitempty"`
+
+	// Reachable is true when the registry could be reached from the Node
+	// with the certificate installed
+	// +optional
+	Reachable *bool `json:"reachable,omitempty"`
+
+	// LastProbeTime is the last time the registry was probed from the Node
+	// +optional
+	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
+
+	// LastVerifyTime is the last time the certificate installed in the Node was verified
+	// +optional
+	LastVerifyTime metav1.Time `json:"lastVerifyTime,omitempty"`
+
+	// LastError is the last error found in the Node
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// Runtimes are the container runtimes detected in the Node
+	// +optional
+	Runtimes []string `json:"runtimes,omitempty"`
+
+	// SystemTrust is true when the CA.crt has been installed in the system trust store of the Node
+	// +optional
+	SystemTrust bool `json:"systemTrust,omitempty"`
+
+	// FailedHash is the hash of the certificate whose installation has failed in the Node
+	// +optional
+	FailedHash string `json:"failedHash,omitempty"`
+
+	// Failures is the number of failed installations of the certificate with FailedHash
+	// +optional
+	Failures int `json:"failures,omitempty"`
+
+	// LastFailureTime is the last time the installation of the certificate failed in the Node
+	// +optional
+	LastFailureTime metav1.Time `json:"lastFailureTime,omitempty"`
 }
 
 // +genclient
@@ -88,6 +219,41 @@ func (registry Registry) GetCertificateSecret(r client.Client) (*v1.Secret, erro
 
 }
 
+// GetCredentialsSecret gets the credentials for a registry
+func (registry Registry) GetCredentialsSecret(r client.Client) (*v1.Secret, error) {
+	if registry.Spec.Credentials == nil {
+		return nil, nil
+	}
+
+	secret := &v1.Secret{}
+	err := r.Get(nil, types.NamespacedName{Name: registry.Spec.Credentials.Name, Namespace: registry.Spec.Credentials.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// UsesSecret returns true if the registry uses the given Secret
+func (registry Registry) UsesSecret(name, namespace string) bool {
+	for _, ref := range []*v1.SecretReference{registry.Spec.Certificate, registry.Spec.Credentials} {
+		if ref != nil && ref.Name == name && ref.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNodeStatus returns the status of this Registry in a Node, creating it when not found
+func (status *RegistryStatus) GetNodeStatus(name string) *RegistryNodeStatus {
+	for i := range status.Nodes {
+		if status.Nodes[i].Name == name {
+			return &status.Nodes[i]
+		}
+	}
+	status.Nodes = append(status.Nodes, RegistryNodeStatus{Name: name})
+	return &status.Nodes[len(status.Nodes)-1]
+}
+
 // String returns registry HOST:PORT formatted address
 func (registry Registry) String() string {
 	return fmt.Sprintf("%s", registry.Spec.HostPort)
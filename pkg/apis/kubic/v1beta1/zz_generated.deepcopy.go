@@ -32,7 +32,7 @@ func (in *Registry) DeepCopyInto(out *Registry) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -57,6 +57,10 @@ func (in *Registry) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistryCertificateStatus) DeepCopyInto(out *RegistryCertificateStatus) {
 	*out = *in
+	if in.NotAfter != nil {
+		in, out := &in.NotAfter, &out.NotAfter
+		*out = (*in).DeepCopy()
+	}
 	return
 }
 
@@ -70,6 +74,41 @@ func (in *RegistryCertificateStatus) DeepCopy() *RegistryCertificateStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryCondition) DeepCopyInto(out *RegistryCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryCondition.
+func (in *RegistryCondition) DeepCopy() *RegistryCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryHealthStatus) DeepCopyInto(out *RegistryHealthStatus) {
+	*out = *in
+	out.Latency = in.Latency
+	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryHealthStatus.
+func (in *RegistryHealthStatus) DeepCopy() *RegistryHealthStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryHealthStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistryList) DeepCopyInto(out *RegistryList) {
 	*out = *in
@@ -103,6 +142,51 @@ func (in *RegistryList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryNodeStatus) DeepCopyInto(out *RegistryNodeStatus) {
+	*out = *in
+	if in.Reachable != nil {
+		in, out := &in.Reachable, &out.Reachable
+		*out = new(bool)
+		**out = **in
+	}
+	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+	in.LastVerifyTime.DeepCopyInto(&out.LastVerifyTime)
+	if in.Runtimes != nil {
+		in, out := &in.Runtimes, &out.Runtimes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.LastFailureTime.DeepCopyInto(&out.LastFailureTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryNodeStatus.
+func (in *RegistryNodeStatus) DeepCopy() *RegistryNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryPreflight) DeepCopyInto(out *RegistryPreflight) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryPreflight.
+func (in *RegistryPreflight) DeepCopy() *RegistryPreflight {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryPreflight)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistrySpec) DeepCopyInto(out *RegistrySpec) {
 	*out = *in
@@ -111,6 +195,21 @@ func (in *RegistrySpec) DeepCopyInto(out *RegistrySpec) {
 		*out = new(v1.SecretReference)
 		**out = **in
 	}
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(v1.SecretReference)
+		**out = **in
+	}
+	if in.Preflight != nil {
+		in, out := &in.Preflight, &out.Preflight
+		*out = new(RegistryPreflight)
+		**out = **in
+	}
+	if in.Mirrors != nil {
+		in, out := &in.Mirrors, &out.Mirrors
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -127,7 +226,26 @@ func (in *RegistrySpec) DeepCopy() *RegistrySpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RegistryStatus) DeepCopyInto(out *RegistryStatus) {
 	*out = *in
-	out.Certificate = in.Certificate
+	in.Certificate.DeepCopyInto(&out.Certificate)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]RegistryCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Health != nil {
+		in, out := &in.Health, &out.Health
+		*out = new(RegistryHealthStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]RegistryNodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
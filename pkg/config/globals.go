@@ -17,6 +17,22 @@
 
 package config
 
+import (
+	"time"
+)
+
+const (
+	// InstallModeJob installs the certificates with Jobs launched by the controller
+	InstallModeJob = "job"
+
+	// InstallModeAgent installs the certificates with the node agents (running in a DaemonSet)
+	InstallModeAgent = "agent"
+
+	// InstallModeBatch installs the certificates of all the registries with a single
+	// Job per node launched by the controller
+	InstallModeBatch = "batch"
+)
+
 var (
 	// DefaultPrefix for all the resources created by the operator
 	DefaultPrefix = "regsop"
@@ -24,6 +40,67 @@ var (
 	// JobServiceAccountName is the service account name for spawned jobs
 	JobServiceAccountName = "regs-jobs"
 
+	// JobNamespace is the namespace where the Jobs are launched (the Secrets mounted
+	// in the Jobs are copied to this namespace when they live in a different one)
+	JobNamespace = "kube-system"
+
+	// JobSuccessfulHistoryLimit is the number of successful Jobs kept (for every
+	// Registry) once they have been processed (no limit when negative)
+	JobSuccessfulHistoryLimit = 0
+
+	// JobFailedHistoryLimit is the number of failed Jobs kept (for every
+	// Registry) once they have been processed (no limit when negative)
+	JobFailedHistoryLimit = 0
+
+	// JobTTLSecondsAfterFinished is the time the finished Jobs are kept (forever
+	// when zero, as long as they are within the history limits)
+	JobTTLSecondsAfterFinished = 0
+
+	// NodeImage is the image used in the jobs that run the operator's node commands
+	NodeImage = "opensuse/registries-operator"
+
+	// InstallMode is the way certificates are installed in the nodes (InstallModeJob,
+	// InstallModeAgent or InstallModeBatch)
+	InstallMode = InstallModeJob
+
 	// DefaultDeployNumReplicas is the  number of replicas for the Deployment
 	DefaultDeployNumReplicas = 3
+
+	// CertExpiryWarningDays are the thresholds (in days before the expiration of
+	// a certificate) where we will warn about the certificate expiring
+	CertExpiryWarningDays = []int{30, 7, 1}
+
+	// HealthProbePeriod is the time between probes of the registries (disabled when zero)
+	HealthProbePeriod = 5 * time.Minute
+
+	// DriftCheckPeriod is the time between verifications of the certificates
+	// installed in the nodes (disabled when zero). Every verification runs a Job
+	// per node and Registry (or a Job per node in the "batch" mode).
+	DriftCheckPeriod = 24 * time.Hour
+
+	// RuntimeReloadPolicy is the policy for reloading the container runtimes in the
+	// nodes after their configuration is modified ("Never", "Reload" or "Restart")
+	RuntimeReloadPolicy = "Never"
+
+	// RuntimeTargets are the runtime targets configured in the nodes (detected
+	// from the runtime of every node when empty)
+	RuntimeTargets = []string{}
+
+	// NodeReadinessTaint enables the removal of the "not-ready" taint of the Nodes
+	// once the certificates of all the Registries have been installed in them
+	NodeReadinessTaint = false
+
+	// InstallRetryLimit is the number of failed installations of a certificate in a Node
+	// before giving up in that Node (retried forever when zero)
+	InstallRetryLimit = 10
+
+	// InstallRetryBackoff is the delay before retrying a failed installation,
+	// doubled after every failure (up to InstallRetryMaxBackoff)
+	InstallRetryBackoff = 10 * time.Second
+
+	// InstallRetryMaxBackoff is the maximum delay before retrying a failed installation
+	InstallRetryMaxBackoff = 10 * time.Minute
+
+	// MetricsAddr is the address where the Prometheus metrics are served (disabled when empty)
+	MetricsAddr = ":8080"
 )
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// JobPodConfig overrides some fields in the pod template of the Jobs that
+// run the operator's node commands
+type JobPodConfig struct {
+	// Image used in the Jobs (instead of NodeImage)
+	Image string `json:"image,omitempty"`
+
+	// ImagePullPolicy for the image used in the Jobs
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// ImagePullSecrets for pulling the image (they must exist in the JobNamespace)
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Resources required by all the containers in the Jobs
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Tolerations added to the default tolerations of the Jobs
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// PriorityClassName of the pods of the Jobs
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// SecurityContext of the pods of the Jobs
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+
+	// ContainerSecurityContext of all the containers in the Jobs (the containers
+	// are still privileged when the runtimes must be reloaded)
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// AppArmorProfile for all the containers in the Jobs ("runtime/default",
+	// "unconfined" or "localhost/<profile>")
+	AppArmorProfile string `json:"appArmorProfile,omitempty"`
+}
+
+// JobPod are the overrides for the pod template of the Jobs
+var JobPod = JobPodConfig{}
+
+// LoadJobPodConfig loads the overrides for the pod template of the Jobs from a YAML (or JSON) file
+func LoadJobPodConfig(filename string) (JobPodConfig, error) {
+	res := JobPodConfig{}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&res); err != nil {
+		return res, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	if err := res.Validate(); err != nil {
+		return res, fmt.Errorf("invalid configuration in %s: %s", filename, err)
+	}
+	return res, nil
+}
+
+// Validate checks the overrides for the pod template of the Jobs
+func (cfg JobPodConfig) Validate() error {
+	switch cfg.ImagePullPolicy {
+	case "", corev1.PullAlways, corev1.PullNever, corev1.PullIfNotPresent:
+	default:
+		return fmt.Errorf("unknown imagePullPolicy '%s'", cfg.ImagePullPolicy)
+	}
+
+	profile := cfg.AppArmorProfile
+	if len(profile) > 0 && profile != "runtime/default" && profile != "unconfined" &&
+		(!strings.HasPrefix(profile, "localhost/") || profile == "localhost/") {
+		return fmt.Errorf("unknown appArmorProfile '%s'", profile)
+	}
+	return nil
+}
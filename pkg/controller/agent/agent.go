@@ -0,0 +1,301 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+)
+
+const (
+	// the node agent controller name
+	agentControllerName = "KubicRegistriesNodeAgent"
+
+	// time between checks of the certificates installed in the node
+	// (so we can fix any modification done by someone else)
+	agentResyncPeriod = 10 * time.Minute
+
+	// timeout for probing the registries from the node
+	agentProbeTimeout = 10 * time.Second
+)
+
+// Add creates a new node agent Controller and adds it to the Manager.
+// The agent installs the certificates of all the Registries in the node `nodeName`,
+// using `root` as the root filesystem of the node, installing the configuration
+// in the runtime `targets` (all the targets when empty) and reloading the
+// runtimes after any change depending on `reload`.
+func Add(mgr manager.Manager, nodeName string, root string, targets []string, reload node.ReloadPolicy) error {
+	// the agents can only get their Node (they cannot watch all the Nodes),
+	// so it is read without the cache of the manager
+	nodeReader, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+	if err != nil {
+		return err
+	}
+	return addAgentController(mgr, newAgentReconcilier(mgr, nodeReader, nodeName, root, targets, reload))
+}
+
+// newAgentReconcilier returns a new reconcile.Reconciler
+func newAgentReconcilier(mgr manager.Manager, nodeReader client.Reader, nodeName string, root string, targets []string, reload node.ReloadPolicy) reconcile.Reconciler {
+	return &ReconcileNodeAgent{
+		Client:        mgr.GetClient(),
+		EventRecorder: mgr.GetRecorder(agentControllerName),
+		nodeReader:    nodeReader,
+		nodeName:      nodeName,
+		root:          root,
+		targets:       targets,
+		reload:        reload,
+	}
+}
+
+// addAgentController adds a new Controller to mgr with r as the reconcile.Reconciler
+func addAgentController(mgr manager.Manager, r reconcile.Reconciler) error {
+	agentController, err := controller.New(agentControllerName, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to Registry
+	err = agentController.Watch(&source.Kind{Type: &kubicv1beta1.Registry{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Watch the Secrets, just in case the secret in the registry changes
+	if err = agentController.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: secretToRegistryMapper{mgr.GetClient()},
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var _ reconcile.Reconciler = &ReconcileNodeAgent{}
+
+// ReconcileNodeAgent reconciles the certificates installed in a node
+// with the Registry objects
+type ReconcileNodeAgent struct {
+	client.Client
+	record.EventRecorder
+	nodeReader client.Reader
+	nodeName   string
+	root       string
+	targets    []string
+	reload     node.ReloadPolicy
+}
+
+// Reconcile installs (or removes) the certificate of a Registry in the node,
+// reporting the result in the Registry.Status.Nodes
+//
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create
+// +kubebuilder:rbac:groups=kubic.opensuse.org,resources=registries,verbs=get;list;watch;update
+func (r *ReconcileNodeAgent) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	glog.V(5).Infof("[kubic] trying to reconcile registry %s in node %s", request.Name, r.nodeName)
+
+	registry := &kubicv1beta1.Registry{}
+	ctx := context.Background()
+	if err := r.Get(ctx, types.NamespacedName{Name: request.Name}, registry); err != nil {
+		if apierrors.IsNotFound(err) {
+			glog.V(3).Infof("[kubic] %s not found (%s)... ignoring", request.Name, err)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	orig := registry.DeepCopy()
+
+	// the runtime targets (and the trust store) depend on this node
+	thisNode := &corev1.Node{}
+	if err := r.nodeReader.Get(ctx, types.NamespacedName{Name: r.nodeName}, thisNode); err != nil {
+		return reconcile.Result{}, err
+	}
+	targets := node.TargetsForNode(thisNode, r.targets)
+
+	// the configuration we should have in this node (nil when it must be removed)
+	var cfg *node.HostConfig
+	if registry.ObjectMeta.DeletionTimestamp.IsZero() && registry.Spec.Certificate != nil {
+		secret, err := registry.GetCertificateSecret(r)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if len(secret.Data[node.SecretCAKey]) > 0 {
+			c := node.NewHostConfig(registry, secret)
+			c.Targets = targets
+			if c.SystemTrust {
+				c.TrustStore = node.TrustStoreForOSImage(thisNode.Status.NodeInfo.OSImage)
+			}
+			cfg = &c
+		}
+	}
+
+	changed, err := r.reconcileCert(registry, cfg, targets)
+
+	nodeStatus := registry.Status.GetNodeStatus(r.nodeName)
+	nodeStatus.CurrentHash = node.InstalledHash(r.root, registry.Name, registry.Spec.HostPort, targets...)
+	nodeStatus.Runtimes = node.DetectRuntimes(r.root)
+	if err != nil {
+		nodeStatus.LastError = err.Error()
+	} else if changed {
+		nodeStatus.LastError = ""
+		if cfg != nil && registry.Spec.NodeProbe {
+			r.probe(registry, nodeStatus, targets)
+		}
+	}
+	if err == nil {
+		nodeStatus.SystemTrust = cfg != nil && cfg.SystemTrust
+	}
+
+	if !reflect.DeepEqual(orig.Status, registry.Status) {
+		glog.V(5).Infof("[kubic] updating status of %s in node %s", registry, r.nodeName)
+		if err := r.Update(ctx, registry); err != nil {
+			if apierrors.IsNotFound(err) {
+				return reconcile.Result{}, nil
+			}
+			return reconcile.Result{}, err
+		}
+	}
+
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: agentResyncPeriod}, nil
+}
+
+// reconcileCert makes sure the configuration `cfg` is installed for the registry
+// in the runtime `targets` (or removed, when `cfg` is nil), returning true if the
+// node has been modified.
+func (r *ReconcileNodeAgent) reconcileCert(registry *kubicv1beta1.Registry, cfg *node.HostConfig, targets []string) (bool, error) {
+	hostPort := registry.Spec.HostPort
+	installedHash := node.InstalledHash(r.root, registry.Name, hostPort, targets...)
+	runtimeConfigs := node.RuntimeConfigs(r.root, registry.Name, hostPort)
+
+	if cfg == nil {
+		// only remove the certificates we have installed
+		if len(registry.Status.GetNodeStatus(r.nodeName).CurrentHash) == 0 {
+			return false, nil
+		}
+
+		glog.V(3).Infof("[kubic] removing certificate for %s from node %s", registry, r.nodeName)
+		if err := node.RemoveHostConfig(r.root, registry.Name, hostPort); err != nil {
+			glog.V(1).Infof("[kubic] ERROR: when removing certificate for %s: %s", registry, err)
+			r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeRemoveFailed",
+				fmt.Sprintf("Certificate removal failed in node '%s': %s", r.nodeName, err))
+			return false, err
+		}
+		return true, r.reloadRuntimes(registry, runtimeConfigs)
+	}
+
+	hash := cfg.Hash()
+	if installedHash == hash {
+		glog.V(5).Infof("[kubic] certificate for %s already installed in node %s", registry, r.nodeName)
+		return false, nil
+	}
+
+	if registry.Status.GetNodeStatus(r.nodeName).CurrentHash == hash {
+		// it was installed, but someone has modified the certificates in the node
+		glog.V(3).Infof("[kubic] certificate for %s has drifted in node %s", registry, r.nodeName)
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeDrifted",
+			fmt.Sprintf("Certificate '%s' not found in node '%s'... reinstalling", hash, r.nodeName))
+	}
+
+	glog.V(3).Infof("[kubic] installing certificate '%s' for %s in node %s", hash, registry, r.nodeName)
+	if err := node.InstallHostConfig(r.root, *cfg); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when installing certificate for %s: %s", registry, err)
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeInstallFailed",
+			fmt.Sprintf("Certificate '%s' installation failed in node '%s': %s", hash, r.nodeName, err))
+		return false, err
+	}
+
+	r.EventRecorder.Event(registry, corev1.EventTypeNormal, "NodeInstalled",
+		fmt.Sprintf("Certificate '%s' installed in node '%s'", hash, r.nodeName))
+	return true, r.reloadRuntimes(registry, runtimeConfigs)
+}
+
+// reloadRuntimes reloads the runtimes whose configuration has changed since `before`
+func (r *ReconcileNodeAgent) reloadRuntimes(registry *kubicv1beta1.Registry, before map[string][]byte) error {
+	if err := node.ReloadRuntimes(r.root, r.reload, registry.Name, registry.Spec.HostPort, before); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when reloading the runtimes for %s: %s", registry, err)
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeReloadFailed",
+			fmt.Sprintf("Runtimes reload failed in node '%s': %s", r.nodeName, err))
+		return err
+	}
+	return nil
+}
+
+// probe checks the registry can be reached from the node with the certificate installed
+func (r *ReconcileNodeAgent) probe(registry *kubicv1beta1.Registry, nodeStatus *kubicv1beta1.RegistryNodeStatus, targets []string) {
+	caFile := node.CertificatePath(r.root, registry.Spec.HostPort, targets)
+	res := node.Probe(r.nodeName, registry.Spec.HostPort, caFile, agentProbeTimeout)
+
+	reachable := res.Reachable
+	nodeStatus.Reachable = &reachable
+	nodeStatus.LastProbeTime = metav1.Now()
+	nodeStatus.LastError = res.Error
+
+	if !reachable {
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeUnreachable",
+			fmt.Sprintf("Registry '%s' is not reachable from node '%s': %s", registry.Spec.HostPort, r.nodeName, res.Error))
+	}
+}
+
+// A mapper from Secret to Registries that use that Secret
+type secretToRegistryMapper struct {
+	client.Client
+}
+
+func (srm secretToRegistryMapper) Map(obj handler.MapObject) []reconcile.Request {
+	res := []reconcile.Request{}
+	secret, ok := obj.Object.(*corev1.Secret)
+	if !ok {
+		return res // This wasn't a Secret
+	}
+
+	registries := &kubicv1beta1.RegistryList{}
+	if err := srm.List(context.TODO(), &client.ListOptions{}, registries); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when getting the list of Registries in the cluster: %s", err)
+		return res
+	}
+
+	for _, registry := range registries.Items {
+		if registry.UsesSecret(secret.GetName(), secret.GetNamespace()) {
+			res = append(res, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: registry.GetName()},
+			})
+		}
+	}
+	return res
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/kubic-project/registries-operator/pkg/test"
+	"github.com/kubic-project/registries-operator/pkg/test/fake"
+)
+
+func TestAgentReconcile(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	c := fake.NewTestClient()
+	r := &ReconcileNodeAgent{
+		Client:        c,
+		EventRecorder: fake.NewTestRecorder(),
+		nodeReader:    c,
+		nodeName:      "node0",
+		root:          root,
+	}
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	// a containerd node
+	node0 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0"}}
+	node0.Status.NodeInfo.ContainerRuntimeVersion = "containerd://1.2.0"
+
+	r.Create(context.TODO(), node0)
+	r.Create(context.TODO(), fooSec)
+	r.Create(context.TODO(), fooReg)
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: fooReg.Name, Namespace: fooReg.Namespace}}
+	res, err := r.Reconcile(req)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res.RequeueAfter).Should(Equal(agentResyncPeriod))
+
+	// the certificate must be installed (only for containerd) and reported in the status
+	cfg := node.NewHostConfig(fooReg, fooSec)
+	cfg.Targets = []string{node.TargetContainerd}
+	hash := cfg.Hash()
+	g.Expect(node.InstalledHash(root, fooReg.Name, fooReg.Spec.HostPort, cfg.Targets...)).Should(Equal(hash))
+	g.Expect(filepath.Join(root, node.DockerCertsDir, fooReg.Spec.HostPort)).ShouldNot(BeADirectory())
+
+	instance := &kubicv1beta1.Registry{}
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: fooReg.Name, Namespace: fooReg.Namespace}, instance)).ShouldNot(HaveOccurred())
+	g.Expect(instance.Status.Nodes).Should(HaveLen(1))
+	g.Expect(instance.Status.Nodes[0].Name).Should(Equal("node0"))
+	g.Expect(instance.Status.Nodes[0].CurrentHash).Should(Equal(hash))
+
+	// the certificate must be removed when the Registry has no certificate
+	instance.Spec.Certificate = nil
+	g.Expect(r.Update(context.TODO(), instance)).ShouldNot(HaveOccurred())
+
+	_, err = r.Reconcile(req)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(node.InstalledHash(root, fooReg.Name, fooReg.Spec.HostPort, cfg.Targets...)).Should(BeEmpty())
+
+	instance = &kubicv1beta1.Registry{}
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: fooReg.Name, Namespace: fooReg.Namespace}, instance)).ShouldNot(HaveOccurred())
+	g.Expect(instance.Status.Nodes[0].CurrentHash).Should(BeEmpty())
+}
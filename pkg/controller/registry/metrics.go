@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+)
+
+const (
+	// the namespace for all the metrics exported by the registries controller
+	metricsNamespace = "kubic_registry"
+)
+
+var (
+	// days until the certificate of a registry expires
+	certExpiryDaysGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_days",
+		Help:      "Number of days until the certificate of the registry expires.",
+	}, []string{"registry", "host_port"})
+
+	// the result of the last probe of a registry
+	registryUpGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "up",
+		Help:      "Whether the registry was reachable in the last probe (1) or not (0).",
+	}, []string{"registry", "host_port"})
+
+	// the HTTP status code returned by the registry in the last probe
+	registryProbeStatusCodeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_status_code",
+		Help:      "HTTP status code returned by the registry in the last probe.",
+	}, []string{"registry", "host_port"})
+
+	// the latency of the last probe of a registry
+	registryProbeLatencyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_latency_seconds",
+		Help:      "Time it took for the registry to respond in the last probe.",
+	}, []string{"registry", "host_port"})
+
+	// the authentication scheme requested by the registry in the last probe
+	registryProbeAuthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_auth_challenge",
+		Help:      "Authentication scheme requested by the registry in the last probe.",
+	}, []string{"registry", "host_port", "challenge"})
+)
+
+func init() {
+	prometheus.MustRegister(certExpiryDaysGauge)
+	prometheus.MustRegister(registryUpGauge)
+	prometheus.MustRegister(registryProbeStatusCodeGauge)
+	prometheus.MustRegister(registryProbeLatencyGauge)
+	prometheus.MustRegister(registryProbeAuthGauge)
+}
+
+// registryMetricsLabels returns the labels used in all the metrics for a registry
+func registryMetricsLabels(registry *kubicv1beta1.Registry) prometheus.Labels {
+	return prometheus.Labels{
+		"registry":  registry.GetName(),
+		"host_port": registry.Spec.HostPort,
+	}
+}
+
+// registryAuthMetricsLabels returns the labels used in the authentication challenge metric
+func registryAuthMetricsLabels(registry *kubicv1beta1.Registry, challenge string) prometheus.Labels {
+	labels := registryMetricsLabels(registry)
+	labels["challenge"] = challenge
+	return labels
+}
+
+// deleteHealthMetrics removes the metrics about the health of a registry
+func deleteHealthMetrics(registry *kubicv1beta1.Registry) {
+	labels := registryMetricsLabels(registry)
+	registryUpGauge.Delete(labels)
+	registryProbeStatusCodeGauge.Delete(labels)
+	registryProbeLatencyGauge.Delete(labels)
+	if registry.Status.Health != nil {
+		registryProbeAuthGauge.Delete(registryAuthMetricsLabels(registry, registry.Status.Health.AuthChallenge))
+	}
+}
+
+// deleteRegistryMetrics removes all the metrics associated with a registry
+func deleteRegistryMetrics(registry *kubicv1beta1.Registry) {
+	certExpiryDaysGauge.Delete(registryMetricsLabels(registry))
+	deleteHealthMetrics(registry)
+}
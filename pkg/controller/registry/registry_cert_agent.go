@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+)
+
+// agentCertReconciler is a CertReconciler for clusters where the certificates are
+// installed by the node agents (see pkg/controller/agent): the controller does not
+// launch any Job, it just aggregates the status reported by the agents in each Node.
+type agentCertReconciler struct {
+	*ReconcileRegistry
+}
+
+var _ CertReconciler = &agentCertReconciler{}
+
+// ReconcileCertPresent updates the certificate status with the number of Nodes
+// where the agents have installed the current certificate
+func (r *agentCertReconciler) ReconcileCertPresent(registry *kubicv1beta1.Registry,
+	curNodes map[string]*corev1.Node,
+	specSecret *corev1.Secret) (reconcile.Result, error) {
+
+	// Migrate hashes generated by previous versions of the operator
+	r.migrateLegacyHash(registry, specSecret)
+
+	r.updateCertStatus(registry, getRegistryHash(registry, specSecret),
+		getNodesRegistryHashes(registry, specSecret, curNodes))
+
+	return reconcile.Result{}, nil
+}
+
+// ReconcileCertMissing waits until the agents have removed the certificate from all the Nodes
+func (r *agentCertReconciler) ReconcileCertMissing(instance *kubicv1beta1.Registry, nodes map[string]*corev1.Node) error {
+	r.updateCertRemovalStatus(instance)
+
+	// the instance must be updated at the upper layer
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func TestAgentCertReconciler(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	reg := newTestReconcileRegistry()
+	r := &agentCertReconciler{&reg}
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	hash := getRegistryHash(fooReg, fooSec)
+	nodes := testNodes("node0", "node1")
+
+	// no agent has installed the certificate yet
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(0))
+
+	// the certificate has been installed in some nodes
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = hash
+	fooReg.Status.GetNodeStatus("node1").CurrentHash = "some-old-hash"
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(Equal(hash))
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+
+	fooReg.Status.GetNodeStatus("node1").CurrentHash = hash
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(2))
+
+	// the Registry cannot be removed until the agents have removed the certificate
+	timestamp := metav1.Now()
+	fooReg.ObjectMeta.SetDeletionTimestamp(&timestamp)
+	fooReg.ObjectMeta.Finalizers = []string{regsFinalizerName}
+
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = ""
+	g.Expect(r.ReconcileCertMissing(fooReg, nodes)).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+	g.Expect(fooReg.ObjectMeta.Finalizers).Should(HaveLen(1))
+
+	fooReg.Status.GetNodeStatus("node1").CurrentHash = ""
+	g.Expect(r.ReconcileCertMissing(fooReg, nodes)).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(0))
+	g.Expect(fooReg.ObjectMeta.Finalizers).Should(BeEmpty())
+}
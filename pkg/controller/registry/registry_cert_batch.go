@@ -0,0 +1,545 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+const (
+	// a prefix for all the jobs created for converging nodes
+	jobBatchNamePrefix = "kubic-registries-converge"
+
+	// some labels in jobs that converge nodes: all of them have this label
+	jobBatchLabel = "kubic-registries-converge"
+
+	// some labels in jobs that converge nodes: the node where this job runs (shortened when too long)
+	jobBatchLabelNode = "kubic-registries-converge-node"
+
+	// the directory (in the Job) where the Secret of the i-th registry is mounted
+	jobBatchRegistryDir = "registry-%d"
+)
+
+// batchCertReconciler is a CertReconciler that converges every Node for all the
+// Registries at once, with a single Job per Node, instead of a Job per Registry and Node.
+// The status of every Registry is derived from the results reported by these Jobs.
+type batchCertReconciler struct {
+	*ReconcileRegistry
+}
+
+var _ CertReconciler = &batchCertReconciler{}
+
+// batchRegistry is a Registry in the desired state of the Nodes
+type batchRegistry struct {
+	registry *kubicv1beta1.Registry
+
+	// secret is the certificate Secret (nil when the configuration must be removed)
+	secret *corev1.Secret
+
+	// status is the status of the Registry before the convergence
+	status kubicv1beta1.RegistryStatus
+}
+
+// ReconcileCertPresent converges the Nodes where the certificate of this Registry
+// (or of any other Registry) is not installed yet
+func (r *batchCertReconciler) ReconcileCertPresent(registry *kubicv1beta1.Registry,
+	curNodes map[string]*corev1.Node,
+	specSecret *corev1.Secret) (reconcile.Result, error) {
+
+	// Migrate hashes generated by previous versions of the operator
+	r.migrateLegacyHash(registry, specSecret)
+	migrateLegacyNodesStatus(registry, curNodes, specSecret)
+
+	specSecretHash := getRegistryHash(registry, specSecret)
+
+	nodesHashes := getNodesRegistryHashes(registry, specSecret, curNodes)
+	resetCertFailures(registry, nodesHashes)
+
+	// the Nodes are converged again (instead of verified) once their
+	// verification is due, so no verification Jobs are launched
+	driftResult := r.getBatchDriftResult(registry, nodesHashes)
+
+	// make sure the registry can be verified with this certificate (the
+	// Registries that fail the check are not added to the desired state)
+	result := driftResult
+	if countNodesWithHash(registry, nodesHashes) < len(nodesHashes) && !r.preflightCheck(registry, specSecret) {
+		glog.V(3).Infof("[kubic] preflight check failed for '%s': blocking the installation", registry)
+		result = mergeResults(result, reconcile.Result{RequeueAfter: preflightRetryPeriod})
+	}
+
+	if err := r.convergeNodes(registry, curNodes); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	r.updateCertStatus(registry, specSecretHash, nodesHashes)
+
+	// the Registries that have failed in a Node are not added to the desired state of that
+	// Node until their backoff expires (or forever, once they have failed too many times)
+	if delay := getCertRetryDelay(registry, nodesHashes); delay > 0 {
+		glog.V(3).Infof("[kubic] retrying the installation for '%s' in %s", registry, delay)
+		result = mergeResults(result, reconcile.Result{RequeueAfter: delay})
+	}
+	return result, nil
+}
+
+// ReconcileCertMissing converges the Nodes where the certificate of this Registry
+// is still installed
+func (r *batchCertReconciler) ReconcileCertMissing(instance *kubicv1beta1.Registry, nodes map[string]*corev1.Node) error {
+	// Migrate the status generated by previous versions of the operator
+	migrateLegacyNodesStatus(instance, nodes, nil)
+
+	if err := r.convergeNodes(instance, nodes); err != nil {
+		return err
+	}
+	r.updateCertRemovalStatus(instance)
+
+	// the instance must be updated at the upper layer
+	return nil
+}
+
+// convergeNodes processes the results of the convergence Jobs, updating the status of
+// all the Registries, and launches a convergence Job in the Nodes that are not in sync
+// with the desired state. `registry` is the Registry being reconciled: it must
+// be updated at the upper layer.
+func (r *batchCertReconciler) convergeNodes(registry *kubicv1beta1.Registry, curNodes map[string]*corev1.Node) error {
+	registries, err := r.getBatchRegistries(registry)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := getAllJobsWithLabels(r, map[string]string{jobBatchLabel: "true"})
+	if err != nil {
+		return err
+	}
+	glog.V(3).Infof("[kubic] %d convergence Jobs found", len(jobs))
+	jobsByNode := getJobsByNode(jobs)
+
+	running := map[string]bool{}
+	for nodeName, curNode := range curNodes {
+		if job, found := jobsByNode[nodeName]; found {
+			done, err := r.collectNodeResult(registries, job, curNode)
+			if err != nil {
+				return err
+			}
+			running[nodeName] = !done
+		}
+	}
+
+	// (the Registries that have just failed in a Node are retried there after their backoff)
+	mustConverge := []string{}
+	for nodeName, curNode := range curNodes {
+		if running[nodeName] {
+			continue
+		}
+		desired := getNodeRegistries(registries, curNode)
+		if !isNodeConverged(desired, curNode) || !isNodeVerified(desired, curNode) {
+			mustConverge = append(mustConverge, nodeName)
+		}
+	}
+
+	// the status of the other Registries is derived from the results in the Nodes
+	for _, br := range registries {
+		if br.registry == registry || reflect.DeepEqual(br.status, br.registry.Status) {
+			continue
+		}
+		glog.V(5).Infof("[kubic] updating status of %s", br.registry)
+		if err := r.Update(context.TODO(), br.registry); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if len(mustConverge) > 0 {
+		r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+			"Starting", fmt.Sprintf("Starting the convergence of %d nodes", len(mustConverge)))
+
+		sort.Strings(mustConverge)
+		for _, nodeName := range mustConverge {
+			curNode := curNodes[nodeName]
+			if err := r.convergeNode(registry, getNodeRegistries(registries, curNode), curNode); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getBatchRegistries gets all the Registries in the desired state of the Nodes
+// (using `registry` instead of the copy in the cluster), sorted by name
+func (r *batchCertReconciler) getBatchRegistries(registry *kubicv1beta1.Registry) ([]*batchRegistry, error) {
+	list := &kubicv1beta1.RegistryList{}
+	if err := r.List(context.TODO(), &client.ListOptions{}, list); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when getting the list of Registries in the cluster: %s", err)
+		return nil, err
+	}
+
+	registries := []*kubicv1beta1.Registry{registry}
+	for i := range list.Items {
+		if list.Items[i].Name != registry.Name {
+			registries = append(registries, &list.Items[i])
+		}
+	}
+	sort.Slice(registries, func(i, j int) bool { return registries[i].Name < registries[j].Name })
+
+	res := []*batchRegistry{}
+	for _, reg := range registries {
+		br := &batchRegistry{registry: reg, status: *reg.Status.DeepCopy()}
+
+		if reg.ObjectMeta.DeletionTimestamp.IsZero() && reg.Spec.Certificate != nil {
+			secret, err := reg.GetCertificateSecret(r)
+			if err != nil {
+				// leave the configuration in the Nodes untouched until we can get the Secret
+				glog.V(1).Infof("[kubic] ERROR: when getting the certificate for %s: %s", reg, err)
+				continue
+			}
+			if getSecretCA(secret) == nil || isPreflightBlocked(reg) {
+				continue
+			}
+			br.secret = secret
+		}
+		res = append(res, br)
+	}
+	return res, nil
+}
+
+// getBatchDriftResult returns a reconcile.Result for waking up when the verification of
+// the certificate is due in any Node (where the Node will be converged again). The drift
+// found in the Nodes is reported when collecting their results (see setNodeResult).
+func (r *batchCertReconciler) getBatchDriftResult(registry *kubicv1beta1.Registry, nodesHashes map[string]string) reconcile.Result {
+	if config.DriftCheckPeriod <= 0 {
+		registry.Status.RemoveCondition(kubicv1beta1.RegistryCertificateDrifted)
+		return reconcile.Result{}
+	}
+
+	if countNodesWithHash(registry, nodesHashes) == len(nodesHashes) {
+		r.reportCertInSync(registry)
+	}
+
+	nextCheck := config.DriftCheckPeriod
+	for i := range registry.Status.Nodes {
+		nodeStatus := &registry.Status.Nodes[i]
+		hash, found := nodesHashes[nodeStatus.Name]
+		if !found || len(hash) == 0 || nodeStatus.CurrentHash != hash {
+			continue
+		}
+		if delay := getNodeVerifyDelay(nodeStatus); delay > 0 && delay < nextCheck {
+			nextCheck = delay
+		}
+	}
+	return reconcile.Result{RequeueAfter: nextCheck}
+}
+
+// isNodeVerified returns true if the configuration of all the Registries installed
+// in `curNode` has been verified recently (see `config.DriftCheckPeriod`)
+func isNodeVerified(registries []*batchRegistry, curNode *corev1.Node) bool {
+	if config.DriftCheckPeriod <= 0 {
+		return true
+	}
+	for _, br := range registries {
+		for i := range br.registry.Status.Nodes {
+			nodeStatus := &br.registry.Status.Nodes[i]
+			if nodeStatus.Name == curNode.Name && len(nodeStatus.CurrentHash) > 0 && getNodeVerifyDelay(nodeStatus) <= 0 {
+				glog.V(5).Infof("[kubic] configuration for '%s' in node '%s' must be verified", br.registry, curNode.Name)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getNodeRegistries returns the Registries in the desired state of `curNode`: the
+// installations delayed after previous failures in the Node are left untouched
+func getNodeRegistries(registries []*batchRegistry, curNode *corev1.Node) []*batchRegistry {
+	res := []*batchRegistry{}
+	for _, br := range registries {
+		if br.secret != nil {
+			hash := getNodeRegistryHash(br.registry, br.secret, curNode)
+			if delay, giveUp := getNodeRetryDelay(br.registry, curNode.Name, hash); giveUp || delay > 0 {
+				glog.V(5).Infof("[kubic] installation of %s in node '%s' delayed after previous failures", br.registry, curNode.Name)
+				continue
+			}
+		}
+		res = append(res, br)
+	}
+	return res
+}
+
+// isPreflightBlocked returns true if the installation of the certificate of
+// `registry` has been blocked by the preflight check
+func isPreflightBlocked(registry *kubicv1beta1.Registry) bool {
+	if registry.Spec.Preflight == nil || registry.Spec.Preflight.IgnoreFailure {
+		return false
+	}
+	cond := registry.Status.GetCondition(kubicv1beta1.RegistryCertificateVerified)
+	return cond != nil && cond.Status == corev1.ConditionFalse
+}
+
+// getNodeHash returns the hash of the configuration installed for `registry`
+// in the Node `nodeName` (without creating the Node status)
+func getNodeHash(registry *kubicv1beta1.Registry, nodeName string) string {
+	for _, nodeStatus := range registry.Status.Nodes {
+		if nodeStatus.Name == nodeName {
+			return nodeStatus.CurrentHash
+		}
+	}
+	return ""
+}
+
+// isNodeConverged returns true if all the Registries have the configuration
+// expected in `curNode`
+func isNodeConverged(registries []*batchRegistry, curNode *corev1.Node) bool {
+	for _, br := range registries {
+		expected := ""
+		if br.secret != nil {
+			expected = getNodeRegistryHash(br.registry, br.secret, curNode)
+		}
+		if getNodeHash(br.registry, curNode.Name) != expected {
+			glog.V(5).Infof("[kubic] node '%s' does not have current configuration for '%s' yet", curNode.Name, br.registry)
+			return false
+		}
+	}
+	return true
+}
+
+// getNodeState returns the desired state of `curNode` for all the Registries, and
+// the Secrets that must be mounted in the Job (by directory)
+func getNodeState(registries []*batchRegistry, curNode *corev1.Node) (node.NodeState, map[string]*corev1.Secret) {
+	state := node.NodeState{RuntimeReload: node.ReloadPolicy(config.RuntimeReloadPolicy)}
+	secrets := map[string]*corev1.Secret{}
+
+	for i, br := range registries {
+		if br.secret == nil {
+			if len(getNodeHash(br.registry, curNode.Name)) > 0 {
+				state.Remove = append(state.Remove, node.InstallSpec{
+					Name:     br.registry.Name,
+					HostPort: br.registry.Spec.HostPort,
+				})
+			}
+			continue
+		}
+
+		// note: the Registry names can be too long for a volume name
+		registryDir := fmt.Sprintf(jobBatchRegistryDir, i)
+		spec := getNodeInstallSpec(br.registry, br.secret, curNode, registryDir)
+		spec.RuntimeReload = ""
+		spec.Probe = br.registry.Spec.NodeProbe
+		state.Install = append(state.Install, spec)
+		secrets[registryDir] = br.secret
+	}
+	return state, secrets
+}
+
+// collectNodeResult processes the convergence Job in `curNode`, storing the results
+// in the status of the Registries (and counting the failures in the Node).
+// It returns true once the Job is done (and removed).
+func (r *batchCertReconciler) collectNodeResult(registries []*batchRegistry, job *batchv1.Job, curNode *corev1.Node) (bool, error) {
+	nodeName := curNode.Name
+	glog.V(3).Infof("[kubic] Job '%s': Active=%d, Failed=%d, Succeeded=%d",
+		job.GetName(), job.Status.Active, job.Status.Failed, job.Status.Succeeded)
+
+	if job.Status.Active > 0 {
+		// let the Job finish. Once it is done, it will be processed in a following reconciliation
+		glog.V(5).Infof("[kubic] Job '%s' is still active... will let it finish", job.Name)
+		return false, nil
+	} else if job.Status.Failed == 0 && job.Status.Succeeded == 0 {
+		glog.V(5).Infof("[kubic] Job '%s' has a unknown state", job.Name)
+		return false, nil
+	}
+
+	res, finishedAt, err := r.getNodeResult(job)
+	if err != nil {
+		glog.V(1).Infof("[kubic] ERROR: could not get the convergence result of Job '%s': %s", job.Name, err)
+		// the Registries that were not in sync have failed
+		details := "no details reported"
+		if excerpt := r.getFailedPodExcerpt(job); len(excerpt) > 0 {
+			details = excerpt
+		}
+		for _, br := range registries {
+			if isNodeConverged([]*batchRegistry{br}, curNode) {
+				continue
+			}
+			br.registry.Status.GetNodeStatus(nodeName).LastError = fmt.Sprintf("convergence of node '%s' failed: %s", nodeName, details)
+			if br.secret != nil {
+				r.recordCertFailure(br.registry, nodeName, getNodeRegistryHash(br.registry, br.secret, curNode))
+			}
+			r.EventRecorder.Event(br.registry, corev1.EventTypeWarning, "NodeInstallFailed",
+				fmt.Sprintf("Convergence of node '%s' failed (%s)... retrying", nodeName, details))
+		}
+	} else {
+		for _, rr := range res.Registries {
+			for _, br := range registries {
+				if br.registry.Name == rr.Name {
+					r.setNodeResult(br.registry, nodeName, res.Runtimes, rr, finishedAt)
+					if br.secret == nil {
+						continue
+					}
+					// (a Registry that is not reachable from the Node has been installed anyway)
+					if hash := getNodeRegistryHash(br.registry, br.secret, curNode); rr.Hash != hash {
+						r.recordCertFailure(br.registry, nodeName, hash)
+					} else {
+						clearNodeCertFailures(br.registry.Status.GetNodeStatus(nodeName))
+					}
+				}
+			}
+		}
+	}
+
+	// the Job will be re-created (if needed) once it is gone
+	if err := r.finishJob(job); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setNodeResult stores the result of the convergence of a Node in the status of `registry`
+func (r *batchCertReconciler) setNodeResult(registry *kubicv1beta1.Registry, nodeName string, runtimes []string, rr node.RegistryResult, finishedAt metav1.Time) {
+	nodeStatus := registry.Status.GetNodeStatus(nodeName)
+	glog.V(5).Infof("[kubic] '%s' in node '%s': '%s' %s", registry, nodeName, rr.Hash, rr.Error)
+
+	// the configuration we installed in the Node was not found there (see reconcileCertDrift)
+	if config.DriftCheckPeriod > 0 && len(nodeStatus.CurrentHash) > 0 && len(rr.Hash) > 0 && rr.PreviousHash != nodeStatus.CurrentHash {
+		glog.V(3).Infof("[kubic] CA.crt for '%s' has drifted in '%s': '%s' found", registry, nodeName, rr.PreviousHash)
+		r.reportCertDrift(registry, []string{nodeName})
+	}
+
+	nodeStatus.CurrentHash = rr.Hash
+	nodeStatus.LastVerifyTime = finishedAt
+	nodeStatus.LastError = rr.Error
+	nodeStatus.Runtimes = runtimes
+	if len(rr.Error) == 0 {
+		nodeStatus.SystemTrust = registry.Spec.SystemTrust && len(rr.Hash) > 0
+	}
+	if rr.Reachable != nil {
+		reachable := *rr.Reachable
+		nodeStatus.Reachable = &reachable
+		nodeStatus.LastProbeTime = finishedAt
+		if !reachable {
+			r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeUnreachable",
+				fmt.Sprintf("Registry '%s' is not reachable from node '%s': %s", registry.Spec.HostPort, nodeName, rr.Error))
+			return
+		}
+	}
+
+	if len(rr.Error) > 0 {
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeInstallFailed",
+			fmt.Sprintf("Convergence of '%s' failed in node '%s': %s... retrying", registry, nodeName, rr.Error))
+	}
+}
+
+// getNodeResult reads the result of a convergence Job (from the termination message of its pod)
+func (r *batchCertReconciler) getNodeResult(job *batchv1.Job) (*node.NodeResult, metav1.Time, error) {
+	pods, err := getJobPods(r, job)
+	if err != nil {
+		return nil, metav1.Time{}, err
+	}
+
+	for _, pod := range pods {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.State.Terminated == nil || len(cs.State.Terminated.Message) == 0 {
+				continue
+			}
+
+			res := node.NodeResult{}
+			if err := node.ReadTerminationMessage(cs.State.Terminated.Message, &res); err != nil {
+				return nil, metav1.Time{}, err
+			}
+			if res.Node != job.Spec.Template.Spec.NodeName {
+				glog.V(5).Infof("[kubic] ignoring result for node '%s' in Job '%s'", res.Node, job.Name)
+				continue
+			}
+			return &res, cs.State.Terminated.FinishedAt, nil
+		}
+	}
+	return nil, metav1.Time{}, fmt.Errorf("no result found")
+}
+
+// convergeNode creates a `Job` for converging `curNode` for all the Registries
+func (r *batchCertReconciler) convergeNode(owner *kubicv1beta1.Registry, registries []*batchRegistry, curNode *corev1.Node) error {
+	nodeName := curNode.Name
+	jobName := shortenLabelValue(kubicutil.SafeID(jobBatchNamePrefix) + "-" + kubicutil.SafeID(nodeName))
+
+	state, secrets := getNodeState(registries, curNode)
+	commands, err := getNodeConvergeCommands(nodeName, state)
+	if err != nil {
+		return err
+	}
+
+	systemTrust := false
+	for _, br := range registries {
+		systemTrust = systemTrust || needsSystemTrust(br.registry, nodeName)
+	}
+
+	// the Secrets must be in the namespace of the Job
+	secrets, err = r.getJobSecrets(owner, secrets)
+	if err != nil {
+		return err
+	}
+
+	glog.V(3).Infof("[kubic] generating Job '%s'", jobName)
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     commands,
+		JobName:      jobName,
+		JobNamespace: config.JobNamespace,
+		NodeName:     nodeName,
+		Secrets:      secrets,
+		Labels: map[string]string{
+			jobBatchLabel:     "true",
+			jobBatchLabelNode: getNodeLabelValue(nodeName),
+		},
+		HostRootDir:   jobHostRootDir,
+		HostRootPaths: getJobHostRootPaths(systemTrust),
+		HostPID:       needsHostPID(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// (the Registry that launches the Job will process its result)
+	if err := controllerutil.SetControllerReference(owner, job, r.scheme); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when setting Controller reference: %s", err)
+		return err
+	}
+
+	glog.V(3).Infof("[kubic] creating Job '%s' for converging node '%s'", jobName, nodeName)
+	if err := r.Create(context.TODO(), job); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			glog.V(3).Infof("[kubic] the Job already exists")
+			return nil
+		}
+		glog.V(1).Infof("[kubic] ERROR: when creating Job '%s': %s", jobName, err)
+		return err
+	}
+	return nil
+}
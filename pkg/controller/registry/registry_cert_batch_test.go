@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func TestBatchInstall(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+	br := &batchCertReconciler{&r}
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+	barSec, err := test.BuildSecretFromCert("bar-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+	barReg, err := kubicv1beta1.GetTestRegistry("bar")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	for _, obj := range []runtime.Object{fooSec, barSec, fooReg, barReg} {
+		g.Expect(r.Create(context.TODO(), obj)).ShouldNot(HaveOccurred())
+	}
+
+	nodes := testNodes("node0", "node1")
+	fooHash := getRegistryHash(fooReg, fooSec)
+	barHash := getRegistryHash(barReg, barSec)
+
+	//a single Job must be created for each node, for all the registries
+	_, err = br.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		nodeName := job.Labels[jobBatchLabelNode]
+		g.Expect(nodes).Should(HaveKey(nodeName))
+		g.Expect(job.Spec.Template.Spec.NodeName).Should(Equal(nodeName))
+		g.Expect(job.Spec.Template.Spec.Volumes).Should(HaveLen(2 + len(jobHostPaths))) // two secrets and the directories of the node
+
+		commands := job.Spec.Template.Spec.Containers[0].Command
+		g.Expect(commands[:3]).Should(Equal([]string{nodeExe, "node", "converge"}))
+
+		state := node.NodeState{}
+		g.Expect(json.Unmarshal([]byte(commands[len(commands)-1]), &state)).ShouldNot(HaveOccurred())
+		g.Expect(state.Install).Should(HaveLen(2))
+		g.Expect(state.Install[0].Name).Should(Equal("bar"))
+		g.Expect(state.Install[1].Name).Should(Equal("foo"))
+	}
+
+	//simulate the Job succeeded in node0 and failed (without a result) in node1
+	for _, job := range jobs.Items {
+		if job.Labels[jobBatchLabelNode] == "node0" {
+			job.Status.Succeeded = 1
+			g.Expect(r.Create(context.TODO(), newTestJobPod(&job, job.Name, "node0", node.NodeResult{
+				Node: "node0",
+				Registries: []node.RegistryResult{
+					{Name: "bar", Hash: barHash},
+					{Name: "foo", Hash: fooHash},
+				},
+			}, 0))).ShouldNot(HaveOccurred())
+		} else {
+			job.Status.Failed = 1
+		}
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	_, err = br.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(Equal(fooHash))
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(fooHash))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").CurrentHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.GetNodeStatus("node1").LastError).ShouldNot(BeEmpty())
+
+	//the status of the other registries is derived from the same results
+	updated := &kubicv1beta1.Registry{}
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: "bar", Namespace: metav1.NamespaceSystem}, updated)).ShouldNot(HaveOccurred())
+	g.Expect(updated.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(barHash))
+	g.Expect(updated.Status.GetNodeStatus("node1").LastError).ShouldNot(BeEmpty())
+	g.Expect(updated.Status.GetNodeStatus("node0").Failures).Should(BeZero())
+	g.Expect(updated.Status.GetNodeStatus("node1").Failures).Should(Equal(1))
+
+	//the convergence is delayed by the backoff...
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+
+	//... and then it is retried only in node1
+	updated.Status.GetNodeStatus("node1").LastFailureTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	g.Expect(r.Update(context.TODO(), updated)).ShouldNot(HaveOccurred())
+	fooReg.Status.GetNodeStatus("node1").LastFailureTime = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	_, err = br.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobBatchLabelNode]).Should(Equal("node1"))
+	g.Expect(strings.Join(jobs.Items[0].Spec.Template.Spec.Containers[0].Command, " ")).Should(ContainSubstring("--node-name node1"))
+
+	//when the verification is due, node0 is converged again (instead of verified)
+	fooReg.Status.GetNodeStatus("node0").LastVerifyTime = metav1.NewTime(time.Now().Add(-2 * config.DriftCheckPeriod))
+
+	_, err = br.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		g.Expect(job.Labels).Should(HaveKey(jobBatchLabelNode))
+	}
+	//the CA.crt of foo had been removed by hand in node0: the drift is reported (and repaired)
+	for _, job := range jobs.Items {
+		if job.Labels[jobBatchLabelNode] != "node0" {
+			continue
+		}
+		job.Status.Succeeded = 1
+		pod := newTestJobPod(&job, job.Name, "node0", node.NodeResult{
+			Node: "node0",
+			Registries: []node.RegistryResult{
+				{Name: "bar", Hash: barHash, PreviousHash: barHash},
+				{Name: "foo", Hash: fooHash},
+			},
+		}, 0)
+		// (the Pod of the previous Job would have been removed with it)
+		g.Expect(r.Delete(context.TODO(), pod)).ShouldNot(HaveOccurred())
+		g.Expect(r.Create(context.TODO(), pod)).ShouldNot(HaveOccurred())
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	_, err = br.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(fooHash))
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateDrifted)
+	g.Expect(cond).ShouldNot(BeNil())
+	g.Expect(string(cond.Status)).Should(Equal("True"))
+	g.Expect(cond.Message).Should(ContainSubstring("node0"))
+
+	updated = &kubicv1beta1.Registry{}
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: "bar", Namespace: metav1.NamespaceSystem}, updated)).ShouldNot(HaveOccurred())
+	g.Expect(updated.Status.GetCondition(kubicv1beta1.RegistryCertificateDrifted)).Should(BeNil())
+}
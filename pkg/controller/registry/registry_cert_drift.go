@@ -0,0 +1,248 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+const (
+	// a prefix for all the jobs created for verifying certificates
+	jobVerifyNamePrefix = "kubic-registry-verifier"
+
+	// some labels in jobs that verify certificates: the registry this job is verifying
+	jobVerifyLabelHostPort = "kubic-registry-verifier-host-port"
+
+	// some labels in jobs that verify certificates: the node where this job runs (shortened when too long)
+	jobVerifyLabelNode = "kubic-registry-verifier-node"
+)
+
+// reconcileCertDrift verifies periodically that the certificate is still installed
+// in the Nodes where we installed it (with the hashes expected in every Node in `nodesHashes`). The Nodes where it has drifted (ie, the
+// CA.crt has been removed by hand, or the Node has been reimaged) are marked as not
+// having the certificate, so it will be installed again (only) in those Nodes.
+func (r *ReconcileRegistry) reconcileCertDrift(registry *kubicv1beta1.Registry,
+	curNodes map[string]*corev1.Node,
+	nodesHashes map[string]string) (reconcile.Result, error) {
+
+	if config.DriftCheckPeriod <= 0 {
+		registry.Status.RemoveCondition(kubicv1beta1.RegistryCertificateDrifted)
+		return reconcile.Result{}, nil
+	}
+
+	// 1. Process all the verification Jobs (one per node)
+	jobs, err := getAllJobsWithLabels(r, map[string]string{
+		jobVerifyLabelHostPort: kubicutil.SafeID(registry.Spec.HostPort),
+	})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	glog.V(3).Infof("[kubic] %d verification Jobs found for %s", len(jobs), registry.Spec.HostPort)
+	jobsByNode := getJobsByNode(jobs)
+
+	drifted := []string{}
+	mustVerify := []string{}
+	nextCheck := config.DriftCheckPeriod
+	for nodeName := range curNodes {
+		nodeStatus := registry.Status.GetNodeStatus(nodeName)
+		hash := nodesHashes[nodeName]
+
+		job, found := jobsByNode[nodeName]
+		if !found {
+			// only the nodes where the certificate has been installed can drift
+			if len(hash) == 0 || nodeStatus.CurrentHash != hash {
+				continue
+			}
+
+			if delay := getNodeVerifyDelay(nodeStatus); delay <= 0 {
+				mustVerify = append(mustVerify, nodeName)
+			} else if delay < nextCheck {
+				nextCheck = delay
+			}
+			continue
+		}
+
+		if job.Status.Active > 0 {
+			glog.V(5).Infof("[kubic] Job '%s' is still active... will let it finish", job.Name)
+			continue
+		} else if job.Status.Failed > 0 {
+			// it will be retried in the next period
+			glog.V(3).Infof("[kubic] Job '%s' has failed to verify '%s's CA.crt in '%s'", job.Name, registry, nodeName)
+			nodeStatus.LastVerifyTime = metav1.Now()
+		} else if job.Status.Succeeded > 0 {
+			res, err := r.getVerifyResult(job)
+			if err != nil {
+				glog.V(1).Infof("[kubic] ERROR: could not get the verification result of Job '%s': %s", job.Name, err)
+			} else {
+				nodeStatus.LastVerifyTime = metav1.Now()
+				if nodeStatus.CurrentHash == hash && res.Hash != hash {
+					glog.V(3).Infof("[kubic] CA.crt for '%s' has drifted in '%s': '%s' found", registry, nodeName, res.Hash)
+					nodeStatus.CurrentHash = res.Hash
+					nodeStatus.LastError = fmt.Sprintf("certificate '%s' not found in the node", hash)
+					drifted = append(drifted, nodeName)
+				}
+			}
+		} else {
+			glog.V(5).Infof("[kubic] Job '%s' has a unknown state", job.Name)
+			continue
+		}
+
+		if err = r.finishJob(job); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// 2. Report the nodes where the certificate has drifted
+	if len(drifted) > 0 {
+		r.reportCertDrift(registry, drifted)
+	} else if countNodesWithHash(registry, nodesHashes) == len(curNodes) {
+		r.reportCertInSync(registry)
+	}
+
+	// 3. Launch the verification Jobs in the nodes that have not been verified recently
+	sort.Strings(mustVerify)
+	for _, nodeName := range mustVerify {
+		if err := r.verifyCertForRegistry(registry, curNodes[nodeName]); err != nil && !apierrors.IsAlreadyExists(err) {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{RequeueAfter: nextCheck}, nil
+}
+
+// reportCertDrift reports (with an event and the `CertificateDrifted` condition)
+// the Nodes where the certificate of `registry` has drifted
+func (r *ReconcileRegistry) reportCertDrift(registry *kubicv1beta1.Registry, drifted []string) {
+	sort.Strings(drifted)
+	msg := fmt.Sprintf("Certificate not found in nodes %s... reinstalling",
+		strings.Join(drifted, ", "))
+	registry.Status.SetCondition(kubicv1beta1.RegistryCertificateDrifted, corev1.ConditionTrue, "Drifted", msg)
+	r.EventRecorder.Event(registry, corev1.EventTypeWarning, "Drifted", msg)
+}
+
+// reportCertInSync clears the `CertificateDrifted` condition once the certificate
+// is installed in all the Nodes (with an event when it had drifted)
+func (r *ReconcileRegistry) reportCertInSync(registry *kubicv1beta1.Registry) {
+	cond := registry.Status.GetCondition(kubicv1beta1.RegistryCertificateDrifted)
+	wasDrifted := cond != nil && cond.Status == corev1.ConditionTrue
+	registry.Status.SetCondition(kubicv1beta1.RegistryCertificateDrifted, corev1.ConditionFalse,
+		"InSync", "The certificate is installed in all the nodes")
+	if wasDrifted {
+		r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+			"InSync", "Certificate reinstalled in all the nodes")
+	}
+}
+
+// getNodeVerifyDelay returns the time until the certificate installed in a
+// Node must be verified again (zero or less when it must be verified now)
+func getNodeVerifyDelay(nodeStatus *kubicv1beta1.RegistryNodeStatus) time.Duration {
+	elapsed := time.Since(nodeStatus.LastVerifyTime.Time)
+	if elapsed < 0 {
+		return config.DriftCheckPeriod
+	}
+	return config.DriftCheckPeriod - elapsed
+}
+
+// getVerifyResult reads the result of a verification Job (from the termination message of its pod)
+func (r *ReconcileRegistry) getVerifyResult(job *batchv1.Job) (*node.VerifyResult, error) {
+	pods, err := getJobPods(r, job)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pod := range pods {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name != job.Name || cs.State.Terminated == nil || cs.State.Terminated.ExitCode != 0 {
+				continue
+			}
+
+			res := node.VerifyResult{}
+			if err := node.ReadTerminationMessage(cs.State.Terminated.Message, &res); err != nil {
+				return nil, err
+			}
+			return &res, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no verification result found for Job '%s'", job.Name)
+}
+
+// verifyCertForRegistry creates a `Job` for verifying the certificate installed at node `curNode`
+func (r *ReconcileRegistry) verifyCertForRegistry(registry *kubicv1beta1.Registry, curNode *corev1.Node) error {
+	nodeName := curNode.Name
+	jobName := getNodeJobName(jobVerifyNamePrefix, registry.Spec.HostPort, nodeName)
+
+	commands, err := getNodeInstallCommands("verify", node.InstallSpec{
+		Name:     registry.Name,
+		HostPort: registry.Spec.HostPort,
+		Targets:  getNodeTargets(curNode),
+	})
+	if err != nil {
+		return err
+	}
+	commands = append(commands, "--node-name", nodeName)
+
+	glog.V(3).Infof("[kubic] generating Job '%s'", jobName)
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     commands,
+		JobName:      jobName,
+		JobNamespace: config.JobNamespace,
+		NodeName:     nodeName,
+		Labels: map[string]string{
+			jobVerifyLabelHostPort: kubicutil.SafeID(registry.Spec.HostPort),
+			jobVerifyLabelNode:     getNodeLabelValue(nodeName),
+		},
+		HostRootDir:   jobHostRootDir,
+		HostRootPaths: getJobHostRootPaths(needsSystemTrust(registry, nodeName)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := controllerutil.SetControllerReference(registry, job, r.scheme); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when setting Controller reference: %s", err)
+		return err
+	}
+
+	glog.V(3).Infof("[kubic] creating Job '%s' for verifying certificates", jobName)
+	if err := r.Create(context.TODO(), job); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			glog.V(1).Infof("[kubic] ERROR: when creating Job '%s': %s", jobName, err)
+		}
+		return err
+	}
+
+	return nil
+}
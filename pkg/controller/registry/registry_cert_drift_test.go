@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func TestCertDrift(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	hash := getRegistryHash(fooReg, fooSec)
+	nodes := testNodes("node0", "node1")
+	hashes := getNodesRegistryHashes(fooReg, fooSec, nodes)
+	fooReg.Status.Certificate.CurrentHash = hash
+	fooReg.Status.Certificate.NumNodes = 2
+	for nodeName := range nodes {
+		fooReg.Status.GetNodeStatus(nodeName).CurrentHash = hash
+	}
+
+	//the nodes have never been verified: one verification Job per node
+	_, err = r.reconcileCertDrift(fooReg, nodes, hashes)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+
+	//simulate the CA.crt has been removed by hand in node1
+	for _, job := range jobs.Items {
+		res := node.VerifyResult{Node: job.Labels[jobVerifyLabelNode], HostPort: fooReg.Spec.HostPort}
+		if res.Node == "node0" {
+			res.Hash = hash
+		}
+		g.Expect(r.Create(context.TODO(), newTestJobPod(&job, job.Name, res.Node, res, 0))).ShouldNot(HaveOccurred())
+
+		job.Status.Succeeded = 1
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	result, err := r.reconcileCertDrift(fooReg, nodes, hashes)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).Should(BeNumerically(">", 0))
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(hash))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").CurrentHash).Should(BeEmpty())
+
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateDrifted)
+	g.Expect(cond).ShouldNot(BeNil())
+	g.Expect(cond.Status).Should(Equal(corev1.ConditionTrue))
+	g.Expect(cond.Message).Should(ContainSubstring("node1"))
+
+	//the finished Jobs are removed...
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+
+	//... and the certificate is reinstalled only in node1
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobInstallLabelNode]).Should(Equal("node1"))
+
+	//once reinstalled, the nodes are in sync again
+	fooReg.Status.GetNodeStatus("node1").CurrentHash = hash
+	_, err = r.reconcileCertDrift(fooReg, nodes, hashes)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	cond = fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateDrifted)
+	g.Expect(cond.Status).Should(Equal(corev1.ConditionFalse))
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+const (
+	// reason used in the `CertificateExpiring` condition when the certificate is still valid
+	certExpiryReasonValid = "Valid"
+
+	// reason used in the `CertificateExpiring` condition when the certificate has expired
+	certExpiryReasonExpired = "Expired"
+
+	// one day...
+	day = 24 * time.Hour
+)
+
+// parseCertificates parses all the PEM-encoded certificates in a CA.crt
+func parseCertificates(crt []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for len(crt) > 0 {
+		var block *pem.Block
+		block, crt = pem.Decode(crt)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// getCertsNotAfter returns the earliest expiration time in a list of certificates
+func getCertsNotAfter(certs []*x509.Certificate) time.Time {
+	notAfter := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return notAfter
+}
+
+// certExpiryState returns the reason for the `CertificateExpiring` condition
+// for a certificate that expires at `notAfter`, as well as the duration until
+// the next threshold is crossed (or zero if there are no more thresholds)
+func certExpiryState(notAfter time.Time, now time.Time, thresholdDays []int) (string, time.Duration) {
+	remaining := notAfter.Sub(now)
+	if remaining <= 0 {
+		return certExpiryReasonExpired, 0
+	}
+
+	// process the thresholds from the farthest to the closest one
+	days := append([]int{}, thresholdDays...)
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+
+	reason := certExpiryReasonValid
+	next := remaining // the expiration itself is always the last threshold
+	for _, d := range days {
+		threshold := time.Duration(d) * day
+		if remaining <= threshold {
+			reason = fmt.Sprintf("ExpiringWithin%dDays", d)
+		} else if remaining-threshold < next {
+			next = remaining - threshold
+		}
+	}
+
+	return reason, next
+}
+
+// reconcileCertExpiry checks the expiration of the certificate in `specSecret`, updating the
+// `CertificateExpiring` condition and emitting a Warning event every time a threshold is crossed.
+// It returns a reconcile.Result for waking up again when the next threshold is crossed.
+func (r *ReconcileRegistry) reconcileCertExpiry(registry *kubicv1beta1.Registry, specSecret *corev1.Secret) reconcile.Result {
+	crt := getSecretCA(specSecret)
+	if crt == nil {
+		r.clearCertExpiry(registry)
+		return reconcile.Result{}
+	}
+
+	certs, err := parseCertificates(crt)
+	if err != nil {
+		glog.V(1).Infof("[kubic] ERROR: could not parse the CA.crt for '%s': %s", registry, err)
+		r.clearCertExpiry(registry)
+		return reconcile.Result{}
+	}
+
+	now := time.Now()
+	notAfter := getCertsNotAfter(certs)
+	registry.Status.Certificate.NotAfter = &metav1.Time{Time: notAfter}
+	certExpiryDaysGauge.With(registryMetricsLabels(registry)).Set(notAfter.Sub(now).Hours() / 24)
+
+	reason, next := certExpiryState(notAfter, now, config.CertExpiryWarningDays)
+	switch reason {
+	case certExpiryReasonValid:
+		registry.Status.SetCondition(kubicv1beta1.RegistryCertificateExpiring, corev1.ConditionFalse,
+			reason, fmt.Sprintf("Certificate is valid until %s", notAfter.UTC()))
+	case certExpiryReasonExpired:
+		msg := fmt.Sprintf("Certificate expired at %s", notAfter.UTC())
+		if registry.Status.SetCondition(kubicv1beta1.RegistryCertificateExpiring, corev1.ConditionTrue, reason, msg) {
+			glog.V(1).Infof("[kubic] WARNING: certificate for '%s' expired at %s", registry, notAfter.UTC())
+			r.EventRecorder.Event(registry, corev1.EventTypeWarning, "CertificateExpired", msg)
+		}
+	default:
+		msg := fmt.Sprintf("Certificate expires in %d day(s), at %s", int(notAfter.Sub(now)/day), notAfter.UTC())
+		if registry.Status.SetCondition(kubicv1beta1.RegistryCertificateExpiring, corev1.ConditionTrue, reason, msg) {
+			glog.V(1).Infof("[kubic] WARNING: certificate for '%s' expires at %s", registry, notAfter.UTC())
+			r.EventRecorder.Event(registry, corev1.EventTypeWarning, "CertificateExpiring", msg)
+		}
+	}
+
+	if next <= 0 {
+		return reconcile.Result{}
+	}
+	glog.V(5).Infof("[kubic] will check the certificate expiration for '%s' again in %s", registry, next)
+	return reconcile.Result{RequeueAfter: next + time.Second}
+}
+
+// clearCertExpiry removes all the information about the expiration of the certificate
+func (r *ReconcileRegistry) clearCertExpiry(registry *kubicv1beta1.Registry) {
+	registry.Status.Certificate.NotAfter = nil
+	registry.Status.RemoveCondition(kubicv1beta1.RegistryCertificateExpiring)
+	certExpiryDaysGauge.Delete(registryMetricsLabels(registry))
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func TestCertExpiryState(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	now := time.Now()
+	thresholds := []int{1, 30, 7}
+
+	reason, next := certExpiryState(now.Add(40*day), now, thresholds)
+	g.Expect(reason).Should(Equal(certExpiryReasonValid))
+	g.Expect(next).Should(Equal(10 * day))
+
+	reason, next = certExpiryState(now.Add(10*day), now, thresholds)
+	g.Expect(reason).Should(Equal("ExpiringWithin30Days"))
+	g.Expect(next).Should(Equal(3 * day))
+
+	reason, next = certExpiryState(now.Add(12*time.Hour), now, thresholds)
+	g.Expect(reason).Should(Equal("ExpiringWithin1Days"))
+	g.Expect(next).Should(Equal(12 * time.Hour))
+
+	reason, next = certExpiryState(now.Add(-time.Hour), now, thresholds)
+	g.Expect(reason).Should(Equal(certExpiryReasonExpired))
+	g.Expect(next).Should(BeZero())
+}
+
+func TestReconcileCertExpiry(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	res := r.reconcileCertExpiry(fooReg, fooSec)
+
+	certs, err := parseCertificates(fooSec.Data["ca.crt"])
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NotAfter.Time.Equal(certs[0].NotAfter)).Should(BeTrue())
+	g.Expect(res.RequeueAfter).Should(BeNumerically(">", 0))
+	g.Expect(res.RequeueAfter).Should(BeNumerically("<=", time.Until(certs[0].NotAfter)+time.Second))
+
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateExpiring)
+	g.Expect(cond).ShouldNot(BeNil())
+
+	//the information about the expiration is removed with the certificate
+	r.clearCertExpiry(fooReg)
+	g.Expect(fooReg.Status.Certificate.NotAfter).Should(BeNil())
+	g.Expect(fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateExpiring)).Should(BeNil())
+}
+
+func TestParseCertificatesInvalid(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	_, err := parseCertificates([]byte("not a certificate"))
+	g.Expect(err).Should(HaveOccurred())
+
+	sec := &corev1.Secret{Data: map[string][]byte{}}
+	g.Expect(getSecretCA(sec)).Should(BeNil())
+}
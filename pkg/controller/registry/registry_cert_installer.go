@@ -21,7 +21,7 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
-	"strings"
+	"sort"
 
 	"github.com/golang/glog"
 	batchv1 "k8s.io/api/batch/v1"
@@ -34,6 +34,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
 	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
 )
 
@@ -41,11 +43,14 @@ const (
 	// a prefix for all the jobs created for installing certificates
 	jobInstallNamePrefix = "kubic-registry-installer"
 
-	// some labels in jobs that install certificates: the node where this job should run
+	// some labels in jobs that install certificates: the registry this job is installing
 	jobInstallLabelHostPort = "kubic-registry-installer-host-port"
 
 	// some labels in jobs that install certificates: the hash of the CA.crt this Job is trying to install
 	jobInstallLabelHash = "kubic-registry-installer-hash"
+
+	// some labels in jobs that install certificates: the node where this job runs (shortened when too long)
+	jobInstallLabelNode = "kubic-registry-installer-node"
 )
 
 // reconcileCertPresent reconciles the Certificate for this Registry
@@ -53,164 +58,313 @@ func (r *ReconcileRegistry) ReconcileCertPresent(registry *kubicv1beta1.Registry
 	curNodes map[string]*corev1.Node,
 	specSecret *corev1.Secret) (reconcile.Result, error) {
 
-	// 1. Check if the certificate in this Registry has changed or has never been installed
-	specSecretHash := getSecretHash(specSecret)
-	mustInstall := false
+	// 0. Migrate hashes generated by previous versions of the operator
+	r.migrateLegacyHash(registry, specSecret)
+	migrateLegacyNodesStatus(registry, curNodes, specSecret)
 
-	// 1. Check if the certificate in this Registry has changed
-	if len(registry.Status.Certificate.CurrentHash) > 0 && specSecretHash != registry.Status.Certificate.CurrentHash {
-		glog.V(3).Infof("[kubic] sCA.crt for '%s' as changed: (re)deploying", registry)
-		//  flush the current status, and mark that we must re-deploy the certificate
-		mustInstall = true
-		registry.Status.Certificate.CurrentHash = ""
-		registry.Status.Certificate.NumNodes = 0
-	}
+	specSecretHash := getRegistryHash(registry, specSecret)
 
-	// 2. Check if maybe we have not installed this Registry in some new nodes
-	if registry.Status.Certificate.NumNodes != len(curNodes) {
-		if !mustInstall {
-			glog.V(5).Infof("[kubic] some nodes do not have current CA.crt for '%s' yet: (re)deploying", registry)
-			mustInstall = true
-		}
+	// the hash in each node depends on its runtime targets
+	nodesHashes := getNodesRegistryHashes(registry, specSecret, curNodes)
+	resetCertFailures(registry, nodesHashes)
+
+	// 1. Verify the certificate is still installed in the nodes (forgetting it where it has drifted)
+	driftResult, err := r.reconcileCertDrift(registry, curNodes, nodesHashes)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	// 3. Process all the Jobs that were launched from this controller
+	// 2. Process all the Jobs that were launched from this controller (one per node)
 	jobs, err := getAllJobsWithLabels(r, map[string]string{
 		jobInstallLabelHostPort: kubicutil.SafeID(registry.Spec.HostPort),
-		jobInstallLabelHash:     specSecretHash,
 	})
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 	glog.V(3).Infof("[kubic] %d installation Jobs found for %s", len(jobs), registry.Spec.HostPort)
-	if len(jobs) > 0 {
-		// Process the certificate installation jobs
-		job := jobs[0] // there should be not more than one job
+	jobsByNode := getJobsByNode(jobs)
+
+	// 3. Check the nodes where the current certificate has not been installed yet
+	mustInstall := []string{}
+	for nodeName := range curNodes {
+		nodeStatus := registry.Status.GetNodeStatus(nodeName)
+		nodeHash := nodesHashes[nodeName]
+
+		// (the Jobs for a previous configuration are ignored)
+		job, found := jobsByNode[nodeName]
+		if found && job.Labels[jobInstallLabelHash] != nodeHash {
+			found = false
+		}
+		if !found {
+			if nodeStatus.CurrentHash != nodeHash {
+				glog.V(5).Infof("[kubic] node '%s' does not have current CA.crt for '%s' yet", nodeName, registry)
+				mustInstall = append(mustInstall, nodeName)
+			}
+			continue
+		}
 
 		glog.V(3).Infof("[kubic] Job '%s': Active=%d, Failed=%d, Succeeded=%d",
 			job.GetName(), job.Status.Active, job.Status.Failed, job.Status.Succeeded)
 
 		if job.Status.Active > 0 {
-			// let the Job finish. Once it is done, it will be processed on the
-			// following "... else if jobState.Terminated ..."
+			// let the Job finish. Once it is done, it will be processed in a following reconciliation
 			glog.V(5).Infof("[kubic] Job '%s' is still active... will let it finish", job.Name)
-
-			// there is no need to trigger an installation
-			mustInstall = false
+			continue
 		} else if job.Status.Failed > 0 {
-			glog.V(3).Infof("[kubic] Job '%s' has failed to install '%s's CA.crt", job.Name, registry)
-
-			glog.V(3).Infof("[kubic] removing Job '%s': we will trigger another one...", job.Name)
-			if err = r.Delete(context.TODO(), &job); err != nil {
+			glog.V(3).Infof("[kubic] Job '%s' has failed to install '%s's CA.crt in '%s'", job.Name, registry, nodeName)
+			// (the evidence of the failure must be collected before deleting the Job)
+			if err := r.reportNodeFailure(registry, nodeStatus, "installation", nodeHash, job); err != nil {
 				return reconcile.Result{}, err
 			}
-
-			r.EventRecorder.Event(registry, corev1.EventTypeNormal,
-				"Failed", fmt.Sprintf("Certificate installation of '%s' failed... retrying",
-					specSecretHash))
-
-			mustInstall = true // and mark the node for another try...
+			r.recordCertFailure(registry, nodeName, nodeHash)
 
 		} else if job.Status.Succeeded > 0 {
 			glog.V(3).Infof("[kubic] Job '%s' has finished", job.Name)
-
-			if registry.Status.Certificate.CurrentHash != specSecretHash && registry.Status.Certificate.NumNodes != int(job.Status.Succeeded) {
-				r.EventRecorder.Event(registry, corev1.EventTypeNormal,
-					"Installed", fmt.Sprintf("Certificate '%s' successfully installed", specSecretHash))
-
-				registry.Status.Certificate.CurrentHash = specSecretHash
-				registry.Status.Certificate.NumNodes = int(job.Status.Succeeded)
+			nodeStatus.CurrentHash = nodeHash
+			nodeStatus.SystemTrust = registry.Spec.SystemTrust
+			nodeStatus.LastVerifyTime = metav1.Now()
+			nodeStatus.LastError = ""
+			clearNodeCertFailures(nodeStatus)
+
+			res, err := r.getInstallResult(job)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if res != nil {
+				nodeStatus.Runtimes = res.Runtimes
 			}
 
-			glog.V(3).Infof("[kubic] Job '%s' has completed its mission: removing it!", job.Name)
-			if err = r.Delete(context.TODO(), &job); err != nil {
-				if apierrors.IsGone(err) {
-					return reconcile.Result{}, nil
+			if registry.Spec.NodeProbe {
+				if err := r.collectNodeProbes(registry, job); err != nil {
+					return reconcile.Result{}, err
 				}
-				return reconcile.Result{}, err
 			}
-
-			// The Job has copied the current certificate
-			// so there is no need to mark the node as "dirty"
-			mustInstall = false
 		} else {
 			glog.V(5).Infof("[kubic] Job '%s' has a unknown state", job.Name)
-			mustInstall = false
+			continue
+		}
+
+		// the Job will be re-created (if needed) once it is gone
+		if err = r.finishJob(job); err != nil {
+			return reconcile.Result{}, err
 		}
 	}
 
-	// lunch jobs that install all the `ca.crt`s in all the nodes
-	if mustInstall {
+	// 4. Update the status with the number of nodes where the certificate is installed
+	updateFailedCondition(registry)
+	r.updateCertStatus(registry, specSecretHash, nodesHashes)
+
+	// lunch jobs that install the `ca.crt` in the nodes
+	if len(mustInstall) > 0 {
+		// make sure the registry can be verified with this certificate
+		if !r.preflightCheck(registry, specSecret) {
+			glog.V(3).Infof("[kubic] preflight check failed for '%s': blocking the installation", registry)
+			return mergeResults(driftResult, reconcile.Result{RequeueAfter: preflightRetryPeriod}), nil
+		}
+
+		// delay the installation in the nodes with previous failures (or give up in them)
+		mustInstall = getNodesToRetry(registry, mustInstall, nodesHashes)
+		if delay := getCertRetryDelay(registry, nodesHashes); delay > 0 {
+			glog.V(3).Infof("[kubic] retrying the installation for '%s' in %s", registry, delay)
+			driftResult = mergeResults(driftResult, reconcile.Result{RequeueAfter: delay})
+		}
+		if len(mustInstall) == 0 {
+			return driftResult, nil
+		}
+
 		r.EventRecorder.Event(registry, corev1.EventTypeNormal,
-			"Starting", fmt.Sprintf("Starting certificate installation for '%s'",
-				specSecretHash))
-		err := r.installCertForRegistry(registry, specSecret, len(curNodes))
-		if err != nil {
-			if apierrors.IsAlreadyExists(err) {
-				glog.V(3).Infof("[kubic] the Job already exists")
+			"Starting", fmt.Sprintf("Starting certificate installation for '%s' in %d nodes",
+				specSecretHash, len(mustInstall)))
+
+		sort.Strings(mustInstall)
+		for _, nodeName := range mustInstall {
+			err := r.installCertForRegistry(registry, specSecret, curNodes[nodeName])
+			if err != nil {
+				if apierrors.IsAlreadyExists(err) {
+					glog.V(3).Infof("[kubic] the Job already exists")
+					return reconcile.Result{}, err
+				}
+
+				glog.V(1).Infof("[kubic] ERROR: when trying to create the Job: %s", err)
 				return reconcile.Result{}, err
 			}
+		}
+	}
 
-			glog.V(1).Infof("[kubic] ERROR: when trying to create the Job: %s", err)
-			return reconcile.Result{}, err
+	return driftResult, nil
+}
+
+// updateCertStatus updates the certificate status of the Registry with the number
+// of nodes where the certificate with `hash` has been installed (with the hashes
+// expected in every node in `nodesHashes`)
+func (r *ReconcileRegistry) updateCertStatus(registry *kubicv1beta1.Registry, hash string, nodesHashes map[string]string) {
+	numNodes := countNodesWithHash(registry, nodesHashes)
+	numTotal := len(nodesHashes)
+	glog.V(5).Infof("[kubic] certificate '%s' for '%s' installed in %d/%d nodes",
+		hash, registry, numNodes, numTotal)
+
+	if registry.Status.Certificate.CurrentHash != hash {
+		glog.V(3).Infof("[kubic] CA.crt for '%s' has changed", registry)
+		registry.Status.Certificate.CurrentHash = ""
+		registry.Status.Certificate.NumNodes = 0
+		if numNodes > 0 {
+			registry.Status.Certificate.CurrentHash = hash
 		}
 	}
 
-	return reconcile.Result{}, nil
+	if numNodes == numTotal && registry.Status.Certificate.NumNodes != numNodes {
+		r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+			"Installed", fmt.Sprintf("Certificate '%s' successfully installed", hash))
+	}
+	registry.Status.Certificate.NumNodes = numNodes
+}
+
+// countNodesWithHash returns the number of Nodes where the certificate is installed
+// (ie, the Nodes with the hash expected in `nodesHashes`)
+func countNodesWithHash(registry *kubicv1beta1.Registry, nodesHashes map[string]string) int {
+	res := 0
+	for _, nodeStatus := range registry.Status.Nodes {
+		if hash, found := nodesHashes[nodeStatus.Name]; found && len(hash) > 0 && nodeStatus.CurrentHash == hash {
+			res++
+		}
+	}
+	return res
+}
+
+// migrateLegacyNodesStatus initializes the certificate status of the Nodes when
+// the certificate was installed (in all the Nodes) by a previous version of the operator,
+// where we did not keep track of the certificate installed in each Node.
+// When the `CurrentHash` corresponds to the `specSecret`, each Node gets the hash of the
+// files that previous version really installed there, so only the Nodes that need
+// something else (ie, a `hosts.toml` for containerd) are converged again.
+func migrateLegacyNodesStatus(registry *kubicv1beta1.Registry, curNodes map[string]*corev1.Node, specSecret *corev1.Secret) bool {
+	currentHash := registry.Status.Certificate.CurrentHash
+	if len(currentHash) == 0 || registry.Status.Certificate.NumNodes != len(curNodes) {
+		return false
+	}
+	for _, nodeStatus := range registry.Status.Nodes {
+		if len(nodeStatus.CurrentHash) > 0 {
+			return false
+		}
+	}
+
+	upToDate := specSecret != nil && currentHash == getRegistryHash(registry, specSecret)
 
+	// (the first verification of the nodes is delayed, so the upgrade does not launch
+	// a burst of Jobs in all the nodes)
+	glog.V(3).Infof("[kubic] assuming '%s' is installed in all the nodes for '%s'", currentHash, registry)
+	for nodeName, curNode := range curNodes {
+		nodeStatus := registry.Status.GetNodeStatus(nodeName)
+		nodeStatus.CurrentHash = currentHash
+		if upToDate {
+			nodeStatus.CurrentHash = getLegacyNodeHash(registry, specSecret, curNode)
+		}
+		nodeStatus.LastVerifyTime = metav1.Now()
+	}
+	return true
 }
 
-// installCertForRegistry creates a `Job` for installing certificates at node `Node`
-func (r *ReconcileRegistry) installCertForRegistry(registry *kubicv1beta1.Registry, secret *corev1.Secret, numNodes int) error {
+// migrateLegacyHash replaces a `CurrentHash` computed with the (MD5-based) hash
+// used in previous versions by the current hash, as long as it corresponds to the
+// same CA.crt. This avoids a re-installation of the certificate in all the nodes
+// after an upgrade of the operator.
+func (r *ReconcileRegistry) migrateLegacyHash(registry *kubicv1beta1.Registry, specSecret *corev1.Secret) bool {
+	currentHash := registry.Status.Certificate.CurrentHash
+	if len(currentHash) == 0 {
+		return false
+	}
+
+	legacyHash := getLegacySecretHash(specSecret)
+	if len(legacyHash) == 0 || currentHash != legacyHash {
+		return false
+	}
+
+	newHash := getRegistryHash(registry, specSecret)
+	glog.V(3).Infof("[kubic] migrating hash for '%s': %s -> %s", registry, legacyHash, newHash)
+	registry.Status.Certificate.CurrentHash = newHash
+
+	r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+		"Migrated", fmt.Sprintf("Certificate hash '%s' migrated to '%s'", legacyHash, newHash))
+
+	return true
+}
+
+// getNodeInstallSpec returns the spec for installing the certificate of `registry`
+// in `curNode`, with the `secret` mounted at the `registryDir` in the Job
+func getNodeInstallSpec(registry *kubicv1beta1.Registry, secret *corev1.Secret, curNode *corev1.Node, registryDir string) node.InstallSpec {
+	spec := node.InstallSpec{
+		Name:          registry.Name,
+		HostPort:      registry.Spec.HostPort,
+		CAFile:        filepath.Join(jobSecretsDir, registryDir, node.SecretCAKey),
+		Insecure:      registry.Spec.Insecure,
+		Mirrors:       registry.Spec.Mirrors,
+		Blocked:       registry.Spec.Blocked,
+		RuntimeReload: node.ReloadPolicy(config.RuntimeReloadPolicy),
+	}
+	spec.Targets = getNodeTargets(curNode)
+	if registry.Spec.SystemTrust {
+		spec.SystemTrust = true
+		spec.TrustStore = node.TrustStoreForOSImage(curNode.Status.NodeInfo.OSImage)
+	}
+	if _, found := secret.Data[node.SecretClientCertKey]; found {
+		spec.ClientCertFile = filepath.Join(jobSecretsDir, registryDir, node.SecretClientCertKey)
+		spec.ClientKeyFile = filepath.Join(jobSecretsDir, registryDir, node.SecretClientKeyKey)
+	}
+	return spec
+}
+
+// installCertForRegistry creates a `Job` for installing certificates at node `curNode`
+func (r *ReconcileRegistry) installCertForRegistry(registry *kubicv1beta1.Registry, secret *corev1.Secret, curNode *corev1.Node) error {
 	var err error
 
+	nodeName := curNode.Name
+
 	registryAddress := kubicutil.SafeID(registry.Spec.HostPort)
-	jobName := kubicutil.SafeID(jobInstallNamePrefix) + "-" + registryAddress
+	jobName := getNodeJobName(jobInstallNamePrefix, registry.Spec.HostPort, nodeName)
 
 	// note: docker cannot mount directories with colons (like "registry.suse.de:5000")
 	//       so we will use the path "/certs/this-registry/ca.crt"
 	registryDir := "this-registry"
-	srcDir := filepath.Join(jobSecretsDir, registryDir)
-	dockerDstDir := filepath.Join(dockerCertsDir, registry.Spec.HostPort)
-	podmanDstDir := filepath.Join(podmanCertsDir, registry.Spec.HostPort)
 
-	// commands executed for installing the certificate for Docker and Podman
-	commands := []string{
-		fmt.Sprintf("echo Removing %s", dockerDstDir),
-		fmt.Sprintf("[ -d '%s' ] && rm -rf '%s'", dockerDstDir, dockerDstDir),
-		fmt.Sprintf("mkdir -p '%s'", dockerDstDir),
-		fmt.Sprintf("echo Copying %s/ca.crt to %s/ ...", srcDir, dockerDstDir),
-		fmt.Sprintf("cp '%s/ca.crt' '%s/'", srcDir, dockerDstDir),
+	// the command executed for installing the certificate for Docker, Podman/CRI-O and containerd
+	spec := getNodeInstallSpec(registry, secret, curNode, registryDir)
+	commands, err := getNodeInstallCommands("install", spec)
+	if err != nil {
+		return err
+	}
 
-		fmt.Sprintf("echo Removing %s", podmanDstDir),
-		fmt.Sprintf("[ -d '%s' ] && rm -rf '%s'", podmanDstDir, podmanDstDir),
-		fmt.Sprintf("mkdir -p '%s'", podmanDstDir),
-		fmt.Sprintf("echo Copying %s/ca.crt to %s/ ...", srcDir, podmanDstDir),
-		fmt.Sprintf("cp '%s/ca.crt' '%s/'", srcDir, podmanDstDir),
+	// once installed, probe the registry from the node with the new certificate
+	postCommands := []string{}
+	if registry.Spec.NodeProbe {
+		postCommands = []string{
+			nodeExe, "node", "probe",
+			"--host-port", registry.Spec.HostPort,
+			"--ca-file", node.CertificatePath(jobHostRootDir, registry.Spec.HostPort, spec.Targets),
+		}
+	}
 
-		fmt.Sprintf("echo Done"),
+	// the Secret must be in the namespace of the Job
+	secrets, err := r.getJobSecrets(registry, map[string]*corev1.Secret{registryDir: secret})
+	if err != nil {
+		return err
 	}
 
 	glog.V(3).Infof("[kubic] generating Job '%s'", jobName)
 	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
-		Commands:     []string{strings.Join(commands, " ; ")},
+		Commands:     commands,
 		JobName:      jobName,
-		NumNodes:     int32(numNodes),
-		JobNamespace: metav1.NamespaceSystem,
-		Secrets: map[string]*corev1.Secret{
-			registryDir: secret,
-		},
+		JobNamespace: config.JobNamespace,
+		NodeName:     nodeName,
+		Secrets:      secrets,
 		Labels: map[string]string{
 			jobInstallLabelHostPort: registryAddress,
-			jobInstallLabelHash:     getSecretHash(secret),
-		},
-		HostPaths: []string{
-			"/etc/docker",
-			"/etc/containers",
-		},
-		AntiAffinity: map[string]string{
-			jobInstallLabelHostPort: registryAddress,
+			jobInstallLabelHash:     getNodeRegistryHash(registry, secret, curNode),
+			jobInstallLabelNode:     getNodeLabelValue(nodeName),
 		},
+		HostRootDir:   jobHostRootDir,
+		HostRootPaths: getJobHostRootPaths(needsSystemTrust(registry, nodeName)),
+		HostPID:       needsHostPID(),
+		PostCommands:  postCommands,
 	})
 	if err != nil {
 		return err
@@ -0,0 +1,518 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func testNodes(names ...string) map[string]*corev1.Node {
+	res := map[string]*corev1.Node{}
+	for _, name := range names {
+		res[name] = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	return res
+}
+
+func TestRegistryHashIsLabelValue(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	hash := getRegistryHash(fooReg, fooSec)
+	g.Expect(hash).ShouldNot(BeEmpty())
+	g.Expect(hash).ShouldNot(Equal(getLegacySecretHash(fooSec)))
+	g.Expect(validation.IsValidLabelValue(hash)).Should(BeEmpty())
+
+	//changes in the configuration of the registry lead to a new installation
+	fooReg.Spec.Mirrors = []string{"mirror.foo.com:5000"}
+	g.Expect(getRegistryHash(fooReg, fooSec)).ShouldNot(Equal(hash))
+}
+
+func TestMigrateLegacyHash(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//simulate the certificate was installed by a previous version of the operator
+	//(in Docker and CRI-O nodes, where the CA.crt was all it installed)
+	nodes := testNodes("node0", "node1")
+	nodes["node0"].Status.NodeInfo.ContainerRuntimeVersion = "docker://18.6.1"
+	nodes["node1"].Status.NodeInfo.ContainerRuntimeVersion = "cri-o://1.11.2"
+	fooReg.Status.Certificate.CurrentHash = getLegacySecretHash(fooSec)
+	fooReg.Status.Certificate.NumNodes = len(nodes)
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//the hashes should be migrated without triggering a new installation
+	hashes := getNodesRegistryHashes(fooReg, fooSec, nodes)
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(Equal(getRegistryHash(fooReg, fooSec)))
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(len(nodes)))
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(hashes["node0"]))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").CurrentHash).Should(Equal(hashes["node1"]))
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+}
+
+func TestMigrateLegacyHashContainerd(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//previous versions did not install the hosts.toml for containerd
+	nodes := testNodes("node0", "node1")
+	nodes["node0"].Status.NodeInfo.ContainerRuntimeVersion = "docker://18.6.1"
+	nodes["node1"].Status.NodeInfo.ContainerRuntimeVersion = "containerd://1.2.0"
+	fooReg.Status.Certificate.CurrentHash = getLegacySecretHash(fooSec)
+	fooReg.Status.Certificate.NumNodes = len(nodes)
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//only the containerd node must be converged
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Spec.Template.Spec.NodeName).Should(Equal("node1"))
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+}
+
+func TestMigrateLegacyHashChangedCert(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//simulate a different certificate was installed by a previous version of the operator
+	fooReg.Status.Certificate.CurrentHash = "aW5zdGFsbGVkLWJlZm9yZQ"
+	fooReg.Status.Certificate.NumNodes = 1
+
+	_, err = r.ReconcileCertPresent(fooReg, testNodes("node0"), fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//the certificate must be installed again
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(BeEmpty())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobInstallLabelHash]).Should(Equal(getRegistryHash(fooReg, fooSec)))
+}
+
+func TestInstallPerNode(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	hash := getRegistryHash(fooReg, fooSec)
+	nodes := testNodes("node0", "node1")
+
+	//one Job must be created for each node
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		nodeName := job.Labels[jobInstallLabelNode]
+		g.Expect(nodes).Should(HaveKey(nodeName))
+		g.Expect(job.Spec.Template.Spec.NodeName).Should(Equal(nodeName))
+		g.Expect(job.Labels[jobInstallLabelHash]).Should(Equal(hash))
+	}
+
+	//simulate the Job succeeded in node0 and failed in node1
+	for _, job := range jobs.Items {
+		if job.Labels[jobInstallLabelNode] == "node0" {
+			job.Status.Succeeded = 1
+		} else {
+			job.Status.Failed = 1
+		}
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(Equal(hash))
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(1))
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(hash))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").CurrentHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.GetNodeStatus("node1").LastError).ShouldNot(BeEmpty())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").Failures).Should(BeZero())
+	g.Expect(fooReg.Status.GetNodeStatus("node1").Failures).Should(Equal(1))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").FailedHash).Should(Equal(hash))
+
+	//the finished Jobs are removed...
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+
+	//... the installation is delayed by the backoff...
+	result, err := r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).Should(BeNumerically(">", 0))
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+
+	//... but a new node gets the certificate right away...
+	nodes["node2"] = testNodes("node2")["node2"]
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobInstallLabelNode]).Should(Equal("node2"))
+	g.Expect(r.Delete(context.TODO(), &jobs.Items[0])).ShouldNot(HaveOccurred())
+	delete(nodes, "node2")
+
+	//... and then it is retried in node1
+	fooReg.Status.GetNodeStatus("node1").LastFailureTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobInstallLabelNode]).Should(Equal("node1"))
+}
+
+func TestInstallAllNodes(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	for _, n := range testNodes("a", "b", "c") {
+		g.Expect(r.Create(context.TODO(), n)).ShouldNot(HaveOccurred())
+	}
+
+	//every node in the cluster must be a different Node
+	nodes, err := getAllNodes(r)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(nodes).Should(HaveLen(3))
+	for nodeName, curNode := range nodes {
+		g.Expect(curNode.Name).Should(Equal(nodeName))
+	}
+
+	//one Job must be created in each node, with its own name
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(3))
+	for _, job := range jobs.Items {
+		nodeName := job.Spec.Template.Spec.NodeName
+		g.Expect(nodes).Should(HaveKey(nodeName))
+		g.Expect(job.Name).Should(Equal(getNodeJobName(jobInstallNamePrefix, fooReg.Spec.HostPort, nodeName)))
+	}
+}
+
+// getJobHostPaths returns the paths of the node mounted in a Job
+func getJobHostPaths(job *batchv1.Job) []string {
+	res := []string{}
+	for _, volume := range job.Spec.Template.Spec.Volumes {
+		if volume.HostPath != nil {
+			res = append(res, volume.HostPath.Path)
+		}
+	}
+	return res
+}
+
+func TestInstallHostRootMount(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	nodes := testNodes("node0")
+	nodes["node0"].Status.NodeInfo.OSImage = "SUSE Linux Enterprise Server 15"
+
+	getJob := func() *batchv1.Job {
+		_, err := r.ReconcileCertPresent(fooReg, nodes, fooSec)
+		g.Expect(err).ShouldNot(HaveOccurred())
+
+		jobs := &batchv1.JobList{}
+		g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+		g.Expect(jobs.Items).Should(HaveLen(1))
+		g.Expect(r.Delete(context.TODO(), &jobs.Items[0])).ShouldNot(HaveOccurred())
+		return &jobs.Items[0]
+	}
+
+	//only the directories of the runtimes are mounted by default...
+	g.Expect(getJobHostPaths(getJob())).Should(Equal(jobHostPaths))
+
+	//... and the whole root filesystem of the node for the system trust store...
+	fooReg.Spec.SystemTrust = true
+	g.Expect(getJobHostPaths(getJob())).Should(Equal([]string{"/"}))
+
+	//... even when it has been disabled, for removing the CA.crt from there
+	fooReg.Spec.SystemTrust = false
+	fooReg.Status.GetNodeStatus("node0").SystemTrust = true
+	g.Expect(getJobHostPaths(getJob())).Should(Equal([]string{"/"}))
+}
+
+func TestInstallPerNodeRuntime(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//a docker node, and a node being migrated to containerd
+	clusterNodes := testNodes("node0", "node1")
+	clusterNodes["node0"].Status.NodeInfo.ContainerRuntimeVersion = "docker://18.6.1"
+	clusterNodes["node1"].Status.NodeInfo.ContainerRuntimeVersion = "containerd://1.2.0"
+	clusterNodes["node1"].Labels = map[string]string{node.RuntimeTargetsLabel: "docker_containerd"}
+	for _, n := range clusterNodes {
+		g.Expect(r.Create(context.TODO(), n)).ShouldNot(HaveOccurred())
+	}
+
+	//every node must get its own runtime targets
+	nodes, err := getAllNodes(r)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(getNodeTargets(nodes["node0"])).Should(Equal([]string{"docker"}))
+	g.Expect(getNodeTargets(nodes["node1"])).Should(Equal([]string{"docker", "containerd"}))
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+
+	hashes := getNodesRegistryHashes(fooReg, fooSec, nodes)
+	g.Expect(hashes["node0"]).ShouldNot(Equal(hashes["node1"]))
+	for _, job := range jobs.Items {
+		nodeName := job.Labels[jobInstallLabelNode]
+		g.Expect(job.Labels[jobInstallLabelHash]).Should(Equal(hashes[nodeName]))
+
+		//the targets for each node are passed in the spec
+		command := strings.Join(job.Spec.Template.Spec.Containers[0].Command, " ")
+		if nodeName == "node0" {
+			g.Expect(command).Should(ContainSubstring(`"targets":["docker"]`))
+		} else {
+			g.Expect(command).Should(ContainSubstring(`"targets":["docker","containerd"]`))
+		}
+
+		job.Status.Succeeded = 1
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(2))
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(hashes["node0"]))
+	g.Expect(fooReg.Status.GetNodeStatus("node1").CurrentHash).Should(Equal(hashes["node1"]))
+}
+
+func TestRemovePerNode(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//simulate the registry is being deleted after installing the certificate in node0
+	timestamp := metav1.Now()
+	fooReg.ObjectMeta.SetDeletionTimestamp(&timestamp)
+	fooReg.ObjectMeta.Finalizers = []string{regsFinalizerName}
+	fooReg.Status.Certificate.CurrentHash = "some-hash"
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = "some-hash"
+
+	nodes := testNodes("node0", "node1")
+
+	g.Expect(r.ReconcileCertMissing(fooReg, nodes)).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.ObjectMeta.Finalizers).Should(HaveLen(1))
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Labels[jobRemoveLabelNode]).Should(Equal("node0"))
+	g.Expect(jobs.Items[0].Spec.Template.Spec.NodeName).Should(Equal("node0"))
+
+	//simulate the Job succeeded
+	job := jobs.Items[0]
+	job.Status.Succeeded = 1
+	g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+
+	g.Expect(r.ReconcileCertMissing(fooReg, nodes)).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.CurrentHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(0))
+	g.Expect(fooReg.ObjectMeta.Finalizers).Should(BeEmpty())
+}
+
+func TestNodeJobName(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	name := getNodeJobName(jobInstallNamePrefix, "registry.suse.de:5000", "node0")
+	g.Expect(name).Should(Equal("kubic-registry-installer-registry-suse-de-5000-node0"))
+
+	//long names must be shortened, but still be different for each node
+	longNode := strings.Repeat("node", 20)
+	name0 := getNodeJobName(jobInstallNamePrefix, "registry.suse.de:5000", longNode+"0")
+	name1 := getNodeJobName(jobInstallNamePrefix, "registry.suse.de:5000", longNode+"1")
+	g.Expect(validation.IsValidLabelValue(name0)).Should(BeEmpty())
+	g.Expect(name0).ShouldNot(Equal(name1))
+}
+
+func TestInstallLongNodeNames(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//node names can be longer than a label value
+	longNode := strings.Repeat("node.", 20)
+	nodes := testNodes(longNode+"0", longNode+"1")
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		g.Expect(validation.IsValidLabelValue(job.Labels[jobInstallLabelNode])).Should(BeEmpty())
+		g.Expect(nodes).Should(HaveKey(job.Spec.Template.Spec.NodeName))
+
+		job.Status.Succeeded = 1
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	//the Jobs are matched with their nodes
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Certificate.NumNodes).Should(Equal(2))
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+const (
+	// timeout for connecting to the registry in the preflight check (it is done in
+	// the reconciliation loop, so it must be short: the check is retried anyway)
+	preflightTimeout = 2 * time.Second
+
+	// time between preflight checks when the installation is blocked by a failure
+	preflightRetryPeriod = time.Minute
+)
+
+// preflightCheck verifies the certificate in `specSecret` against the registry
+// (when enabled in the Registry), updating the `CertificateVerified` condition.
+// It returns false when the installation of the certificate must be blocked.
+func (r *ReconcileRegistry) preflightCheck(registry *kubicv1beta1.Registry, specSecret *corev1.Secret) bool {
+	if registry.Spec.Preflight == nil {
+		registry.Status.RemoveCondition(kubicv1beta1.RegistryCertificateVerified)
+		return true
+	}
+
+	glog.V(3).Infof("[kubic] verifying the certificate for '%s' before installing it", registry)
+	err := kubicutil.VerifyTLS(registry.Spec.HostPort, getSecretCA(specSecret), preflightTimeout)
+	if err == nil {
+		glog.V(3).Infof("[kubic] certificate for '%s' verified", registry)
+		if registry.Status.SetCondition(kubicv1beta1.RegistryCertificateVerified, corev1.ConditionTrue,
+			"Verified", "The registry presented a certificate signed by this CA") {
+			r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+				"Verified", fmt.Sprintf("Certificate verified against '%s'", registry.Spec.HostPort))
+		}
+		return true
+	}
+
+	glog.V(1).Infof("[kubic] ERROR: could not verify the certificate for '%s': %s", registry, err)
+	msg := fmt.Sprintf("Could not verify the certificate against '%s': %s", registry.Spec.HostPort, err)
+	if registry.Status.SetCondition(kubicv1beta1.RegistryCertificateVerified, corev1.ConditionFalse,
+		"VerificationFailed", msg) {
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, "VerificationFailed", msg)
+	}
+
+	if registry.Spec.Preflight.IgnoreFailure {
+		glog.V(3).Infof("[kubic] ignoring the verification failure for '%s'", registry)
+		return true
+	}
+	return false
+}
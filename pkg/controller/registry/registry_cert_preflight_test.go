@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/test"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+// newTestCASecret returns a Secret with the CA.crt of a TLS test server
+func newTestCASecret(server *httptest.Server) *corev1.Secret {
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-ca-crt",
+			Namespace: metav1.NamespaceSystem,
+		},
+		Data: map[string][]byte{"ca.crt": crt},
+	}
+}
+
+// newTestTLSRegistry starts a TLS server, returning the server and a Secret with its CA.crt
+func newTestTLSRegistry() (*httptest.Server, *corev1.Secret) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	return server, newTestCASecret(server)
+}
+
+// newTestTLSRegistryObject returns a Registry that points to a test server
+func newTestTLSRegistryObject(t *testing.T, server *httptest.Server) *kubicv1beta1.Registry {
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+	fooReg.Spec.HostPort = strings.TrimPrefix(server.URL, "https://")
+	fooReg.Spec.Preflight = &kubicv1beta1.RegistryPreflight{}
+	return fooReg
+}
+
+func TestVerifyTLS(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	server, secret := newTestTLSRegistry()
+	defer server.Close()
+
+	hostPort := strings.TrimPrefix(server.URL, "https://")
+
+	err := kubicutil.VerifyTLS(hostPort, secret.Data["ca.crt"], time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//the server is not using a certificate signed by this CA
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+	err = kubicutil.VerifyTLS(hostPort, fooSec.Data["ca.crt"], time.Second)
+	g.Expect(err).Should(HaveOccurred())
+}
+
+func TestPreflightBlocksInstallation(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	server, _ := newTestTLSRegistry()
+	defer server.Close()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+	fooReg := newTestTLSRegistryObject(t, server)
+
+	res, err := r.ReconcileCertPresent(fooReg, testNodes("node0"), fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res.RequeueAfter).Should(Equal(preflightRetryPeriod))
+
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateVerified)
+	g.Expect(cond).ShouldNot(BeNil())
+	g.Expect(cond.Status).Should(Equal(corev1.ConditionFalse))
+
+	//no installation Job should be created
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+
+	//unless the failure is ignored
+	fooReg.Spec.Preflight.IgnoreFailure = true
+	_, err = r.ReconcileCertPresent(fooReg, testNodes("node0"), fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+}
+
+func TestPreflightVerified(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	server, secret := newTestTLSRegistry()
+	defer server.Close()
+
+	fooReg := newTestTLSRegistryObject(t, server)
+
+	_, err := r.ReconcileCertPresent(fooReg, testNodes("node0"), secret)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryCertificateVerified)
+	g.Expect(cond).ShouldNot(BeNil())
+	g.Expect(cond.Status).Should(Equal(corev1.ConditionTrue))
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+}
@@ -20,19 +20,19 @@ package registry
 import (
 	"context"
 	"fmt"
-	"path/filepath"
-	"strings"
+	"sort"
 
 	"github.com/golang/glog"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	kubeadmutil "k8s.io/kubernetes/cmd/kubeadm/app/util"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
 	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
 )
 
@@ -40,12 +40,15 @@ const (
 	// a prefix for all the jobs created for removing certificates
 	jobRemoveNamePrefix = "kubic-registry-remover"
 
-	// some labels in jobs that remove certificates: the node where this job should run
+	// some labels in jobs that remove certificates: the registry this job is removing
 	jobRemoveLabelHostPort = "kubic-registry-remover-host-port"
 
 	// some labels in jobs that remove certificates: the hash of the CA.crt this Job is trying to remove
 	jobRemoveLabelHash = "kubic-registry-remover-hash"
 
+	// some labels in jobs that remove certificates: the node where this job runs (shortened when too long)
+	jobRemoveLabelNode = "kubic-registry-remover-node"
+
 	// Name of the finalizer
 	regsFinalizerName = "registry.finalizers.kubic.opensuse.org"
 )
@@ -56,7 +59,8 @@ const (
 // multiple types for same object.
 func (r *ReconcileRegistry) ReconcileCertMissing(instance *kubicv1beta1.Registry, nodes map[string]*corev1.Node) error {
 
-	mustRemove := false
+	// Migrate the status generated by previous versions of the operator
+	migrateLegacyNodesStatus(instance, nodes, nil)
 
 	secretHash := instance.Status.Certificate.CurrentHash
 
@@ -68,51 +72,58 @@ func (r *ReconcileRegistry) ReconcileCertMissing(instance *kubicv1beta1.Registry
 		return err
 	}
 	glog.V(5).Infof("[kubic] %d removal Jobs found for %s '%s'", len(jobs), instance.Spec.HostPort, secretHash)
+	jobsByNode := getJobsByNode(jobs)
+
+	mustRemove := []string{}
+	for nodeName := range nodes {
+		nodeStatus := instance.Status.GetNodeStatus(nodeName)
 
-	if len(jobs) == 0 {
-		if len(instance.Status.Certificate.CurrentHash) > 0 && instance.Status.Certificate.NumNodes != 0 {
-			glog.V(3).Infof("[kubic] will start a removal Job")
-			mustRemove = true
+		job, found := jobsByNode[nodeName]
+		if !found {
+			if len(nodeStatus.CurrentHash) > 0 {
+				mustRemove = append(mustRemove, nodeName)
+			}
+			continue
 		}
-	} else {
-		// Process the certificate removal jobs
-		job := jobs[0] // there should be not more than one job
 
+		// Process the certificate removal job in this node
 		glog.V(3).Infof("[kubic] Job '%s': Active=%d, Failed=%d, Succeeded=%d",
 			job.GetName(), job.Status.Active, job.Status.Failed, job.Status.Succeeded)
 
 		if job.Status.Active > 0 {
 			glog.V(3).Infof("[kubic] Job '%s' is still active... will let it finish", job.Name)
-		} else {
-			glog.V(3).Infof("[kubic] Job '%s' has finished", job.Name)
-
-			if len(instance.Status.Certificate.CurrentHash) > 0 && instance.Status.Certificate.NumNodes > 0 {
-				r.EventRecorder.Event(instance, corev1.EventTypeNormal,
-					"Installed", fmt.Sprintf("Certificate '%s' successfully removed", secretHash))
-				instance.Status.Certificate.CurrentHash = ""
-				instance.Status.Certificate.NumNodes = 0
-			}
-
-			glog.V(3).Infof("[kubic] Job '%s' has completed its mission: removing it!", job.Name)
-			if err = r.Delete(context.TODO(), &job); err != nil {
-				if apierrors.IsGone(err) {
-					return nil
-				}
+			continue
+		} else if job.Status.Failed > 0 {
+			glog.V(3).Infof("[kubic] Job '%s' has failed to remove '%s's CA.crt from '%s'", job.Name, instance, nodeName)
+			if err := r.reportNodeFailure(instance, nodeStatus, "removal", secretHash, job); err != nil {
 				return err
 			}
+		} else if job.Status.Succeeded > 0 {
+			glog.V(3).Infof("[kubic] Job '%s' has finished", job.Name)
+			nodeStatus.CurrentHash = ""
+			nodeStatus.SystemTrust = false
+			nodeStatus.LastError = ""
+		} else {
+			glog.V(5).Infof("[kubic] Job '%s' has a unknown state", job.Name)
+			continue
+		}
 
-			r.finalizerDone(instance)
+		if err = r.finishJob(job); err != nil {
+			return err
 		}
 	}
 
-	if mustRemove {
-		// If no certs removal Jobs are runningg, start one
+	if removed := r.updateCertRemovalStatus(instance); !removed && len(mustRemove) > 0 {
+		// start a removal Job in the nodes where no Job is running
 		glog.V(3).Infof("[kubic] deleting all the dependencies for %s", instance)
 		r.EventRecorder.Event(instance, corev1.EventTypeNormal,
-			"Removing", fmt.Sprintf("Removing certificate for '%s'...", instance))
+			"Removing", fmt.Sprintf("Removing certificate for '%s' from %d nodes...", instance, len(mustRemove)))
 
-		if err := r.removeCertForRegistry(instance, secretHash, len(nodes)); err != nil {
-			return err
+		sort.Strings(mustRemove)
+		for _, nodeName := range mustRemove {
+			if err := r.removeCertForRegistry(instance, secretHash, nodeName); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -120,40 +131,76 @@ func (r *ReconcileRegistry) ReconcileCertMissing(instance *kubicv1beta1.Registry
 	return nil
 }
 
-// removeCertForRegistry creates a `Job` for removing the certificate in `registry`
-func (r *ReconcileRegistry) removeCertForRegistry(registry *kubicv1beta1.Registry, secretHash string, numNodes int) error {
+// updateCertRemovalStatus updates the certificate status of the Registry with the number
+// of nodes where the certificate is still installed, returning true (and marking the
+// Registry as done) when it has been removed from all the nodes
+func (r *ReconcileRegistry) updateCertRemovalStatus(instance *kubicv1beta1.Registry) bool {
+	numNodes := countNodesWithCert(instance)
+	instance.Status.Certificate.NumNodes = numNodes
+
+	if numNodes > 0 {
+		glog.V(3).Infof("[kubic] certificate for %s still present in %d nodes", instance, numNodes)
+		return false
+	}
+
+	if len(instance.Status.Certificate.CurrentHash) > 0 {
+		r.EventRecorder.Event(instance, corev1.EventTypeNormal,
+			"Removed", fmt.Sprintf("Certificate '%s' successfully removed", instance.Status.Certificate.CurrentHash))
+		instance.Status.Certificate.CurrentHash = ""
+	}
+
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		r.finalizerDone(instance)
+	}
+	return true
+}
+
+// countNodesWithCert returns the number of Nodes where some certificate is installed
+func countNodesWithCert(registry *kubicv1beta1.Registry) int {
+	res := 0
+	for _, nodeStatus := range registry.Status.Nodes {
+		if len(nodeStatus.CurrentHash) > 0 {
+			res++
+		}
+	}
+	return res
+}
+
+// isCertInstalled returns true if some certificate is installed for the Registry in some Node
+func isCertInstalled(registry *kubicv1beta1.Registry) bool {
+	return len(registry.Status.Certificate.CurrentHash) > 0 || countNodesWithCert(registry) > 0
+}
+
+// removeCertForRegistry creates a `Job` for removing the certificate in `registry` from node `nodeName`
+func (r *ReconcileRegistry) removeCertForRegistry(registry *kubicv1beta1.Registry, secretHash string, nodeName string) error {
 	var err error
 
 	registryAddress := kubicutil.SafeID(registry.Spec.HostPort)
-	jobName := kubicutil.SafeID(jobRemoveNamePrefix) + "-" + registryAddress
+	jobName := getNodeJobName(jobRemoveNamePrefix, registry.Spec.HostPort, nodeName)
 
-	dockerDstDir := filepath.Join(dockerCertsDir, registry.Spec.HostPort)
-	podmanDstDir := filepath.Join(podmanCertsDir, registry.Spec.HostPort)
-
-	commands := []string{
-		fmt.Sprintf("echo Removing %s", dockerDstDir),
-		fmt.Sprintf("rm -rf '%s'", dockerDstDir),
-		fmt.Sprintf("echo Removing %s", podmanDstDir),
-		fmt.Sprintf("rm -rf '%s'", podmanDstDir),
+	commands, err := getNodeInstallCommands("remove", node.InstallSpec{
+		Name:          registry.Name,
+		HostPort:      registry.Spec.HostPort,
+		RuntimeReload: node.ReloadPolicy(config.RuntimeReloadPolicy),
+	})
+	if err != nil {
+		return err
 	}
 
 	glog.V(3).Infof("[kubic] generating Job '%s'", jobName)
 	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
-		Commands:     []string{strings.Join(commands, " ; ")},
+		Commands:     commands,
 		JobName:      jobName,
-		NumNodes:     int32(numNodes),
-		JobNamespace: metav1.NamespaceSystem,
+		JobNamespace: config.JobNamespace,
+		NodeName:     nodeName,
 		Labels: map[string]string{
 			jobRemoveLabelHostPort: registryAddress,
 			jobRemoveLabelHash:     secretHash,
+			jobRemoveLabelNode:     getNodeLabelValue(nodeName),
 		},
-		HostPaths: []string{
-			"/etc/docker",
-			"/etc/containers",
-		},
-		AntiAffinity: map[string]string{
-			jobInstallLabelHostPort: registryAddress,
-		},
+		HostRootDir:   jobHostRootDir,
+		HostRootPaths: getJobHostRootPaths(needsSystemTrust(registry, nodeName)),
+		HostPID:       needsHostPID(),
 	})
 	if err != nil {
 		return err
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+// recordCertFailure counts a failed installation of the certificate with `hash` in the
+// Node `nodeName`, setting the `Failed` condition once the retry limit has been reached
+// in that Node (the other Nodes are not affected)
+func (r *ReconcileRegistry) recordCertFailure(registry *kubicv1beta1.Registry, nodeName string, hash string) {
+	nodeStatus := registry.Status.GetNodeStatus(nodeName)
+	if nodeStatus.FailedHash != hash {
+		clearNodeCertFailures(nodeStatus)
+	}
+
+	nodeStatus.FailedHash = hash
+	nodeStatus.Failures++
+	nodeStatus.LastFailureTime = metav1.Now()
+	glog.V(3).Infof("[kubic] installation of '%s' for '%s' has failed %d times in node '%s'",
+		hash, registry, nodeStatus.Failures, nodeName)
+
+	if isRetryLimitReached(nodeStatus) {
+		msg := fmt.Sprintf("Installation of certificate '%s' failed %d times in node '%s': giving up until the Registry or its Secret change",
+			hash, nodeStatus.Failures, nodeName)
+		if registry.Status.SetCondition(kubicv1beta1.RegistryFailed, corev1.ConditionTrue, "RetryLimitReached", msg) {
+			glog.V(1).Infof("[kubic] ERROR: giving up the installation of '%s' for '%s' in node '%s'", hash, registry, nodeName)
+			r.EventRecorder.Event(registry, corev1.EventTypeWarning, "RetryLimitReached", msg)
+		}
+	}
+}
+
+// resetCertFailures forgets the failures in the Nodes where the certificate
+// expected (in `nodesHashes`) is a different one, or where it has been installed
+func resetCertFailures(registry *kubicv1beta1.Registry, nodesHashes map[string]string) {
+	for i := range registry.Status.Nodes {
+		nodeStatus := &registry.Status.Nodes[i]
+		if len(nodeStatus.FailedHash) == 0 {
+			continue
+		}
+		hash := nodesHashes[nodeStatus.Name]
+		if nodeStatus.FailedHash == hash && nodeStatus.CurrentHash != hash {
+			continue
+		}
+		glog.V(3).Infof("[kubic] certificate for '%s' has changed in node '%s': forgetting previous failures", registry, nodeStatus.Name)
+		clearNodeCertFailures(nodeStatus)
+	}
+	updateFailedCondition(registry)
+}
+
+// clearNodeCertFailures forgets all the failures in a Node
+func clearNodeCertFailures(nodeStatus *kubicv1beta1.RegistryNodeStatus) {
+	nodeStatus.FailedHash = ""
+	nodeStatus.Failures = 0
+	nodeStatus.LastFailureTime = metav1.Time{}
+}
+
+// updateFailedCondition removes the `Failed` condition once no Node has reached the retry limit
+func updateFailedCondition(registry *kubicv1beta1.Registry) {
+	for i := range registry.Status.Nodes {
+		if isRetryLimitReached(&registry.Status.Nodes[i]) {
+			return
+		}
+	}
+	registry.Status.RemoveCondition(kubicv1beta1.RegistryFailed)
+}
+
+// isRetryLimitReached returns true when the installation in a Node has failed too many times
+func isRetryLimitReached(nodeStatus *kubicv1beta1.RegistryNodeStatus) bool {
+	return config.InstallRetryLimit > 0 && nodeStatus.Failures >= config.InstallRetryLimit
+}
+
+// getNodeRetryDelay returns the time the installation of the certificate `hash` in the
+// Node `nodeName` must wait after previous failures, or true when it must not be retried anymore
+func getNodeRetryDelay(registry *kubicv1beta1.Registry, nodeName string, hash string) (time.Duration, bool) {
+	for i := range registry.Status.Nodes {
+		nodeStatus := &registry.Status.Nodes[i]
+		if nodeStatus.Name != nodeName {
+			continue
+		}
+		if nodeStatus.Failures == 0 || nodeStatus.FailedHash != hash {
+			return 0, false
+		}
+		if isRetryLimitReached(nodeStatus) {
+			return 0, true
+		}
+
+		delay := nodeStatus.LastFailureTime.Add(getRetryBackoff(nodeStatus.Failures)).Sub(time.Now())
+		if delay < 0 {
+			return 0, false
+		}
+		return delay, false
+	}
+	return 0, false
+}
+
+// getCertRetryDelay returns the shortest time the installation of the certificate
+// must wait in any Node after previous failures (0 when no Node is waiting)
+func getCertRetryDelay(registry *kubicv1beta1.Registry, nodesHashes map[string]string) time.Duration {
+	res := time.Duration(0)
+	for nodeName, hash := range nodesHashes {
+		if delay, _ := getNodeRetryDelay(registry, nodeName, hash); delay > 0 && (res == 0 || delay < res) {
+			res = delay
+		}
+	}
+	return res
+}
+
+// getNodesToRetry returns the Nodes in `nodeNames` where the installation is not
+// delayed after previous failures (with the hashes expected in `nodesHashes`)
+func getNodesToRetry(registry *kubicv1beta1.Registry, nodeNames []string, nodesHashes map[string]string) []string {
+	res := []string{}
+	for _, nodeName := range nodeNames {
+		if delay, giveUp := getNodeRetryDelay(registry, nodeName, nodesHashes[nodeName]); giveUp {
+			glog.V(5).Infof("[kubic] too many failures for '%s' in node '%s': not retrying the installation", registry, nodeName)
+			continue
+		} else if delay > 0 {
+			continue
+		}
+		res = append(res, nodeName)
+	}
+	return res
+}
+
+// getRetryBackoff returns the delay before retrying after `failures` failures:
+// the backoff is doubled after every failure, up to the maximum backoff
+func getRetryBackoff(failures int) time.Duration {
+	backoff := config.InstallRetryBackoff
+	for i := 1; i < failures && backoff < config.InstallRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > config.InstallRetryMaxBackoff {
+		backoff = config.InstallRetryMaxBackoff
+	}
+	return backoff
+}
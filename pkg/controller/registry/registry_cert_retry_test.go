@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+func TestRetryBackoff(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	defer func(base, max time.Duration) {
+		config.InstallRetryBackoff, config.InstallRetryMaxBackoff = base, max
+	}(config.InstallRetryBackoff, config.InstallRetryMaxBackoff)
+	config.InstallRetryBackoff = 10 * time.Second
+	config.InstallRetryMaxBackoff = time.Minute
+
+	g.Expect(getRetryBackoff(1)).Should(Equal(10 * time.Second))
+	g.Expect(getRetryBackoff(2)).Should(Equal(20 * time.Second))
+	g.Expect(getRetryBackoff(3)).Should(Equal(40 * time.Second))
+	g.Expect(getRetryBackoff(4)).Should(Equal(time.Minute))
+	g.Expect(getRetryBackoff(100)).Should(Equal(time.Minute))
+}
+
+func TestRetryLimit(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	defer func(limit int) { config.InstallRetryLimit = limit }(config.InstallRetryLimit)
+	config.InstallRetryLimit = 3
+
+	r := newTestReconcileRegistry()
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//every failure delays the next installation in the node
+	for i := 1; i < config.InstallRetryLimit; i++ {
+		r.recordCertFailure(fooReg, "node0", "hash1")
+		g.Expect(fooReg.Status.GetNodeStatus("node0").Failures).Should(Equal(i))
+
+		delay, giveUp := getNodeRetryDelay(fooReg, "node0", "hash1")
+		g.Expect(giveUp).Should(BeFalse())
+		g.Expect(delay).Should(BeNumerically(">", 0))
+		g.Expect(fooReg.Status.GetCondition(kubicv1beta1.RegistryFailed)).Should(BeNil())
+	}
+
+	//until the limit is reached
+	r.recordCertFailure(fooReg, "node0", "hash1")
+	_, giveUp := getNodeRetryDelay(fooReg, "node0", "hash1")
+	g.Expect(giveUp).Should(BeTrue())
+	cond := fooReg.Status.GetCondition(kubicv1beta1.RegistryFailed)
+	g.Expect(cond).ShouldNot(BeNil())
+	g.Expect(cond.Status).Should(Equal(corev1.ConditionTrue))
+
+	//the other nodes are not affected
+	delay, giveUp := getNodeRetryDelay(fooReg, "node1", "hash1")
+	g.Expect(giveUp).Should(BeFalse())
+	g.Expect(delay).Should(BeZero())
+	g.Expect(getCertRetryDelay(fooReg, map[string]string{"node0": "hash1", "node1": "hash1"})).Should(BeZero())
+
+	//a different certificate is installed right away
+	delay, giveUp = getNodeRetryDelay(fooReg, "node0", "hash2")
+	g.Expect(giveUp).Should(BeFalse())
+	g.Expect(delay).Should(BeZero())
+
+	resetCertFailures(fooReg, map[string]string{"node0": "hash2"})
+	g.Expect(fooReg.Status.GetNodeStatus("node0").Failures).Should(BeZero())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").FailedHash).Should(BeEmpty())
+	g.Expect(fooReg.Status.GetCondition(kubicv1beta1.RegistryFailed)).Should(BeNil())
+}
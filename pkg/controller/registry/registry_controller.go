@@ -20,12 +20,14 @@ package registry
 import (
 	"context"
 	"fmt"
+	"reflect"
 
 	"github.com/golang/glog"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -38,17 +40,12 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 
 	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
 )
 
 const (
 	// the registries controller name
 	regsControllerName = "KubicRegistriesController"
-
-	// certificates directory for Docker
-	dockerCertsDir = "/etc/docker/certs.d/"
-
-	// certificates directory for podman
-	podmanCertsDir = "/etc/containers/certs.d/"
 )
 
 var (
@@ -62,8 +59,22 @@ func newRegistryReconcilier(mgr manager.Manager) reconcile.Reconciler {
 		EventRecorder: mgr.GetRecorder(regsControllerName),
 		scheme:        mgr.GetScheme(),
 	}
+	if clientset, err := kubernetes.NewForConfig(mgr.GetConfig()); err == nil {
+		r.podLogs = clientsetPodLogs{clientset}
+		r.nodeAnnotator = clientsetNodeAnnotator{clientset}
+	} else {
+		glog.V(1).Infof("[kubic] ERROR: the logs of the failed Jobs will not be available: %s", err)
+	}
+
 	//RegistryReconciler implements a default Cert Reconcilier
 	r.certReconciler = r
+	if config.InstallMode == config.InstallModeAgent {
+		// the certificates are installed by the node agents
+		r.certReconciler = &agentCertReconciler{r}
+	} else if config.InstallMode == config.InstallModeBatch {
+		// the certificates of all the registries are installed with a Job per node
+		r.certReconciler = &batchCertReconciler{r}
+	}
 
 	return r
 }
@@ -71,7 +82,13 @@ func newRegistryReconcilier(mgr manager.Manager) reconcile.Reconciler {
 // Add creates a new Registry Controller and adds it to the Manager with default RBAC.
 // The Manager will set fields on the Controller and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return addRegController(mgr, newRegistryReconcilier(mgr))
+	if err := addRegController(mgr, newRegistryReconcilier(mgr)); err != nil {
+		return err
+	}
+	if config.NodeReadinessTaint {
+		return addNodeReadinessController(mgr, newNodeReadinessReconcilier(mgr))
+	}
+	return nil
 }
 
 // addRegController adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -97,7 +114,10 @@ func addRegController(mgr manager.Manager, r reconcile.Reconciler) error {
 			return false // there is nothing we can do when the node is deleted
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
-			return false
+			// ... or the runtime targets of a node change
+			oldNode, okOld := e.ObjectOld.(*corev1.Node)
+			newNode, okNew := e.ObjectNew.(*corev1.Node)
+			return okOld && okNew && !reflect.DeepEqual(getNodeTargets(oldNode), getNodeTargets(newNode))
 		},
 		GenericFunc: func(e event.GenericEvent) bool {
 			return false
@@ -136,6 +156,13 @@ type ReconcileRegistry struct {
 	record.EventRecorder
 	scheme *runtime.Scheme
 	certReconciler CertReconciler
+
+	// podLogs reads the logs of the failed Jobs (nil when not available)
+	podLogs podLogsGetter
+
+	// nodeAnnotator records the Registries installed in the Nodes (the controller
+	// client is used when nil)
+	nodeAnnotator nodeAnnotator
 }
 
 
@@ -153,6 +180,9 @@ type CertReconciler interface {
 // Automatically generate RBAC rules to allow the Controller to read and write Jobs
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update
 // +kubebuilder:rbac:groups=kubic.opensuse.org,resources=registries,verbs=get;list;watch;create;update;patch;delete
 func (r *ReconcileRegistry) Reconcile(request reconcile.Request) (reconcile.Result, error) {
 	glog.V(5).Infof("[kubic] trying to reconcile registry %s", request.Name)
@@ -186,16 +216,25 @@ func (r *ReconcileRegistry) Reconcile(request reconcile.Request) (reconcile.Resu
 		return reconcile.Result{}, err
 	}
 
+	// forget about the Nodes that have been removed from the cluster
+	pruneNodesStatus(registry, curNodes)
+
+	// recover the certificates installed in the Nodes when they are not in the status
+	restoreNodesStatus(registry, curNodes)
+
+	result := reconcile.Result{}
 	if finalizing {
-		if len(registry.Status.Certificate.CurrentHash) > 0 {
+		deleteRegistryMetrics(registry)
+		if isCertInstalled(registry) {
 			err = r.certReconciler.ReconcileCertMissing(registry, curNodes)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
 		}
 	} else {
+		var specSecret *corev1.Secret
 		if registry.Spec.Certificate != nil {
-			specSecret, err := registry.GetCertificateSecret(r)
+			specSecret, err = registry.GetCertificateSecret(r)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
@@ -204,9 +243,14 @@ func (r *ReconcileRegistry) Reconcile(request reconcile.Request) (reconcile.Resu
 			if err != nil {
 				return rr, err
 			}
+
+			// check the certificate expiration (and wake up before the next warning)
+			result = mergeResults(rr, r.reconcileCertExpiry(registry, specSecret))
 		} else {
+			r.clearCertExpiry(registry)
+
 			// trigger a certificate removal when Spec.Certificate=nil and Status.Certificate!=nil
-			if len(registry.Status.Certificate.CurrentHash) > 0 {
+			if isCertInstalled(registry) {
 				glog.V(3).Infof("[kubic] certificate has disappeared for %s: removing certificate", registry)
 				err = r.certReconciler.ReconcileCertMissing(registry, curNodes)
 				if err != nil {
@@ -217,6 +261,25 @@ func (r *ReconcileRegistry) Reconcile(request reconcile.Request) (reconcile.Resu
 			}
 		}
 
+		// probe the registry (and wake up for the next probe)
+		result = mergeResults(result, r.reconcileHealth(registry, specSecret))
+	}
+
+	// remove the finished Jobs that are not kept anymore (and wake up when the next one expires)
+	pruneResult, err := r.pruneRetainedJobs(registry)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	result = mergeResults(result, pruneResult)
+
+	// record the certificates installed in the Nodes in their annotations
+	if err := r.annotateNodes(registry, curNodes); err != nil {
+		if finalizing {
+			// do not remove the finalizer while the Nodes still remember the
+			// Registry, or a new Registry with the same name would inherit it
+			return reconcile.Result{}, err
+		}
+		result.Requeue = true
 	}
 
 	if err := r.Update(ctx, registry); err != nil {
@@ -227,7 +290,7 @@ func (r *ReconcileRegistry) Reconcile(request reconcile.Request) (reconcile.Resu
 		}
 	}
 
-	return reconcile.Result{}, nil
+	return result, nil
 }
 
 // finalizerCheck checks if the object is being finalized and, in that case,
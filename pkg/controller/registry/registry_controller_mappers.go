@@ -76,7 +76,7 @@ func (srm secretToRegistryMapper) Map(obj handler.MapObject) []reconcile.Request
 
 	// Add all the Registries that use this Secret
 	for _, registry := range registries.Items {
-		if registry.Spec.Certificate.Name == secret.GetName() && registry.Spec.Certificate.Namespace == secret.GetNamespace() {
+		if registry.UsesSecret(secret.GetName(), secret.GetNamespace()) {
 			res = append(res, reconcile.Request{
 				NamespacedName: types.NamespacedName{
 					Name:      registry.GetName(),
@@ -23,6 +23,7 @@ import (
 	"github.com/kubic-project/registries-operator/pkg/test/fake"
 	. "github.com/onsi/gomega"
 	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"testing"
 )
@@ -180,3 +181,31 @@ func TestMapSecretDifferentNs(t *testing.T) {
 	g.Expect(requests).To(HaveLen(0))
 
 }
+
+func TestMapSecretCredentials(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	c := fake.NewTestClient()
+
+	fooSec, err := test.BuildSecretFromCert("foo-credentials", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+	c.Create(context.TODO(), fooSec)
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+	//use the secret for the credentials of a registry without certificate
+	fooReg.Spec.Certificate = nil
+	fooReg.Spec.Credentials = &corev1.SecretReference{Name: fooSec.GetName(), Namespace: fooSec.GetNamespace()}
+	c.Create(context.TODO(), fooReg)
+
+	event := handler.MapObject{Meta: &fooSec.ObjectMeta, Object: fooSec}
+
+	rm := secretToRegistryMapper{c}
+	requests := rm.Map(event)
+	g.Expect(requests).To(HaveLen(1))
+}
@@ -19,6 +19,7 @@ package registry
 
 import (
 	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
 	"github.com/kubic-project/registries-operator/pkg/test"
 	"github.com/kubic-project/registries-operator/pkg/test/fake"
 	. "github.com/onsi/gomega"
@@ -41,11 +42,16 @@ func NewFakeCertReconciler() *FakeCertReconciler {
 }
 
 func newTestReconcileRegistry() ReconcileRegistry {
+	//do not probe the (fake) registries used in the tests
+	config.HealthProbePeriod = 0
+
 	return ReconcileRegistry{
 		fake.NewTestClient(),
 		fake.NewTestRecorder(),
 		scheme.Scheme,
 		NewFakeCertReconciler(),
+		nil,
+		nil,
 	}
 }
 
@@ -125,7 +131,7 @@ func TestRegistryFinalizing(t *testing.T) {
 	fooReg.ObjectMeta.SetDeletionTimestamp(&timestamp)
 
 	//simulate the registry had a certificated deployed
-	fooReg.Status.Certificate.CurrentHash = getSecretHash(fooSec)
+	fooReg.Status.Certificate.CurrentHash = getRegistryHash(fooReg, fooSec)
 
 	c := r.Client
 	c.Create(context.TODO(), fooSec)
@@ -165,7 +171,9 @@ func TestRegistryFound(t *testing.T) {
 	req := reconcile.Request{types.NamespacedName{Name: fooReg.Name, Namespace: fooReg.Namespace}}
 	res, _ := r.Reconcile(req)
 
-	g.Expect(res).To(Equal(reconcile.Result{}))
+	//a requeue should be scheduled before the certificate expires
+	g.Expect(res.Requeue).To(Equal(false))
+	g.Expect(res.RequeueAfter).To(BeNumerically(">", 0))
 	//reconcile cert should be called
 	cr, _ := r.certReconciler.(*FakeCertReconciler)
 	g.Expect(cr.ReconcileCertPresentCalled()).Should(Equal(true))
@@ -189,7 +197,7 @@ func TestCertRemoved(t *testing.T) {
 		t.Errorf("Error creating secret %v", err)
 	}
 	//simulate certificate was installed and then removed from Registry
-	fooReg.Status.Certificate.CurrentHash = getSecretHash(fooSec)
+	fooReg.Status.Certificate.CurrentHash = getRegistryHash(fooReg, fooSec)
 	fooReg.Spec.Certificate = nil
 
 	c := r.Client
@@ -36,19 +36,18 @@ import (
 	"time"
 
 	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
 	"github.com/kubic-project/registries-operator/pkg/test"
 	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
 )
 
-var jobKey = types.NamespacedName{
-	Name:      "kubic-registry-installer-foo-com-5000",
-	Namespace: metav1.NamespaceSystem,
-}
+const (
+	// a prefix for the jobs that check the certificates have been installed
+	checkJobNamePrefix = "kubic-registry-checker"
 
-var checkJobKey = types.NamespacedName{
-	Name:      "kubic-registry-checker-foo-com-5000",
-	Namespace: metav1.NamespaceSystem,
-}
+	// a label in jobs that check the certificates: the registry this job is checking
+	checkJobLabelHostPort = "kubic-registry-checker-host-port"
+)
 
 const timeout = time.Second * 60 * 1
 
@@ -82,12 +81,15 @@ func testReconcileSetup(t *testing.T, mgr manager.Manager) {
 
 }
 
-func cleanupJob(t *testing.T, c client.Client, jobName types.NamespacedName) {
+func cleanupJobs(t *testing.T, c client.Client, labels map[string]string) {
 
-	job := &batchv1.Job{}
-	err := c.Get(context.TODO(), jobName, job)
-	if err == nil {
-		err = c.Delete(context.TODO(), job)
+	jobs, err := getAllJobsWithLabels(c, labels)
+	if err != nil {
+		t.Logf("Error listing jobs %v", err)
+		return
+	}
+	for _, job := range jobs {
+		err = c.Delete(context.TODO(), &job)
 		if err != nil && !apierrors.IsNotFound(err) {
 			t.Logf("Error deleting job %v", err)
 		}
@@ -144,35 +146,32 @@ func testReconcileCleanup(t *testing.T, mgr manager.Manager) {
 		t.Logf("Error deleting Registry CRD: %v", err)
 	}
 
-	cleanupJob(t, c, jobKey)
+	registryAddress := kubicutil.SafeID("foo.com:5000")
+
+	cleanupJobs(t, c, map[string]string{jobInstallLabelHostPort: registryAddress})
 
-	cleanupJob(t, c, checkJobKey)
+	cleanupJobs(t, c, map[string]string{checkJobLabelHostPort: registryAddress})
 }
 
-func createCertificateCheckingJob(t *testing.T, c client.Client, regName string) (*batchv1.Job, error) {
+func createCertificateCheckingJobs(t *testing.T, c client.Client, regName string) ([]*batchv1.Job, error) {
 
-	job := &batchv1.Job{}
+	jobs := []*batchv1.Job{}
 
 	registry := &kubicv1beta1.Registry{}
 	err := c.Get(context.TODO(), types.NamespacedName{Name: regName}, registry)
 	if err != nil {
-		return job, err
+		return jobs, err
 	}
 
 	registryAddress := kubicutil.SafeID(registry.Spec.HostPort)
-	secret, err := registry.GetCertificateSecret(c)
-	if err != nil {
-		return job, err
-	}
 
 	nodes, err := getAllNodes(c)
 	if err != nil {
-		return job, err
+		return jobs, err
 	}
-	numNodes := len(nodes)
 
-	dockerDstDir := filepath.Join(dockerCertsDir, registry.Spec.HostPort)
-	podmanDstDir := filepath.Join(podmanCertsDir, registry.Spec.HostPort)
+	dockerDstDir := filepath.Join(node.DockerCertsDir, registry.Spec.HostPort)
+	podmanDstDir := filepath.Join(node.PodmanCertsDir, registry.Spec.HostPort)
 
 	cmdTemplate := "if [[ ! -f '%s/ca.crt' ]]; then echo 'cert not found at %s'; exit 1; fi "
 	commands := []string{
@@ -180,26 +179,29 @@ func createCertificateCheckingJob(t *testing.T, c client.Client, regName string)
 		fmt.Sprintf(cmdTemplate, podmanDstDir, podmanDstDir),
 	}
 
-	job, err = getRunnerJobWithSecrets(&runnerWithSecrets{
-		Commands:     []string{strings.Join(commands, " ; ")},
-		JobName:      checkJobKey.Name,
-		NumNodes:     int32(numNodes),
-		JobNamespace: metav1.NamespaceSystem,
-		Secrets:      map[string]*corev1.Secret{},
-		Labels: map[string]string{
-			jobInstallLabelHostPort: registryAddress,
-			jobInstallLabelHash:     getSecretHash(secret),
-		},
-		HostPaths: []string{
-			"/etc/docker",
-			"/etc/containers",
-		},
-		AntiAffinity: map[string]string{
-			jobInstallLabelHostPort: registryAddress,
-		},
-	})
+	// check the certificate in every node
+	for nodeName := range nodes {
+		job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+			Commands:     []string{"/bin/sh", "-c", strings.Join(commands, " ; ")},
+			JobName:      getNodeJobName(checkJobNamePrefix, registry.Spec.HostPort, nodeName),
+			JobNamespace: metav1.NamespaceSystem,
+			NodeName:     nodeName,
+			Secrets:      map[string]*corev1.Secret{},
+			Labels: map[string]string{
+				checkJobLabelHostPort: registryAddress,
+			},
+			HostPaths: []string{
+				"/etc/docker",
+				"/etc/containers",
+			},
+		})
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
 
-	return job, err
+	return jobs, nil
 }
 
 func waitRegistryCreated(c client.Client, registryName string, timeout time.Duration) error {
@@ -284,24 +286,28 @@ func TestReconcile(t *testing.T) {
 
 	defer testReconcileCleanup(t, mgr)
 
-	job, err := createCertificateCheckingJob(t, c, "foo")
+	jobs, err := createCertificateCheckingJobs(t, c, "foo")
 	if err != nil {
-		t.Fatalf("Error creating certificate checking job: %v", err)
+		t.Fatalf("Error creating certificate checking jobs: %v", err)
 	}
 
-	numNodes := job.Spec.Completions
+	numNodes := int32(len(jobs))
 
-	updates, err := waitRegistryUpdates(c, "foo", *numNodes, timeout)
+	updates, err := waitRegistryUpdates(c, "foo", numNodes, timeout)
 	g.Expect(err).ShouldNot(gomega.HaveOccurred())
-	g.Expect(updates).Should(gomega.Equal(*numNodes))
+	g.Expect(updates).Should(gomega.Equal(numNodes))
 
-	err = c.Create(context.TODO(), job)
-	if err != nil {
-		t.Fatalf("Error starting certificate checking job: %v", err)
+	for _, job := range jobs {
+		err = c.Create(context.TODO(), job)
+		if err != nil {
+			t.Fatalf("Error starting certificate checking job: %v", err)
+		}
 	}
 
-	completed, err := waitJobCompletations(c, job.Name, *numNodes, timeout)
-	g.Expect(err).ShouldNot(gomega.HaveOccurred())
-	g.Expect(completed).Should(gomega.Equal(*numNodes))
+	for _, job := range jobs {
+		completed, err := waitJobCompletations(c, job.Name, 1, timeout)
+		g.Expect(err).ShouldNot(gomega.HaveOccurred())
+		g.Expect(completed).Should(gomega.Equal(int32(1)))
+	}
 
 }
@@ -0,0 +1,325 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+const (
+	// timeout for all the requests performed when probing a registry (the probes
+	// are done in the reconciliation loop, so an unreachable registry must not
+	// delay the reconciliation of the other registries for long)
+	healthProbeTimeout = 2 * time.Second
+)
+
+// registryCredentials are the credentials used for authenticating in a registry
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// getSecretCredentials gets the credentials stored in a "kubernetes.io/basic-auth" Secret
+func getSecretCredentials(secret *corev1.Secret) *registryCredentials {
+	if secret == nil {
+		return nil
+	}
+	username, found := secret.Data[corev1.BasicAuthUsernameKey]
+	if !found {
+		glog.V(5).Infof("[kubic] no username in Secret '%s'", secret.Name)
+		return nil
+	}
+	return &registryCredentials{
+		Username: string(username),
+		Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+	}
+}
+
+// newRegistryHTTPClient returns an HTTP client that trusts the system CAs
+// as well as the CA bundle in `crt` (or that does not verify the registry
+// certificate at all when `insecure`)
+func newRegistryHTTPClient(crt []byte, insecure bool, timeout time.Duration) *http.Client {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if len(crt) > 0 {
+		pool.AppendCertsFromPEM(crt)
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, InsecureSkipVerify: insecure},
+		},
+	}
+}
+
+// parseAuthChallenge parses a "WWW-Authenticate" header, returning the
+// scheme (ie, "Bearer") and the parameters (ie, "realm")
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return "", params
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	scheme := parts[0]
+	if len(parts) == 1 {
+		return scheme, params
+	}
+
+	// parse a list of `key=value` or `key="value"`, separated by commas
+	rest := parts[1]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+// getBearerToken gets a token from the authorization service described in a "Bearer" challenge
+func getBearerToken(ctx context.Context, client *http.Client, params map[string]string, creds *registryCredentials) (string, error) {
+	realm, found := params["realm"]
+	if !found {
+		return "", fmt.Errorf("no realm in the authentication challenge")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	if service, found := params["service"]; found {
+		query.Set("service", service)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(creds.Username, creds.Password)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authorization service returned %d", resp.StatusCode)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if len(token.Token) > 0 {
+		return token.Token, nil
+	}
+	if len(token.AccessToken) > 0 {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token returned by the authorization service")
+}
+
+// probeRegistry probes the "/v2/" endpoint of the registry at `hostPort`, using the
+// CA bundle in `crt` (unless it is `insecure`) and authenticating with `creds` (when provided).
+// All the requests (including the authentication) must be done in `timeout`.
+func probeRegistry(hostPort string, crt []byte, insecure bool, creds *registryCredentials, timeout time.Duration) kubicv1beta1.RegistryHealthStatus {
+	health := kubicv1beta1.RegistryHealthStatus{
+		LastProbeTime: metav1.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// (the connections are not reused between probes)
+	client := newRegistryHTTPClient(crt, insecure, timeout)
+	defer client.CloseIdleConnections()
+	endpoint := fmt.Sprintf("https://%s/v2/", hostPort)
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	health.Latency = metav1.Duration{Duration: time.Since(start)}
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	resp.Body.Close()
+
+	health.StatusCode = resp.StatusCode
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	health.AuthChallenge = scheme
+
+	if resp.StatusCode == http.StatusUnauthorized && creds != nil {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			health.Error = err.Error()
+			return health
+		}
+
+		switch strings.ToLower(scheme) {
+		case "basic":
+			req.SetBasicAuth(creds.Username, creds.Password)
+		case "bearer":
+			token, err := getBearerToken(ctx, client, params, creds)
+			if err != nil {
+				health.Error = fmt.Sprintf("could not get a token: %s", err)
+				return health
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		default:
+			health.Error = fmt.Sprintf("unsupported authentication scheme '%s'", scheme)
+			return health
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			health.Error = err.Error()
+			return health
+		}
+		resp.Body.Close()
+		health.StatusCode = resp.StatusCode
+	}
+
+	switch health.StatusCode {
+	case http.StatusOK:
+		health.Reachable = true
+	case http.StatusUnauthorized:
+		// the registry is there, but we could not authenticate
+		health.Reachable = true
+		if creds != nil {
+			health.Error = "authentication failed"
+		}
+	default:
+		health.Error = fmt.Sprintf("unexpected response from registry: %s", http.StatusText(health.StatusCode))
+	}
+
+	return health
+}
+
+// reconcileHealth probes the registry (when `config.HealthProbePeriod` is set), storing the
+// result in the Registry status and in the metrics. It returns a reconcile.Result for
+// waking up when the next probe must be done.
+func (r *ReconcileRegistry) reconcileHealth(registry *kubicv1beta1.Registry, specSecret *corev1.Secret) reconcile.Result {
+	if config.HealthProbePeriod <= 0 {
+		deleteHealthMetrics(registry)
+		registry.Status.Health = nil
+		return reconcile.Result{}
+	}
+
+	// do not probe the registry more often than needed
+	prev := registry.Status.Health
+	if prev != nil {
+		elapsed := time.Since(prev.LastProbeTime.Time)
+		if elapsed >= 0 && elapsed < config.HealthProbePeriod {
+			return reconcile.Result{RequeueAfter: config.HealthProbePeriod - elapsed}
+		}
+	}
+
+	credsSecret, err := registry.GetCredentialsSecret(r)
+	if err != nil {
+		glog.V(1).Infof("[kubic] ERROR: could not get the credentials for '%s': %s", registry, err)
+	}
+
+	glog.V(5).Infof("[kubic] probing registry '%s'", registry)
+	health := probeRegistry(registry.Spec.HostPort, getSecretCA(specSecret), registry.Spec.Insecure,
+		getSecretCredentials(credsSecret), healthProbeTimeout)
+	glog.V(5).Infof("[kubic] registry '%s': reachable=%t, status=%d, auth=%s, latency=%s",
+		registry, health.Reachable, health.StatusCode, health.AuthChallenge, health.Latency.Duration)
+
+	if prev != nil && prev.AuthChallenge != health.AuthChallenge {
+		registryProbeAuthGauge.Delete(registryAuthMetricsLabels(registry, prev.AuthChallenge))
+	}
+
+	labels := registryMetricsLabels(registry)
+	up := 0.0
+	if health.Reachable {
+		up = 1.0
+	}
+	registryUpGauge.With(labels).Set(up)
+	registryProbeStatusCodeGauge.With(labels).Set(float64(health.StatusCode))
+	registryProbeLatencyGauge.With(labels).Set(health.Latency.Seconds())
+	registryProbeAuthGauge.With(registryAuthMetricsLabels(registry, health.AuthChallenge)).Set(1)
+
+	// emit events only when the reachability changes
+	if health.Reachable && prev != nil && !prev.Reachable {
+		r.EventRecorder.Event(registry, corev1.EventTypeNormal,
+			"Reachable", fmt.Sprintf("Registry '%s' is reachable", registry.Spec.HostPort))
+	} else if !health.Reachable && (prev == nil || prev.Reachable) {
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning,
+			"Unreachable", fmt.Sprintf("Registry '%s' is not reachable: %s", registry.Spec.HostPort, health.Error))
+	}
+
+	registry.Status.Health = &health
+	return reconcile.Result{RequeueAfter: config.HealthProbePeriod}
+}
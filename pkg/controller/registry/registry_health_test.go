@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+// newTestV2Registry starts a TLS server that implements the "/v2/" endpoint,
+// requiring some authentication when `scheme` is not empty
+func newTestV2Registry(scheme string) (*httptest.Server, *corev1.Secret) {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "secret-token"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		switch scheme {
+		case "Basic":
+			if user, pass, ok := r.BasicAuth(); ok && user == "user" && pass == "pass" {
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		case "Bearer":
+			if r.Header.Get("Authorization") == "Bearer secret-token" {
+				return
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+		default:
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	server = httptest.NewTLSServer(mux)
+	return server, newTestCASecret(server)
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:samalba/my-app:pull,push"`)
+	g.Expect(scheme).Should(Equal("Bearer"))
+	g.Expect(params["realm"]).Should(Equal("https://auth.docker.io/token"))
+	g.Expect(params["service"]).Should(Equal("registry.docker.io"))
+	g.Expect(params["scope"]).Should(Equal("repository:samalba/my-app:pull,push"))
+
+	scheme, params = parseAuthChallenge(`Basic realm=test`)
+	g.Expect(scheme).Should(Equal("Basic"))
+	g.Expect(params["realm"]).Should(Equal("test"))
+
+	scheme, _ = parseAuthChallenge("")
+	g.Expect(scheme).Should(BeEmpty())
+}
+
+func TestProbeRegistry(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	creds := &registryCredentials{Username: "user", Password: "pass"}
+
+	for _, scheme := range []string{"", "Basic", "Bearer"} {
+		server, secret := newTestV2Registry(scheme)
+		hostPort := strings.TrimPrefix(server.URL, "https://")
+
+		health := probeRegistry(hostPort, secret.Data["ca.crt"], false, creds, time.Second)
+		g.Expect(health.Error).Should(BeEmpty())
+		g.Expect(health.Reachable).Should(BeTrue())
+		g.Expect(health.StatusCode).Should(Equal(http.StatusOK))
+		g.Expect(health.AuthChallenge).Should(Equal(scheme))
+
+		//without credentials, the registry is there but we cannot authenticate
+		if len(scheme) > 0 {
+			health = probeRegistry(hostPort, secret.Data["ca.crt"], false, nil, time.Second)
+			g.Expect(health.Reachable).Should(BeTrue())
+			g.Expect(health.StatusCode).Should(Equal(http.StatusUnauthorized))
+		}
+
+		//with the wrong credentials, the authentication fails
+		if len(scheme) > 0 {
+			health = probeRegistry(hostPort, secret.Data["ca.crt"], false, &registryCredentials{Username: "user"}, time.Second)
+			g.Expect(health.Error).ShouldNot(BeEmpty())
+		}
+
+		//without the CA.crt the registry cannot be verified...
+		health = probeRegistry(hostPort, nil, false, creds, time.Second)
+		g.Expect(health.Reachable).Should(BeFalse())
+		g.Expect(health.Error).ShouldNot(BeEmpty())
+
+		//... unless it is insecure
+		health = probeRegistry(hostPort, nil, true, creds, time.Second)
+		g.Expect(health.Reachable).Should(BeTrue())
+		g.Expect(health.Error).Should(BeEmpty())
+
+		server.Close()
+	}
+}
+
+func TestProbeRegistryTimeout(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	//a slow registry, where every request takes a while
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(400 * time.Millisecond)
+		fmt.Fprintf(w, `{"token": "secret-token"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(400 * time.Millisecond)
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	server = httptest.NewTLSServer(mux)
+	defer server.Close()
+	secret := newTestCASecret(server)
+	hostPort := strings.TrimPrefix(server.URL, "https://")
+
+	//the timeout is for the whole probe, not for every request
+	start := time.Now()
+	health := probeRegistry(hostPort, secret.Data["ca.crt"], false, &registryCredentials{Username: "user", Password: "pass"}, time.Second)
+	g.Expect(time.Since(start)).Should(BeNumerically("<", 1200*time.Millisecond))
+	g.Expect(health.Reachable).Should(BeFalse())
+	g.Expect(health.Error).ShouldNot(BeEmpty())
+}
+
+func TestReconcileHealth(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+	config.HealthProbePeriod = time.Minute
+	defer func() { config.HealthProbePeriod = 0 }()
+
+	server, secret := newTestV2Registry("")
+	defer server.Close()
+
+	fooReg := newTestTLSRegistryObject(t, server)
+
+	res := r.reconcileHealth(fooReg, secret)
+	g.Expect(res.RequeueAfter).Should(Equal(time.Minute))
+	g.Expect(fooReg.Status.Health).ShouldNot(BeNil())
+	g.Expect(fooReg.Status.Health.Reachable).Should(BeTrue())
+
+	//the registry should not be probed again until the period has passed
+	lastProbe := fooReg.Status.Health.LastProbeTime
+	res = r.reconcileHealth(fooReg, secret)
+	g.Expect(res.RequeueAfter).Should(BeNumerically("<=", time.Minute))
+	g.Expect(fooReg.Status.Health.LastProbeTime).Should(Equal(lastProbe))
+
+	fooReg.Status.Health.LastProbeTime = metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	r.reconcileHealth(fooReg, secret)
+	g.Expect(fooReg.Status.Health.LastProbeTime.After(lastProbe.Time.Add(-time.Second))).Should(BeTrue())
+}
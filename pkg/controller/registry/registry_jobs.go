@@ -0,0 +1,243 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+)
+
+const (
+	// a label in the Jobs kept once processed: the result of the Job
+	jobRetainedLabel = "kubic-registry-job-retained"
+
+	// values for the jobRetainedLabel
+	jobRetainedSucceeded = "succeeded"
+	jobRetainedFailed    = "failed"
+
+	// an annotation in the Jobs kept once processed: the time they were processed
+	jobRetainedAnnotationTime = "kubic.opensuse.org/job-processed-at"
+
+	// a label in the copies of the Secrets mounted in the Jobs
+	jobSecretCopyLabel = "kubic-registry-secret-copy"
+)
+
+// isJobRetentionEnabled returns true when some Jobs must be kept once processed
+func isJobRetentionEnabled() bool {
+	return config.JobSuccessfulHistoryLimit != 0 || config.JobFailedHistoryLimit != 0
+}
+
+// isJobRetained returns true if the Job has already been processed (and it is
+// just kept for inspection)
+func isJobRetained(job *batchv1.Job) bool {
+	_, found := job.Labels[jobRetainedLabel]
+	return found
+}
+
+// finishJob removes a Job once its result has been processed or, when the
+// retention policy is enabled, marks it as processed (so it can be inspected later on)
+func (r *ReconcileRegistry) finishJob(job *batchv1.Job) error {
+	if !isJobRetentionEnabled() {
+		glog.V(3).Infof("[kubic] Job '%s' has completed its mission: removing it!", job.Name)
+		if err := r.Delete(context.TODO(), job); err != nil && !apierrors.IsGone(err) && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	result := jobRetainedSucceeded
+	if job.Status.Failed > 0 {
+		result = jobRetainedFailed
+	}
+
+	glog.V(3).Infof("[kubic] Job '%s' has completed its mission: keeping it as %s", job.Name, result)
+	if job.Labels == nil {
+		job.Labels = map[string]string{}
+	}
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Labels[jobRetainedLabel] = result
+	job.Annotations[jobRetainedAnnotationTime] = time.Now().Format(time.RFC3339)
+	if err := r.Update(context.TODO(), job); err != nil && !apierrors.IsGone(err) && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// getJobProcessedTime returns the time a retained Job was processed
+func getJobProcessedTime(job *batchv1.Job) time.Time {
+	t, err := time.Parse(time.RFC3339, job.Annotations[jobRetainedAnnotationTime])
+	if err != nil {
+		return job.CreationTimestamp.Time
+	}
+	return t
+}
+
+// isOwnedBy returns true if `registry` is the owner of `obj`
+func isOwnedBy(obj metav1.Object, registry *kubicv1beta1.Registry) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == "Registry" && ref.Name == registry.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneRetainedJobs removes the Jobs of `registry` that are not within the history
+// limits anymore (or that have expired), returning when the next one will expire
+func (r *ReconcileRegistry) pruneRetainedJobs(registry *kubicv1beta1.Registry) (reconcile.Result, error) {
+	if !isJobRetentionEnabled() {
+		return reconcile.Result{}, nil
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := r.List(context.TODO(), &client.ListOptions{Namespace: config.JobNamespace}, jobs); err != nil {
+		glog.V(1).Infof("[kubic] error when getting the list of Jobs in the cluster: %s", err)
+		return reconcile.Result{}, err
+	}
+
+	byResult := map[string][]*batchv1.Job{}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if isJobRetained(job) && isOwnedBy(job, registry) {
+			result := job.Labels[jobRetainedLabel]
+			byResult[result] = append(byResult[result], job)
+		}
+	}
+
+	limits := map[string]int{
+		jobRetainedSucceeded: config.JobSuccessfulHistoryLimit,
+		jobRetainedFailed:    config.JobFailedHistoryLimit,
+	}
+	ttl := time.Duration(config.JobTTLSecondsAfterFinished) * time.Second
+
+	res := reconcile.Result{}
+	for result, retained := range byResult {
+		// (the most recent Jobs first)
+		sort.Slice(retained, func(i, j int) bool {
+			return getJobProcessedTime(retained[i]).After(getJobProcessedTime(retained[j]))
+		})
+
+		limit := limits[result]
+		for i, job := range retained {
+			remaining := time.Duration(0)
+			if ttl > 0 {
+				remaining = getJobProcessedTime(job).Add(ttl).Sub(time.Now())
+			}
+			if (limit >= 0 && i >= limit) || remaining < 0 {
+				glog.V(3).Infof("[kubic] Job '%s' is not kept anymore: removing it!", job.Name)
+				if err := r.Delete(context.TODO(), job); err != nil && !apierrors.IsGone(err) && !apierrors.IsNotFound(err) {
+					return reconcile.Result{}, err
+				}
+				continue
+			}
+			if remaining > 0 {
+				res = mergeResults(res, reconcile.Result{RequeueAfter: remaining})
+			}
+		}
+	}
+	return res, nil
+}
+
+// getJobSecrets returns the Secrets that must be mounted in a Job launched by
+// `owner`, copying the Secrets that are not in the namespace of the Jobs
+func (r *ReconcileRegistry) getJobSecrets(owner *kubicv1beta1.Registry, secrets map[string]*corev1.Secret) (map[string]*corev1.Secret, error) {
+	res := map[string]*corev1.Secret{}
+	for dir, secret := range secrets {
+		if secret.Namespace == config.JobNamespace {
+			res[dir] = secret
+			continue
+		}
+
+		secretCopy, err := r.copyJobSecret(owner, secret)
+		if err != nil {
+			return nil, err
+		}
+		res[dir] = secretCopy
+	}
+	return res, nil
+}
+
+// copyJobSecret creates (or updates) a copy of `secret` in the namespace of the Jobs.
+// The copy is owned by all the Registries that use it, so it is garbage
+// collected once they are all gone.
+func (r *ReconcileRegistry) copyJobSecret(owner *kubicv1beta1.Registry, secret *corev1.Secret) (*corev1.Secret, error) {
+	name := fmt.Sprintf("%s-%s-%s", config.DefaultPrefix, secret.Namespace, secret.Name)
+	ownerRef := metav1.OwnerReference{
+		APIVersion: kubicv1beta1.SchemeGroupVersion.String(),
+		Kind:       "Registry",
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+
+	secretCopy := &corev1.Secret{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: config.JobNamespace}, secretCopy)
+	if apierrors.IsNotFound(err) {
+		glog.V(3).Infof("[kubic] copying Secret '%s/%s' to '%s/%s'", secret.Namespace, secret.Name, config.JobNamespace, name)
+		secretCopy = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       config.JobNamespace,
+				Labels:          map[string]string{jobSecretCopyLabel: "true"},
+				OwnerReferences: []metav1.OwnerReference{ownerRef},
+			},
+			Type: secret.Type,
+			Data: secret.Data,
+		}
+		if err := r.Create(context.TODO(), secretCopy); err != nil {
+			glog.V(1).Infof("[kubic] ERROR: when copying Secret '%s/%s': %s", secret.Namespace, secret.Name, err)
+			return nil, err
+		}
+		return secretCopy, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	updated := false
+	if !reflect.DeepEqual(secretCopy.Data, secret.Data) {
+		secretCopy.Data = secret.Data
+		updated = true
+	}
+	if !isOwnedBy(secretCopy, owner) {
+		secretCopy.OwnerReferences = append(secretCopy.OwnerReferences, ownerRef)
+		updated = true
+	}
+	if updated {
+		glog.V(3).Infof("[kubic] updating the copy of Secret '%s/%s'", secret.Namespace, secret.Name)
+		if err := r.Update(context.TODO(), secretCopy); err != nil {
+			return nil, err
+		}
+	}
+	return secretCopy, nil
+}
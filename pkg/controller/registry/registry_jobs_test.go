@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+// newTestJobPod returns the Pod created by `job` in `nodeName`, with a `container`
+// terminated with `exitCode` and a result `res` (encoded as the termination message)
+func newTestJobPod(job *batchv1.Job, container, nodeName string, res interface{}, exitCode int32) *corev1.Pod {
+	msg := []byte{}
+	if res != nil {
+		msg, _ = json.Marshal(res)
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-" + nodeName,
+			Namespace: job.Namespace,
+			Labels:    map[string]string{"job-name": job.Name},
+		},
+		Spec: corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name: container,
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   exitCode,
+							Message:    string(msg),
+							FinishedAt: metav1.Now(),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	defer func(successful, failed, ttl int) {
+		config.JobSuccessfulHistoryLimit, config.JobFailedHistoryLimit, config.JobTTLSecondsAfterFinished = successful, failed, ttl
+	}(config.JobSuccessfulHistoryLimit, config.JobFailedHistoryLimit, config.JobTTLSecondsAfterFinished)
+	config.JobSuccessfulHistoryLimit = 1
+	config.JobFailedHistoryLimit = 1
+	config.JobTTLSecondsAfterFinished = 3600
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	nodes := testNodes("node0", "node1")
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//simulate the Job succeeded in node0 and failed in node1
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		if job.Labels[jobInstallLabelNode] == "node0" {
+			job.Status.Succeeded = 1
+		} else {
+			job.Status.Failed = 1
+		}
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	//the processed Jobs are kept...
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).ShouldNot(BeEmpty())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		g.Expect(isJobRetained(&job)).Should(BeTrue())
+	}
+
+	//... but they are not processed again
+	active, err := getAllJobsWithLabels(&r, map[string]string{})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(active).Should(BeEmpty())
+
+	//an older successful Job is beyond the history limit
+	older := jobs.Items[0].DeepCopy()
+	older.Name = older.Name + "-older"
+	older.ResourceVersion = ""
+	older.Labels[jobRetainedLabel] = jobRetainedSucceeded
+	older.Annotations[jobRetainedAnnotationTime] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	g.Expect(r.Create(context.TODO(), older)).ShouldNot(HaveOccurred())
+
+	result, err := r.pruneRetainedJobs(fooReg)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).Should(BeNumerically("~", time.Hour, time.Minute))
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(2))
+	for _, job := range jobs.Items {
+		g.Expect(job.Name).ShouldNot(Equal(older.Name))
+	}
+
+	//and all of them are removed once they expire
+	config.JobTTLSecondsAfterFinished = 1
+	for _, job := range jobs.Items {
+		job.Annotations[jobRetainedAnnotationTime] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+		g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	}
+
+	_, err = r.pruneRetainedJobs(fooReg)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs = &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(BeEmpty())
+}
+
+func TestJobNamespace(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	defer func(namespace string) { config.JobNamespace = namespace }(config.JobNamespace)
+	config.JobNamespace = "registries-jobs"
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	_, err = r.ReconcileCertPresent(fooReg, testNodes("node0"), fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+	g.Expect(jobs.Items[0].Namespace).Should(Equal("registries-jobs"))
+
+	//the Secret is copied to the namespace of the Jobs
+	var secretName string
+	for _, volume := range jobs.Items[0].Spec.Template.Spec.Volumes {
+		if volume.Secret != nil {
+			secretName = volume.Secret.SecretName
+		}
+	}
+	g.Expect(secretName).ShouldNot(Equal(fooSec.Name))
+
+	secretCopy := &corev1.Secret{}
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: "registries-jobs"}, secretCopy)).ShouldNot(HaveOccurred())
+	g.Expect(secretCopy.Data).Should(Equal(fooSec.Data))
+	g.Expect(isOwnedBy(secretCopy, fooReg)).Should(BeTrue())
+
+	//and it is updated when the original changes
+	fooSec.Data["extra"] = []byte("something")
+	_, err = r.getJobSecrets(fooReg, map[string]*corev1.Secret{"this-registry": fooSec})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: "registries-jobs"}, secretCopy)).ShouldNot(HaveOccurred())
+	g.Expect(secretCopy.Data).Should(HaveKey("extra"))
+
+	//the Secrets in the namespace of the Jobs are not copied
+	fooSec.Namespace = "registries-jobs"
+	secrets, err := r.getJobSecrets(fooReg, map[string]*corev1.Secret{"this-registry": fooSec})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(secrets["this-registry"]).Should(Equal(fooSec))
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+)
+
+const (
+	// an annotation in the Nodes with the Registries installed in them
+	// (a JSON object with the hash installed for every Registry)
+	nodeRegistriesAnnotation = "registries.kubic.opensuse.org/installed"
+)
+
+// getNodeRegistriesAnnotation returns the hashes of the Registries installed
+// in `curNode` (by Registry name), as recorded in its annotations
+func getNodeRegistriesAnnotation(curNode *corev1.Node) map[string]string {
+	res := map[string]string{}
+	value, found := curNode.Annotations[nodeRegistriesAnnotation]
+	if !found {
+		return res
+	}
+	if err := json.Unmarshal([]byte(value), &res); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: invalid '%s' annotation in node '%s': %s", nodeRegistriesAnnotation, curNode.Name, err)
+		return map[string]string{}
+	}
+	return res
+}
+
+// nodeAnnotator records the Registries installed in the Nodes
+type nodeAnnotator interface {
+	// SetNodeRegistry records `hash` for `registryName` in the annotations
+	// of the Node (removing the Registry when the hash is empty)
+	SetNodeRegistry(nodeName string, registryName string, hash string) error
+}
+
+// clientsetNodeAnnotator is a nodeAnnotator that patches the Nodes in the API server,
+// so we do not conflict with the kubelet (or anybody else) updating the Nodes
+type clientsetNodeAnnotator struct {
+	kubernetes.Interface
+}
+
+func (c clientsetNodeAnnotator) SetNodeRegistry(nodeName string, registryName string, hash string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		curNode, err := c.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		value, changed, err := getNodeRegistriesAnnotationValue(curNode, registryName, hash)
+		if err != nil || !changed {
+			return err
+		}
+
+		// (the resourceVersion makes the patch fail when the annotation has
+		// been changed in the meantime, and then we try again)
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": curNode.ResourceVersion,
+				"annotations":     map[string]interface{}{nodeRegistriesAnnotation: value},
+			},
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		_, err = c.CoreV1().Nodes().Patch(nodeName, types.MergePatchType, data)
+		return err
+	})
+}
+
+// clientNodeAnnotator is a nodeAnnotator that updates the Nodes with the
+// controller client (when the clientset is not available)
+type clientNodeAnnotator struct {
+	client.Client
+}
+
+func (c clientNodeAnnotator) SetNodeRegistry(nodeName string, registryName string, hash string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		curNode := &corev1.Node{}
+		if err := c.Get(context.TODO(), types.NamespacedName{Name: nodeName}, curNode); err != nil {
+			return err
+		}
+		value, changed, err := getNodeRegistriesAnnotationValue(curNode, registryName, hash)
+		if err != nil || !changed {
+			return err
+		}
+
+		if value == nil {
+			delete(curNode.Annotations, nodeRegistriesAnnotation)
+		} else {
+			if curNode.Annotations == nil {
+				curNode.Annotations = map[string]string{}
+			}
+			curNode.Annotations[nodeRegistriesAnnotation] = *value
+		}
+		return c.Update(context.TODO(), curNode)
+	})
+}
+
+// getNodeRegistriesAnnotationValue returns the new value for the annotation in `curNode`
+// after recording `hash` for `registryName` (nil when the annotation must be removed),
+// and true when it is different from the current value
+func getNodeRegistriesAnnotationValue(curNode *corev1.Node, registryName string, hash string) (*string, bool, error) {
+	installed := getNodeRegistriesAnnotation(curNode)
+	if installed[registryName] == hash {
+		return nil, false, nil
+	}
+
+	if len(hash) > 0 {
+		installed[registryName] = hash
+	} else {
+		delete(installed, registryName)
+	}
+	if len(installed) == 0 {
+		return nil, true, nil
+	}
+
+	value, err := json.Marshal(installed)
+	if err != nil {
+		return nil, false, err
+	}
+	res := string(value)
+	return &res, true, nil
+}
+
+// annotateNodes records the certificate of `registry` installed in every
+// Node (as reported in the Registry status) in the annotations of the Nodes
+func (r *ReconcileRegistry) annotateNodes(registry *kubicv1beta1.Registry, curNodes map[string]*corev1.Node) error {
+	annotator := r.nodeAnnotator
+	if annotator == nil {
+		annotator = clientNodeAnnotator{r.Client}
+	}
+
+	nodeNames := []string{}
+	for nodeName := range curNodes {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+
+	for _, nodeName := range nodeNames {
+		hash := getNodeHash(registry, nodeName)
+		if getNodeRegistriesAnnotation(curNodes[nodeName])[registry.Name] == hash {
+			continue
+		}
+
+		glog.V(5).Infof("[kubic] recording '%s' installed in node '%s' for '%s'", hash, nodeName, registry)
+		if err := annotator.SetNodeRegistry(nodeName, registry.Name, hash); err != nil && !apierrors.IsNotFound(err) {
+			glog.V(1).Infof("[kubic] ERROR: when annotating node '%s': %s", nodeName, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreNodesStatus restores the certificate installed in the Nodes from their
+// annotations, when it is not in the status of `registry` (ie, when the Registry
+// has been re-created)
+func restoreNodesStatus(registry *kubicv1beta1.Registry, curNodes map[string]*corev1.Node) bool {
+	restored := false
+	for nodeName, curNode := range curNodes {
+		hash := getNodeRegistriesAnnotation(curNode)[registry.Name]
+		if len(hash) == 0 || len(getNodeHash(registry, nodeName)) > 0 {
+			continue
+		}
+
+		// (the first verification of the nodes is delayed, so we do not launch
+		// a burst of Jobs in all the nodes)
+		glog.V(3).Infof("[kubic] restoring '%s' installed in node '%s' for '%s'", hash, nodeName, registry)
+		nodeStatus := registry.Status.GetNodeStatus(nodeName)
+		nodeStatus.CurrentHash = hash
+		nodeStatus.LastVerifyTime = metav1.Now()
+		restored = true
+	}
+	return restored
+}
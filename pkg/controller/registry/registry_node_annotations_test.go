@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+func TestNodeAnnotations(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	nodes := testNodes("node0", "node1")
+	for _, curNode := range nodes {
+		g.Expect(r.Create(context.TODO(), curNode)).ShouldNot(HaveOccurred())
+	}
+	getNode := func(name string) *corev1.Node {
+		updated := &corev1.Node{}
+		g.Expect(r.Get(context.TODO(), types.NamespacedName{Name: name}, updated)).ShouldNot(HaveOccurred())
+		return updated
+	}
+
+	//the nodes where the certificate is installed are annotated
+	hash := getRegistryHash(fooReg, fooSec)
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = hash
+	g.Expect(r.annotateNodes(fooReg, nodes)).ShouldNot(HaveOccurred())
+
+	node0 := getNode("node0")
+	g.Expect(getNodeRegistriesAnnotation(node0)).Should(Equal(map[string]string{"foo": hash}))
+	g.Expect(getNode("node1").Annotations).ShouldNot(HaveKey(nodeRegistriesAnnotation))
+
+	//the status is restored from the annotations when the Registry is re-created
+	nodes["node0"] = node0
+	fooReg, err = kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+	g.Expect(restoreNodesStatus(fooReg, nodes)).Should(BeTrue())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").CurrentHash).Should(Equal(hash))
+	g.Expect(getNodeHash(fooReg, "node1")).Should(BeEmpty())
+	g.Expect(restoreNodesStatus(fooReg, nodes)).Should(BeFalse())
+
+	//the annotation is removed once the certificate is removed from the node
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = ""
+	g.Expect(r.annotateNodes(fooReg, nodes)).ShouldNot(HaveOccurred())
+	g.Expect(getNode("node0").Annotations).ShouldNot(HaveKey(nodeRegistriesAnnotation))
+}
+
+// failingNodeAnnotator is a nodeAnnotator that cannot annotate the Nodes
+type failingNodeAnnotator struct{}
+
+func (failingNodeAnnotator) SetNodeRegistry(nodeName string, registryName string, hash string) error {
+	return fmt.Errorf("cannot annotate node %s", nodeName)
+}
+
+func TestNodeAnnotationsFailedWhenFinalizing(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+	r.nodeAnnotator = failingNodeAnnotator{}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	//the annotation in the node is out of date
+	node0 := testNodes("node0")["node0"]
+	node0.Annotations = map[string]string{nodeRegistriesAnnotation: `{"foo":"aGFzaA"}`}
+	g.Expect(r.Create(context.TODO(), node0)).ShouldNot(HaveOccurred())
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = "bmV3LWhhc2g"
+
+	timestamp := metav1.Now()
+	fooReg.ObjectMeta.SetDeletionTimestamp(&timestamp)
+	fooReg.ObjectMeta.Finalizers = []string{regsFinalizerName}
+	g.Expect(r.Create(context.TODO(), fooReg)).ShouldNot(HaveOccurred())
+
+	//the registry must not be released until the annotation is removed
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: fooReg.Name}}
+	_, err = r.Reconcile(req)
+	g.Expect(err).Should(HaveOccurred())
+}
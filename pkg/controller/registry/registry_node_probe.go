@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+)
+
+// collectNodeProbes reads the results of the probes run by a Job in the Nodes
+// (from the termination messages of the pods), storing them in the Registry status
+func (r *ReconcileRegistry) collectNodeProbes(registry *kubicv1beta1.Registry, job *batchv1.Job) error {
+	pods, err := getJobPods(r, job)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name != jobPostContainerName || cs.State.Terminated == nil {
+				continue
+			}
+
+			res := node.ProbeResult{}
+			if err := node.ReadTerminationMessage(cs.State.Terminated.Message, &res); err != nil {
+				glog.V(1).Infof("[kubic] ERROR: could not parse probe result in Pod '%s': %s", pod.Name, err)
+				continue
+			}
+			if len(res.Node) == 0 {
+				res.Node = pod.Spec.NodeName
+			}
+			glog.V(5).Infof("[kubic] probe for '%s' in node '%s': reachable=%t", registry, res.Node, res.Reachable)
+
+			nodeStatus := registry.Status.GetNodeStatus(res.Node)
+			reachable := res.Reachable
+			nodeStatus.Reachable = &reachable
+			nodeStatus.LastProbeTime = cs.State.Terminated.FinishedAt
+			nodeStatus.LastError = res.Error
+
+			if !reachable {
+				r.EventRecorder.Event(registry, corev1.EventTypeWarning, "NodeUnreachable",
+					fmt.Sprintf("Registry '%s' is not reachable from node '%s': %s", registry.Spec.HostPort, res.Node, res.Error))
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneNodesStatus removes the status for Nodes that are not in the cluster anymore
+func pruneNodesStatus(registry *kubicv1beta1.Registry, curNodes map[string]*corev1.Node) {
+	var nodes []kubicv1beta1.RegistryNodeStatus
+	for _, nodeStatus := range registry.Status.Nodes {
+		if _, found := curNodes[nodeStatus.Name]; found {
+			nodes = append(nodes, nodeStatus)
+		}
+	}
+	registry.Status.Nodes = nodes
+}
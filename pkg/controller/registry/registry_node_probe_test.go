@@ -0,0 +1,61 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+)
+
+func TestCollectNodeProbes(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "test-job", Namespace: metav1.NamespaceSystem}}
+	r.Create(context.TODO(), newTestJobPod(job, jobPostContainerName, "node0", node.ProbeResult{Reachable: true}, 0))
+	r.Create(context.TODO(), newTestJobPod(job, jobPostContainerName, "node1", node.ProbeResult{Node: "node1", Error: "no route to host"}, 0))
+
+	g.Expect(r.collectNodeProbes(fooReg, job)).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.Nodes).Should(HaveLen(2))
+
+	node0 := fooReg.Status.GetNodeStatus("node0")
+	g.Expect(*node0.Reachable).Should(BeTrue())
+
+	node1 := fooReg.Status.GetNodeStatus("node1")
+	g.Expect(*node1.Reachable).Should(BeFalse())
+	g.Expect(node1.LastError).Should(Equal("no route to host"))
+
+	//nodes removed from the cluster are forgotten
+	pruneNodesStatus(fooReg, testNodes("node1"))
+	g.Expect(fooReg.Status.Nodes).Should(HaveLen(1))
+	g.Expect(fooReg.Status.Nodes[0].Name).Should(Equal("node1"))
+}
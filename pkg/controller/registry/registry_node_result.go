@@ -0,0 +1,198 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+)
+
+const (
+	// number of lines read from the logs of a failed pod
+	failedPodLogLines = 20
+
+	// maximum length of the excerpt of the logs (or the termination message) of a failed pod
+	failedPodExcerptMaxLen = 1024
+)
+
+// podLogsGetter gets the logs of the containers in the Pods
+type podLogsGetter interface {
+	// GetLogs returns the last `lines` lines of the logs of a container in a Pod
+	GetLogs(namespace string, pod string, container string, lines int64) (string, error)
+}
+
+// clientsetPodLogs is a podLogsGetter that reads the logs from the API server
+type clientsetPodLogs struct {
+	kubernetes.Interface
+}
+
+func (c clientsetPodLogs) GetLogs(namespace string, pod string, container string, lines int64) (string, error) {
+	opts := &corev1.PodLogOptions{Container: container, TailLines: &lines}
+	raw, err := c.CoreV1().Pods(namespace).GetLogs(pod, opts).Do().Raw()
+	return string(raw), err
+}
+
+// getInstallResult reads the result of a `node install|remove` Job (from the
+// termination message of the container with the Job name in its latest pod),
+// returning nil when no result has been reported
+func (r *ReconcileRegistry) getInstallResult(job *batchv1.Job) (*node.InstallResult, error) {
+	pods, err := getJobPods(r, job)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *node.InstallResult
+	var finishedAt metav1.Time
+	for _, pod := range pods {
+		// (the command runs in an init container when there are post commands)
+		statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.Name != job.Name || cs.State.Terminated == nil || len(cs.State.Terminated.Message) == 0 {
+				continue
+			}
+			if res != nil && cs.State.Terminated.FinishedAt.Before(&finishedAt) {
+				continue
+			}
+
+			// (the message can be the tail of the logs when the command could not write a result)
+			cur := node.InstallResult{}
+			if err := node.ReadTerminationMessage(cs.State.Terminated.Message, &cur); err != nil {
+				glog.V(5).Infof("[kubic] no result in Pod '%s': %s", pod.Name, err)
+				continue
+			}
+			res, finishedAt = &cur, cs.State.Terminated.FinishedAt
+		}
+	}
+	return res, nil
+}
+
+// getFailedPodExcerpt returns an excerpt of the termination message (or, when
+// there is no message, of the tail of the logs) of the last container that
+// failed in the pods of `job`, or an empty string when it is not available.
+// It must be called before the Job is deleted, as its pods are deleted too.
+func (r *ReconcileRegistry) getFailedPodExcerpt(job *batchv1.Job) string {
+	pods, err := getJobPods(r, job)
+	if err != nil {
+		return ""
+	}
+
+	var failedPod *corev1.Pod
+	var failed *corev1.ContainerStatus
+	for i := range pods {
+		statuses := append(pods[i].Status.InitContainerStatuses, pods[i].Status.ContainerStatuses...)
+		for j := range statuses {
+			t := statuses[j].State.Terminated
+			if t == nil || t.ExitCode == 0 {
+				continue
+			}
+			if failed != nil && t.FinishedAt.Before(&failed.State.Terminated.FinishedAt) {
+				continue
+			}
+			failedPod, failed = &pods[i], &statuses[j]
+		}
+	}
+	if failed == nil {
+		return ""
+	}
+
+	excerpt := failed.State.Terminated.Message
+	if len(strings.TrimSpace(excerpt)) == 0 && r.podLogs != nil {
+		logs, err := r.podLogs.GetLogs(failedPod.Namespace, failedPod.Name, failed.Name, failedPodLogLines)
+		if err != nil {
+			glog.V(1).Infof("[kubic] ERROR: could not get the logs of Pod '%s': %s", failedPod.Name, err)
+		}
+		excerpt = logs
+	}
+	if len(strings.TrimSpace(excerpt)) == 0 {
+		excerpt = failed.State.Terminated.Reason
+	}
+
+	// keep the end, where the error usually is
+	excerpt = strings.TrimSpace(excerpt)
+	if len(excerpt) > failedPodExcerptMaxLen {
+		excerpt = "..." + excerpt[len(excerpt)-failedPodExcerptMaxLen:]
+	}
+	return excerpt
+}
+
+// reportNodeFailure stores the failure of the `action` ("installation" or "removal")
+// of the certificate with `hash` by a `job` in the status of a Node, emitting a
+// Warning event with the details in the result reported by the Node or, when
+// not available, with an excerpt of the logs of the failed pod
+func (r *ReconcileRegistry) reportNodeFailure(registry *kubicv1beta1.Registry,
+	nodeStatus *kubicv1beta1.RegistryNodeStatus,
+	action string, hash string, job *batchv1.Job) error {
+
+	reason := "NodeInstallFailed"
+	if action == "removal" {
+		reason = "NodeRemoveFailed"
+	}
+
+	res, err := r.getInstallResult(job)
+	if err != nil {
+		return err
+	}
+
+	if res == nil || len(res.Error) == 0 {
+		nodeStatus.LastError = fmt.Sprintf("%s of certificate '%s' failed", action, hash)
+		details := "no details reported"
+		if excerpt := r.getFailedPodExcerpt(job); len(excerpt) > 0 {
+			nodeStatus.LastError += ": " + excerpt
+			details = excerpt
+		}
+		r.EventRecorder.Event(registry, corev1.EventTypeWarning, reason,
+			fmt.Sprintf("Certificate %s of '%s' failed in node '%s' (%s)... retrying",
+				action, hash, nodeStatus.Name, details))
+		return nil
+	}
+
+	nodeStatus.LastError = res.Error
+	nodeStatus.Runtimes = res.Runtimes
+	r.EventRecorder.Event(registry, corev1.EventTypeWarning, reason,
+		fmt.Sprintf("Certificate %s of '%s' failed in node '%s': %s (%s)... retrying",
+			action, hash, nodeStatus.Name, res.Error, describeInstallResult(res)))
+	return nil
+}
+
+// describeInstallResult returns a description of the state of the Node in a result
+func describeInstallResult(res *node.InstallResult) string {
+	runtimes := "none"
+	if len(res.Runtimes) > 0 {
+		runtimes = strings.Join(res.Runtimes, ", ")
+	}
+	details := []string{"runtimes detected: " + runtimes}
+	if len(res.Targets) > 0 {
+		details = append(details, "targets: "+strings.Join(res.Targets, ", "))
+	}
+	if len(res.Files) > 0 {
+		details = append(details, "files written: "+strings.Join(res.Files, ", "))
+	}
+	if len(res.Hash) > 0 {
+		details = append(details, fmt.Sprintf("installed: '%s'", res.Hash))
+	}
+	return strings.Join(details, "; ")
+}
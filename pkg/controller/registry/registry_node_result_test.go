@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	"github.com/kubic-project/registries-operator/pkg/test"
+)
+
+// fakePodLogs are the logs of some (failed) pods, by pod name
+type fakePodLogs map[string]string
+
+func (f fakePodLogs) GetLogs(namespace string, pod string, container string, lines int64) (string, error) {
+	return f[pod], nil
+}
+
+func TestInstallFailureResult(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	nodes := testNodes("node0")
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+
+	//simulate the Job failed, reporting what happened in the node
+	job := jobs.Items[0]
+	job.Status.Failed = 1
+	g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+	res := node.InstallResult{
+		Node:     "node0",
+		HostPort: fooReg.Spec.HostPort,
+		Runtimes: []string{"containerd"},
+		Files:    []string{"/etc/containerd/certs.d/foo.com:5000"},
+		Error:    "could not restart containerd: exit status 1",
+	}
+	g.Expect(r.Create(context.TODO(), newTestJobPod(&job, job.Name, res.Node, res, 1))).ShouldNot(HaveOccurred())
+
+	got, err := r.getInstallResult(&job)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(got).ShouldNot(BeNil())
+	g.Expect(*got).Should(Equal(res))
+
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	nodeStatus := fooReg.Status.GetNodeStatus("node0")
+	g.Expect(nodeStatus.CurrentHash).Should(BeEmpty())
+	g.Expect(nodeStatus.LastError).Should(Equal(res.Error))
+	g.Expect(nodeStatus.Runtimes).Should(Equal(res.Runtimes))
+
+	g.Expect(describeInstallResult(&res)).Should(Equal(
+		"runtimes detected: containerd; files written: /etc/containerd/certs.d/foo.com:5000"))
+}
+
+func TestInstallFailureLogs(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := newTestReconcileRegistry()
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	nodes := testNodes("node0")
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	jobs := &batchv1.JobList{}
+	g.Expect(r.List(context.TODO(), &client.ListOptions{}, jobs)).ShouldNot(HaveOccurred())
+	g.Expect(jobs.Items).Should(HaveLen(1))
+
+	//simulate the Job failed without writing a result (ie, the image could not run the command)
+	job := jobs.Items[0]
+	job.Status.Failed = 1
+	g.Expect(r.Update(context.TODO(), &job)).ShouldNot(HaveOccurred())
+
+	pod := newTestJobPod(&job, job.Name, "node0", nil, 1)
+	g.Expect(r.Create(context.TODO(), pod)).ShouldNot(HaveOccurred())
+	r.podLogs = fakePodLogs{pod.Name: "mkdir /host/etc/docker/certs.d: read-only file system\n"}
+
+	g.Expect(r.getFailedPodExcerpt(&job)).Should(Equal("mkdir /host/etc/docker/certs.d: read-only file system"))
+
+	//the excerpt of the logs is kept in the status once the Job is deleted
+	_, err = r.ReconcileCertPresent(fooReg, nodes, fooSec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(fooReg.Status.GetNodeStatus("node0").LastError).Should(HaveSuffix(": mkdir /host/etc/docker/certs.d: read-only file system"))
+
+	//the termination message is preferred (and truncated to its end)
+	pod.Status.ContainerStatuses[0].State.Terminated.Message = strings.Repeat("x", 2*failedPodExcerptMaxLen) + "end"
+	g.Expect(r.Update(context.TODO(), pod)).ShouldNot(HaveOccurred())
+	excerpt := r.getFailedPodExcerpt(&job)
+	g.Expect(excerpt).Should(HaveLen(failedPodExcerptMaxLen + 3))
+	g.Expect(excerpt).Should(HaveSuffix("xend"))
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+)
+
+const (
+	// the node readiness controller name
+	nodeReadinessControllerName = "KubicRegistriesNodeReadiness"
+
+	// nodeNotReadyTaintKey is the taint the Nodes are registered with when they must not
+	// run any workload until the certificates of all the Registries are installed in them
+	nodeNotReadyTaintKey = "registries.kubic.opensuse.org/not-ready"
+)
+
+// newNodeReadinessReconcilier returns a new reconcile.Reconciler
+func newNodeReadinessReconcilier(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcileNodeReadiness{
+		Client:        mgr.GetClient(),
+		EventRecorder: mgr.GetRecorder(nodeReadinessControllerName),
+	}
+}
+
+// addNodeReadinessController adds a new Controller to mgr with r as the reconcile.Reconciler
+func addNodeReadinessController(mgr manager.Manager, r reconcile.Reconciler) error {
+	nodeController, err := controller.New(nodeReadinessControllerName, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch the Nodes, in particular Nodes creations
+	if err = nodeController.Watch(&source.Kind{Type: &corev1.Node{}}, &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+
+	// Watch the Registries, as their status shows the certificates installed in the Nodes
+	if err = nodeController.Watch(&source.Kind{Type: &kubicv1beta1.Registry{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: taintedNodesMapper{mgr.GetClient()},
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// A mapper that returns all the Nodes with the "not-ready" taint
+type taintedNodesMapper struct {
+	client.Client
+}
+
+func (tnm taintedNodesMapper) Map(obj handler.MapObject) []reconcile.Request {
+	res := []reconcile.Request{}
+
+	nodes := &corev1.NodeList{}
+	if err := tnm.List(context.TODO(), &client.ListOptions{}, nodes); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when getting the list of Nodes in the cluster: %s", err)
+		return res
+	}
+
+	for _, curNode := range nodes.Items {
+		if hasNotReadyTaint(&curNode) {
+			res = append(res, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: curNode.GetName()},
+			})
+		}
+	}
+	return res
+}
+
+// hasNotReadyTaint returns true if `curNode` has the "not-ready" taint
+func hasNotReadyTaint(curNode *corev1.Node) bool {
+	for _, taint := range curNode.Spec.Taints {
+		if taint.Key == nodeNotReadyTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+var _ reconcile.Reconciler = &ReconcileNodeReadiness{}
+
+// ReconcileNodeReadiness removes the "not-ready" taint from the Nodes where
+// the certificates of all the Registries have been installed
+type ReconcileNodeReadiness struct {
+	client.Client
+	record.EventRecorder
+}
+
+// Reconcile removes the "not-ready" taint from a Node once all the Registries are installed in it
+//
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;update
+func (r *ReconcileNodeReadiness) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	glog.V(5).Infof("[kubic] checking the readiness of node %s", request.Name)
+
+	curNode := &corev1.Node{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: request.Name}, curNode); err != nil {
+		if apierrors.IsNotFound(err) {
+			glog.V(3).Infof("[kubic] node %s not found (%s)... ignoring", request.Name, err)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !hasNotReadyTaint(curNode) {
+		return reconcile.Result{}, nil
+	}
+
+	ready, err := r.isNodeReady(curNode)
+	if err != nil || !ready {
+		return reconcile.Result{}, err
+	}
+
+	glog.V(3).Infof("[kubic] all the certificates are installed in node '%s': removing the '%s' taint", curNode.Name, nodeNotReadyTaintKey)
+	taints := []corev1.Taint{}
+	for _, taint := range curNode.Spec.Taints {
+		if taint.Key != nodeNotReadyTaintKey {
+			taints = append(taints, taint)
+		}
+	}
+	curNode.Spec.Taints = taints
+	if err := r.Update(context.TODO(), curNode); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when removing the '%s' taint from node '%s': %s", nodeNotReadyTaintKey, curNode.Name, err)
+		return reconcile.Result{}, err
+	}
+
+	r.EventRecorder.Event(curNode, corev1.EventTypeNormal,
+		"RegistriesReady", fmt.Sprintf("All the registries certificates are installed: '%s' taint removed", nodeNotReadyTaintKey))
+	return reconcile.Result{}, nil
+}
+
+// isNodeReady returns true if the certificates of all the Registries are installed in `curNode`
+func (r *ReconcileNodeReadiness) isNodeReady(curNode *corev1.Node) (bool, error) {
+	registries := &kubicv1beta1.RegistryList{}
+	if err := r.List(context.TODO(), &client.ListOptions{}, registries); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when getting the list of Registries in the cluster: %s", err)
+		return false, err
+	}
+
+	for i := range registries.Items {
+		registry := &registries.Items[i]
+		if !registry.ObjectMeta.DeletionTimestamp.IsZero() || registry.Spec.Certificate == nil {
+			continue
+		}
+
+		secret, err := registry.GetCertificateSecret(r)
+		if err != nil {
+			glog.V(3).Infof("[kubic] could not get the certificate for %s: node '%s' is not ready yet", registry, curNode.Name)
+			return false, nil
+		}
+
+		// (a Secret without a CA.crt is never installed)
+		hash := getNodeRegistryHash(registry, secret, curNode)
+		if len(hash) > 0 && getNodeHash(registry, curNode.Name) != hash {
+			glog.V(5).Infof("[kubic] %s is not installed in node '%s' yet", registry, curNode.Name)
+			return false, nil
+		}
+	}
+	return true, nil
+}
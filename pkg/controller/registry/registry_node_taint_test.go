@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/test"
+	"github.com/kubic-project/registries-operator/pkg/test/fake"
+)
+
+func TestNodeReadinessTaint(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	r := &ReconcileNodeReadiness{fake.NewTestClient(), fake.NewTestRecorder()}
+
+	fooSec, err := test.BuildSecretFromCert("foo-ca-crt", "foo.crt")
+	if err != nil {
+		t.Errorf("Error creating secret %v", err)
+	}
+
+	fooReg, err := kubicv1beta1.GetTestRegistry("foo")
+	if err != nil {
+		t.Errorf("Error Getting Registry %v", err)
+	}
+
+	node0 := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node0"},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{
+				{Key: nodeNotReadyTaintKey, Effect: corev1.TaintEffectNoSchedule},
+				{Key: "dedicated", Effect: corev1.TaintEffectNoSchedule},
+			},
+		},
+	}
+	g.Expect(r.Create(context.TODO(), fooSec)).ShouldNot(HaveOccurred())
+	g.Expect(r.Create(context.TODO(), fooReg)).ShouldNot(HaveOccurred())
+	g.Expect(r.Create(context.TODO(), node0)).ShouldNot(HaveOccurred())
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: "node0"}}
+	getNode := func() *corev1.Node {
+		updated := &corev1.Node{}
+		g.Expect(r.Get(context.TODO(), request.NamespacedName, updated)).ShouldNot(HaveOccurred())
+		return updated
+	}
+
+	//the taint is kept until the certificate is installed in the node...
+	_, err = r.Reconcile(request)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(hasNotReadyTaint(getNode())).Should(BeTrue())
+
+	//... the installers must tolerate it...
+	defer func(enabled bool) { config.NodeReadinessTaint = enabled }(config.NodeReadinessTaint)
+	config.NodeReadinessTaint = true
+
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(job.Spec.Template.Spec.Tolerations).Should(ContainElement(corev1.Toleration{
+		Key:      nodeNotReadyTaintKey,
+		Operator: corev1.TolerationOpExists,
+	}))
+
+	//... and it is removed once it is installed
+	fooReg.Status.GetNodeStatus("node0").CurrentHash = getNodeRegistryHash(fooReg, fooSec, node0)
+	g.Expect(r.Update(context.TODO(), fooReg)).ShouldNot(HaveOccurred())
+	g.Expect(taintedNodesMapper{r}.Map(handler.MapObject{Object: fooReg})).Should(HaveLen(1))
+
+	_, err = r.Reconcile(request)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	updated := getNode()
+	g.Expect(hasNotReadyTaint(updated)).Should(BeFalse())
+	g.Expect(updated.Spec.Taints).Should(HaveLen(1))
+	g.Expect(taintedNodesMapper{r}.Map(handler.MapObject{Object: fooReg})).Should(BeEmpty())
+}
@@ -18,26 +18,49 @@
 package registry
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
 	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
 )
 
 const (
-	// the image used in the Job for performing the copies
-	jobImage = "busybox:latest"
-
 	// directory in the Job where secrets will be mounted
 	jobSecretsDir = "/secrets"
+
+	// name of the container that runs the `PostCommands`
+	jobPostContainerName = "post"
+
+	// the operator executable in the node image
+	nodeExe = "/usr/local/bin/registries-operator"
+
+	// directory in the Job where the root filesystem of the node (or only the
+	// `jobHostPaths`, see getJobHostRootPaths) is mounted
+	jobHostRootDir = "/host"
+
+	// the annotation (followed by the container name) with the AppArmor profile of a container
+	appArmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
 )
 
 var (
+	// the directories of the node mounted in the Jobs that do not need
+	// the whole root filesystem of the node
+	jobHostPaths = []string{
+		"/etc/docker",
+		"/etc/containers",
+		"/etc/containerd",
+		node.LockDir,
+	}
+
 	// Template for the Job
 	jobTemplate = batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -45,8 +68,6 @@ var (
 			Labels: map[string]string{},
 		},
 		Spec: batchv1.JobSpec{
-			//Parallelism: 0,  // to be set
-			//Completions: 0,  // to be set
 			Template: corev1.PodTemplateSpec{
 				Spec: corev1.PodSpec{
 					RestartPolicy:      corev1.RestartPolicyNever,
@@ -65,24 +86,11 @@ var (
 					Containers: []corev1.Container{
 						{
 							Name:            "unset", // this will be set
-							Image:           jobImage,
+							Image:           "unset", // this will be set
 							ImagePullPolicy: corev1.PullIfNotPresent,
-							Command:         []string{"/bin/sh", "-c"},
-							Args:            []string{}, // this will be set...
-						},
-					},
-					Affinity: &corev1.Affinity{
-						PodAntiAffinity: &corev1.PodAntiAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
-								{
-									TopologyKey: "kubernetes.io/hostname",
-									LabelSelector: &metav1.LabelSelector{
-										MatchLabels: map[string]string{
-											// to be set
-										},
-									},
-								},
-							},
+							Command:         []string{}, // this will be set...
+							// the tail of the logs is kept when the command fails without a result
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 						},
 					},
 				},
@@ -92,14 +100,31 @@ var (
 )
 
 type runnerWithSecrets struct {
+	// Commands is the command (and its arguments) run (with the node image) in the Job
 	Commands     []string
 	JobName      string
 	JobNamespace string
-	NumNodes     int32
 	Secrets      map[string]*corev1.Secret
 	Labels       map[string]string
-	AntiAffinity map[string]string
 	HostPaths    []string
+
+	// HostRootDir is the directory where the root filesystem of the node
+	// is mounted (when not empty)
+	HostRootDir string
+
+	// HostRootPaths are the only paths of the node mounted in the HostRootDir
+	// (the whole root filesystem is mounted when empty)
+	HostRootPaths []string
+
+	// HostPID runs the Job privileged in the host PID namespace (so it can
+	// run commands in the host, like reloading the runtimes)
+	HostPID bool
+
+	// NodeName is the Node where the Job must run
+	NodeName string
+
+	// PostCommands are run once the Commands have finished successfully
+	PostCommands []string
 }
 
 // getRunnerJobWithSecrets gets a Job for running some commands on a specific node
@@ -107,16 +132,31 @@ type runnerWithSecrets struct {
 func getRunnerJobWithSecrets(cfg *runnerWithSecrets) (*batchv1.Job, error) {
 	job := jobTemplate.DeepCopy()
 
-	job.Name = cfg.JobName
+	// the Jobs can be kept once processed, so every Job must get a different name
+	jobName := cfg.JobName
+	if isJobRetentionEnabled() {
+		jobName = shortenLabelValue(fmt.Sprintf("%s-%s", cfg.JobName, strconv.FormatInt(time.Now().Unix(), 36)))
+	}
+
+	job.Name = jobName
 	job.Namespace = cfg.JobNamespace
-	job.Spec.Completions = &cfg.NumNodes
-	job.Spec.Parallelism = &cfg.NumNodes
 
+	// bind the (only) pod to the node, skipping the scheduler
 	jobSpec := &job.Spec.Template.Spec
+	jobSpec.NodeName = cfg.NodeName
 	jobCont0 := &jobSpec.Containers[0]
 
-	jobCont0.Name = cfg.JobName
-	jobCont0.Args = cfg.Commands
+	jobCont0.Name = jobName
+	jobCont0.Image = config.NodeImage
+	jobCont0.Command = cfg.Commands
+	jobCont0.Env = []corev1.EnvVar{
+		{
+			Name: "NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+			},
+		},
+	}
 
 	// copy all the labels
 	for k, v := range cfg.Labels {
@@ -148,8 +188,6 @@ func getRunnerJobWithSecrets(cfg *runnerWithSecrets) (*batchv1.Job, error) {
 		jobCont0.VolumeMounts = append(jobCont0.VolumeMounts, newVolumeMount)
 	}
 
-	jobSpec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].LabelSelector.MatchLabels = cfg.AntiAffinity
-
 	// add all the extra "hostPaths"
 	for hostPathNum, hostPath := range cfg.HostPaths {
 		name := fmt.Sprintf("host-path-%d", hostPathNum)
@@ -170,5 +208,160 @@ func getRunnerJobWithSecrets(cfg *runnerWithSecrets) (*batchv1.Job, error) {
 		jobCont0.VolumeMounts = append(jobCont0.VolumeMounts, newVolumeMount)
 	}
 
+	// mount the root filesystem of the node (or only some paths of it)
+	for hostPathNum, hostPath := range cfg.HostRootPaths {
+		name := fmt.Sprintf("host-root-%d", hostPathNum)
+		jobSpec.Volumes = append(jobSpec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: hostPath,
+				},
+			},
+		})
+		jobCont0.VolumeMounts = append(jobCont0.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: filepath.Join(cfg.HostRootDir, hostPath),
+		})
+	}
+	if len(cfg.HostRootDir) > 0 && len(cfg.HostRootPaths) == 0 {
+		jobSpec.Volumes = append(jobSpec.Volumes, corev1.Volume{
+			Name: "host-root",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/",
+				},
+			},
+		})
+		jobCont0.VolumeMounts = append(jobCont0.VolumeMounts, corev1.VolumeMount{
+			Name:      "host-root",
+			MountPath: cfg.HostRootDir,
+		})
+	}
+
+	if cfg.HostPID {
+		privileged := true
+		jobSpec.HostPID = true
+		jobCont0.SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+	}
+
+	// the post commands must be run after the commands, so we run the
+	// commands in an init container
+	if len(cfg.PostCommands) > 0 {
+		postCont := jobCont0.DeepCopy()
+		postCont.Name = jobPostContainerName
+		postCont.Command = cfg.PostCommands
+
+		jobSpec.InitContainers = []corev1.Container{*jobCont0}
+		jobSpec.Containers = []corev1.Container{*postCont}
+	}
+
+	// the Jobs must run in the Nodes that are waiting for the certificates
+	if config.NodeReadinessTaint {
+		jobSpec.Tolerations = append(jobSpec.Tolerations, corev1.Toleration{
+			Key:      nodeNotReadyTaintKey,
+			Operator: corev1.TolerationOpExists,
+		})
+	}
+
+	applyJobPodConfig(job, config.JobPod)
+
 	return job, nil
 }
+
+// applyJobPodConfig applies the operator's overrides to the pod template of a Job
+func applyJobPodConfig(job *batchv1.Job, podCfg config.JobPodConfig) {
+	podTemplate := &job.Spec.Template
+	jobSpec := &podTemplate.Spec
+
+	if len(podCfg.ImagePullSecrets) > 0 {
+		jobSpec.ImagePullSecrets = append([]corev1.LocalObjectReference{}, podCfg.ImagePullSecrets...)
+	}
+	if len(podCfg.Tolerations) > 0 {
+		jobSpec.Tolerations = append(jobSpec.Tolerations, podCfg.Tolerations...)
+	}
+	if len(podCfg.PriorityClassName) > 0 {
+		jobSpec.PriorityClassName = podCfg.PriorityClassName
+	}
+	if podCfg.SecurityContext != nil {
+		jobSpec.SecurityContext = podCfg.SecurityContext.DeepCopy()
+	}
+
+	containers := []*corev1.Container{}
+	for i := range jobSpec.InitContainers {
+		containers = append(containers, &jobSpec.InitContainers[i])
+	}
+	for i := range jobSpec.Containers {
+		containers = append(containers, &jobSpec.Containers[i])
+	}
+
+	for _, cont := range containers {
+		if len(podCfg.Image) > 0 {
+			cont.Image = podCfg.Image
+		}
+		if len(podCfg.ImagePullPolicy) > 0 {
+			cont.ImagePullPolicy = podCfg.ImagePullPolicy
+		}
+		if podCfg.Resources != nil {
+			cont.Resources = *podCfg.Resources.DeepCopy()
+		}
+		if podCfg.ContainerSecurityContext != nil {
+			// (the Jobs that reload the runtimes must still be privileged)
+			privileged := cont.SecurityContext != nil && cont.SecurityContext.Privileged != nil && *cont.SecurityContext.Privileged
+			cont.SecurityContext = podCfg.ContainerSecurityContext.DeepCopy()
+			if privileged {
+				cont.SecurityContext.Privileged = &privileged
+			}
+		}
+		if len(podCfg.AppArmorProfile) > 0 {
+			if podTemplate.Annotations == nil {
+				podTemplate.Annotations = map[string]string{}
+			}
+			podTemplate.Annotations[appArmorAnnotationPrefix+cont.Name] = podCfg.AppArmorProfile
+		}
+	}
+}
+
+// needsHostPID returns true if the Jobs that modify the nodes must run in the host PID namespace
+func needsHostPID() bool {
+	policy := node.ReloadPolicy(config.RuntimeReloadPolicy)
+	return len(policy) > 0 && policy != node.ReloadNever
+}
+
+// getJobHostRootPaths returns the paths of the node mounted in a Job: the whole root
+// filesystem (nil) when the Job must configure the system trust store (`systemTrust`)
+// or reload the runtimes, or only the `jobHostPaths` otherwise
+func getJobHostRootPaths(systemTrust bool) []string {
+	if systemTrust || needsHostPID() {
+		return nil
+	}
+	return jobHostPaths
+}
+
+// getNodeInstallCommands returns the command for running a `node install|remove` in a Job
+// (where the root filesystem of the node is mounted at `jobHostRootDir`)
+func getNodeInstallCommands(action string, spec node.InstallSpec) ([]string, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return []string{nodeExe, "node", action, "--root", jobHostRootDir, "--spec", string(specJSON)}, nil
+}
+
+// getNodeConvergeCommands returns the command for running a `node converge` in a Job
+// (where the root filesystem of the node is mounted at `jobHostRootDir`)
+func getNodeConvergeCommands(nodeName string, state node.NodeState) ([]string, error) {
+	if err := state.Validate(); err != nil {
+		return nil, err
+	}
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return []string{nodeExe, "node", "converge", "--root", jobHostRootDir, "--node-name", nodeName, "--state", string(stateJSON)}, nil
+}
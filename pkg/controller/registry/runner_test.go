@@ -18,9 +18,196 @@
 package registry
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/renstrom/dedent"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
 )
 
 func TestRunner(t *testing.T) {
 	// TODO
 }
+
+func TestRunnerPostCommands(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+		Secrets:      map[string]*corev1.Secret{},
+		HostPaths:    []string{"/etc/docker"},
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(job.Spec.Template.Spec.NodeName).Should(Equal("node0"))
+	g.Expect(job.Spec.Template.Spec.InitContainers).Should(BeEmpty())
+	g.Expect(job.Spec.Template.Spec.Containers).Should(HaveLen(1))
+
+	job, err = getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+		Secrets:      map[string]*corev1.Secret{},
+		HostPaths:    []string{"/etc/docker"},
+		PostCommands: []string{nodeExe, "node", "probe"},
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//the commands must be run before the post commands
+	podSpec := job.Spec.Template.Spec
+	g.Expect(podSpec.InitContainers).Should(HaveLen(1))
+	g.Expect(podSpec.InitContainers[0].Command).Should(Equal([]string{"echo installing"}))
+	g.Expect(podSpec.Containers).Should(HaveLen(1))
+	g.Expect(podSpec.Containers[0].Name).Should(Equal(jobPostContainerName))
+	g.Expect(podSpec.InitContainers[0].Image).Should(Equal(config.NodeImage))
+	g.Expect(podSpec.Containers[0].Image).Should(Equal(config.NodeImage))
+	g.Expect(podSpec.Containers[0].Command).Should(Equal([]string{nodeExe, "node", "probe"}))
+	g.Expect(podSpec.Containers[0].VolumeMounts).Should(Equal(podSpec.InitContainers[0].VolumeMounts))
+}
+
+func TestRunnerHostRoot(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+		Secrets:      map[string]*corev1.Secret{},
+		HostRootDir:  jobHostRootDir,
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	//the root filesystem of the node must be mounted at `HostRootDir`
+	podSpec := job.Spec.Template.Spec
+	g.Expect(podSpec.Volumes).Should(HaveLen(1))
+	g.Expect(podSpec.Volumes[0].HostPath.Path).Should(Equal("/"))
+	g.Expect(podSpec.Containers[0].VolumeMounts).Should(HaveLen(1))
+	g.Expect(podSpec.Containers[0].VolumeMounts[0].MountPath).Should(Equal(jobHostRootDir))
+	g.Expect(podSpec.HostPID).Should(BeFalse())
+	g.Expect(podSpec.Containers[0].SecurityContext).Should(BeNil())
+
+	//or only some paths of the node (in the same place)
+	job, err = getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:      []string{"echo installing"},
+		JobName:       "test-job",
+		NodeName:      "node0",
+		JobNamespace:  metav1.NamespaceSystem,
+		HostRootDir:   jobHostRootDir,
+		HostRootPaths: jobHostPaths,
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	podSpec = job.Spec.Template.Spec
+	g.Expect(podSpec.Volumes).Should(HaveLen(len(jobHostPaths)))
+	for i, hostPath := range jobHostPaths {
+		g.Expect(podSpec.Volumes[i].HostPath.Path).Should(Equal(hostPath))
+		g.Expect(podSpec.Containers[0].VolumeMounts[i].MountPath).Should(Equal(filepath.Join(jobHostRootDir, hostPath)))
+	}
+
+	//reloading the runtimes needs a privileged Job in the host PID namespace
+	job, err = getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+		HostRootDir:  jobHostRootDir,
+		HostPID:      true,
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	podSpec = job.Spec.Template.Spec
+	g.Expect(podSpec.HostPID).Should(BeTrue())
+	g.Expect(*podSpec.Containers[0].SecurityContext.Privileged).Should(BeTrue())
+}
+
+func TestRunnerJobPodConfig(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	f, err := ioutil.TempFile("", "jobs-pod-config")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(dedent.Dedent(`
+		image: registry.local/registries-operator:1.0
+		imagePullSecrets:
+		- name: local-registry
+		resources:
+		  limits:
+		    cpu: 100m
+		    memory: 64Mi
+		tolerations:
+		- key: dedicated
+		  operator: Exists
+		priorityClassName: system-node-critical
+		containerSecurityContext:
+		  seLinuxOptions:
+		    type: spc_t
+		appArmorProfile: runtime/default
+	`))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	f.Close()
+
+	podCfg, err := config.LoadJobPodConfig(f.Name())
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	defer func(prev config.JobPodConfig) { config.JobPod = prev }(config.JobPod)
+	config.JobPod = podCfg
+
+	job, err := getRunnerJobWithSecrets(&runnerWithSecrets{
+		Commands:     []string{"echo installing"},
+		JobName:      "test-job",
+		NodeName:     "node0",
+		JobNamespace: metav1.NamespaceSystem,
+		HostRootDir:  jobHostRootDir,
+		HostPID:      true,
+		PostCommands: []string{nodeExe, "node", "probe"},
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	podSpec := job.Spec.Template.Spec
+	g.Expect(podSpec.ImagePullSecrets).Should(Equal([]corev1.LocalObjectReference{{Name: "local-registry"}}))
+	g.Expect(podSpec.Tolerations).Should(HaveLen(len(jobTemplate.Spec.Template.Spec.Tolerations) + 1))
+	g.Expect(podSpec.PriorityClassName).Should(Equal("system-node-critical"))
+
+	//the overrides are applied to all the containers
+	for _, cont := range append(podSpec.InitContainers, podSpec.Containers...) {
+		g.Expect(cont.Image).Should(Equal("registry.local/registries-operator:1.0"))
+		g.Expect(cont.Resources.Limits.Memory().String()).Should(Equal("64Mi"))
+		g.Expect(cont.SecurityContext.SELinuxOptions.Type).Should(Equal("spc_t"))
+		g.Expect(*cont.SecurityContext.Privileged).Should(BeTrue())
+		g.Expect(job.Spec.Template.Annotations).Should(HaveKeyWithValue(appArmorAnnotationPrefix+cont.Name, "runtime/default"))
+	}
+
+	//invalid configurations are rejected
+	g.Expect(config.JobPodConfig{AppArmorProfile: "something"}.Validate()).Should(HaveOccurred())
+	g.Expect(config.JobPodConfig{ImagePullPolicy: "Sometimes"}.Validate()).Should(HaveOccurred())
+}
+
+func TestNodeInstallCommands(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	cmds, err := getNodeInstallCommands("install", node.InstallSpec{
+		HostPort: "registry.suse.de:5000",
+		CAFile:   "/secrets/this-registry/ca.crt",
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(cmds).Should(Equal([]string{nodeExe, "node", "install", "--root", jobHostRootDir, "--spec",
+		`{"hostPort":"registry.suse.de:5000","caFile":"/secrets/this-registry/ca.crt"}`}))
+
+	//invalid addresses must be rejected before launching any Job
+	_, err = getNodeInstallCommands("remove", node.InstallSpec{HostPort: "registry.suse.de:5000'; rm -rf /; '"})
+	g.Expect(err).Should(HaveOccurred())
+}
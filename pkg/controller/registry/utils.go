@@ -21,11 +21,20 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"fmt"
+	"hash/fnv"
 
 	"github.com/golang/glog"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"github.com/kubic-project/registries-operator/pkg/config"
+	"github.com/kubic-project/registries-operator/pkg/node"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
 )
 
 // getAllNodes gets the list of nodes in the cluster
@@ -39,8 +48,8 @@ func getAllNodes(r client.Client) (map[string]*corev1.Node, error) {
 	glog.V(5).Infof("[kubic] %d nodes in the cluster", len(nodes.Items))
 
 	res := map[string]*corev1.Node{}
-	for _, node := range nodes.Items {
-		res[node.Name] = &node
+	for i := range nodes.Items {
+		res[nodes.Items[i].Name] = &nodes.Items[i]
 	}
 	return res, nil
 }
@@ -51,30 +60,188 @@ func getAllJobsWithLabels(r client.Client, labels map[string]string) ([]batchv1.
 	jobs := &batchv1.JobList{}
 
 	// only return the Jobs that were created by the 'kubic-registry-installer'
-	listOptions := &client.ListOptions{}
+	listOptions := &client.ListOptions{Namespace: config.JobNamespace}
 	listOptions.MatchingLabels(labels)
 
 	if err := r.List(context.TODO(), listOptions, jobs); err != nil {
 		glog.V(1).Infof("[kubic] error when getting the list of Jobs in the cluster: %s", err)
 		return nil, err
 	}
-	return jobs.Items, nil
+
+	// (the Jobs kept once processed are ignored)
+	res := []batchv1.Job{}
+	for _, job := range jobs.Items {
+		if !isJobRetained(&job) {
+			res = append(res, job)
+		}
+	}
+	return res, nil
+}
+
+// getNodeJobName returns the name of a Job that runs in the node `nodeName` for a registry.
+// The name is used by Kubernetes in the `job-name` label of the pods, so it is
+// shortened (with a hash) when it is not a valid label value.
+func getNodeJobName(prefix string, hostPort string, nodeName string) string {
+	return shortenLabelValue(kubicutil.SafeID(prefix) + "-" + kubicutil.SafeID(hostPort) + "-" + kubicutil.SafeID(nodeName))
+}
+
+// getNodeLabelValue returns the value for the label with the node where a Job runs.
+// Node names can be longer than a label value, so they are shortened (with a hash):
+// the Jobs are matched with their nodes by the `NodeName` in their spec.
+func getNodeLabelValue(nodeName string) string {
+	return shortenLabelValue(nodeName)
+}
+
+// shortenLabelValue shortens (with a hash) a name that is not a valid label value
+func shortenLabelValue(name string) string {
+	if len(name) <= validation.LabelValueMaxLength {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	return name[:validation.LabelValueMaxLength-len(suffix)] + suffix
+}
+
+// getJobsByNode indexes some Jobs by the node where they run
+func getJobsByNode(jobs []batchv1.Job) map[string]*batchv1.Job {
+	res := map[string]*batchv1.Job{}
+	for i := range jobs {
+		res[jobs[i].Spec.Template.Spec.NodeName] = &jobs[i]
+	}
+	return res
+}
+
+// getJobPods gets the list of pods created by a Job
+func getJobPods(r client.Client, job *batchv1.Job) ([]corev1.Pod, error) {
+	glog.V(5).Infof("[kubic] getting the list of pods for Job '%s'...", job.Name)
+	pods := &corev1.PodList{}
+
+	listOptions := &client.ListOptions{Namespace: job.Namespace}
+	listOptions.MatchingLabels(map[string]string{"job-name": job.Name})
+
+	if err := r.List(context.TODO(), listOptions, pods); err != nil {
+		glog.V(1).Infof("[kubic] error when getting the list of Pods for Job '%s': %s", job.Name, err)
+		return nil, err
+	}
+	return pods.Items, nil
 }
 
-// getSecretHash gets the Hash for the CA.crt in a Secret
-// (we must return a printable string, so we will use the base64)
-func getSecretHash(secret *corev1.Secret) string {
+// getRegistryHash gets the Hash for the configuration installed in the Nodes
+// for a Registry, with the CA.crt (and client certificates) in a Secret
+// (we must return a printable string that can be used in labels)
+func getRegistryHash(registry *kubicv1beta1.Registry, secret *corev1.Secret) string {
+	crt := getSecretCA(secret)
+	if crt == nil {
+		return ""
+	}
+
+	cfg := node.NewHostConfig(registry, secret)
+	cfg.Targets = config.RuntimeTargets
+	return cfg.Hash()
+}
+
+// getNodeTargets returns the runtime targets for `curNode` (nil for all the targets)
+func getNodeTargets(curNode *corev1.Node) []string {
+	return node.TargetsForNode(curNode, config.RuntimeTargets)
+}
+
+// needsSystemTrust returns true if the Jobs for `registry` in the Node `nodeName` must
+// configure its system trust store: when it is enabled, or for removing the CA.crt
+// installed there before
+func needsSystemTrust(registry *kubicv1beta1.Registry, nodeName string) bool {
+	if registry.Spec.SystemTrust {
+		return true
+	}
+	for _, nodeStatus := range registry.Status.Nodes {
+		if nodeStatus.Name == nodeName {
+			return nodeStatus.SystemTrust
+		}
+	}
+	return false
+}
+
+// getNodeRegistryHash gets the Hash for the configuration installed in
+// `curNode` (it depends on the runtime targets of the Node)
+func getNodeRegistryHash(registry *kubicv1beta1.Registry, secret *corev1.Secret, curNode *corev1.Node) string {
+	crt := getSecretCA(secret)
+	if crt == nil {
+		return ""
+	}
+
+	cfg := node.NewHostConfig(registry, secret)
+	cfg.Targets = getNodeTargets(curNode)
+	return cfg.Hash()
+}
+
+// getNodesRegistryHashes gets the Hash for the configuration installed in every Node
+func getNodesRegistryHashes(registry *kubicv1beta1.Registry, secret *corev1.Secret, curNodes map[string]*corev1.Node) map[string]string {
+	res := map[string]string{}
+	for nodeName, curNode := range curNodes {
+		res[nodeName] = getNodeRegistryHash(registry, secret, curNode)
+	}
+	return res
+}
+
+// getLegacyNodeHash gets the Hash for the configuration installed in `curNode` by
+// previous versions of the operator, where only the CA.crt was copied to the Docker
+// and podman certificates directories. It is the current Hash for the Node when
+// nothing else must be installed there, so the Node is not converged again.
+func getLegacyNodeHash(registry *kubicv1beta1.Registry, secret *corev1.Secret, curNode *corev1.Node) string {
+	crt := getSecretCA(secret)
+	if crt == nil {
+		return ""
+	}
+
+	legacy := node.HostConfig{
+		HostPort: registry.Spec.HostPort,
+		CA:       crt,
+		Targets:  []string{node.TargetDocker, node.TargetPodman},
+	}
+
+	cfg := node.NewHostConfig(registry, secret)
+	cfg.Targets = getNodeTargets(curNode)
+	if legacy.Covers(cfg) {
+		return cfg.Hash()
+	}
+	return legacy.Hash()
+}
+
+// getLegacySecretHash gets the (MD5-based) Hash we used in previous versions
+// for the CA.crt in a Secret. It is only used for migrating old `CurrentHash`es.
+func getLegacySecretHash(secret *corev1.Secret) string {
+	crt := getSecretCA(secret)
+	if crt == nil {
+		return ""
+	}
+
+	b := md5.Sum(crt)
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// getSecretCA gets the CA.crt in a Secret (or nil if there is no CA.crt)
+func getSecretCA(secret *corev1.Secret) []byte {
 	if secret == nil {
 		glog.V(5).Infof("[kubic] no secret provided: empty hash")
-		return ""
+		return nil
 	}
 	crt, found := secret.Data["ca.crt"]
 	if !found {
 		glog.V(5).Infof("[kubic] no CA.crt in Secret '%s'", secret.Name)
-		return ""
+		return nil
 	}
+	return crt
+}
 
-	b := md5.Sum(crt)
-	hashStr := base64.RawURLEncoding.EncodeToString(b[:])
-	return hashStr
+// mergeResults merges some reconcile.Results, keeping the earliest requeue
+func mergeResults(results ...reconcile.Result) reconcile.Result {
+	res := reconcile.Result{}
+	for _, r := range results {
+		res.Requeue = res.Requeue || r.Requeue
+		if r.RequeueAfter > 0 && (res.RequeueAfter == 0 || r.RequeueAfter < res.RequeueAfter) {
+			res.RequeueAfter = r.RequeueAfter
+		}
+	}
+	return res
 }
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DockerCertsDir is the certificates directory for Docker
+	DockerCertsDir = "/etc/docker/certs.d/"
+
+	// PodmanCertsDir is the certificates directory for podman
+	PodmanCertsDir = "/etc/containers/certs.d/"
+
+	// ContainerdCertsDir is the certificates (and hosts) directory for containerd
+	ContainerdCertsDir = "/etc/containerd/certs.d/"
+
+	// caFileName is the name of the CA.crt installed for a registry
+	caFileName = "ca.crt"
+)
+
+// CertsDirs are the directories where the certificates are installed
+var CertsDirs = []string{DockerCertsDir, PodmanCertsDir, ContainerdCertsDir}
+
+// CertificatePaths returns the paths where the CA.crt for `hostPort`
+// is installed, relative to the root filesystem `root`
+func CertificatePaths(root string, hostPort string) []string {
+	res := []string{}
+	for _, dir := range CertsDirs {
+		res = append(res, filepath.Join(root, dir, hostPort, caFileName))
+	}
+	return res
+}
+
+// InstallHostConfig installs the configuration for a registry (the CA.crt,
+// the client certificates, the containerd hosts.toml...) in all the runtime
+// targets of `cfg` (see RuntimeTarget).
+// The files are staged and swapped atomically with the current ones
+// (that are kept as a backup), and all the targets are rolled back when
+// something fails (including the verification of the installed files).
+func InstallHostConfig(root string, cfg HostConfig) error {
+	_, err := installHostConfig(root, cfg)
+	return err
+}
+
+// installHostConfig installs the configuration for a registry (see InstallHostConfig),
+// returning the paths written in the root filesystem `root`
+func installHostConfig(root string, cfg HostConfig) ([]string, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	targets, err := getRuntimeTargets(cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockNode(root)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	changes := []Change{}
+	refresh := []string{}
+	rollback := func() {
+		for i := len(changes) - 1; i >= 0; i-- {
+			if err := changes[i].Rollback(); err != nil {
+				glog.V(1).Infof("[kubic] ERROR: could not roll back: %s", err)
+			}
+		}
+		if err := refreshTrustStores(root, refresh); err != nil {
+			glog.V(1).Infof("[kubic] ERROR: %s", err)
+		}
+	}
+
+	for _, target := range targets {
+		glog.V(5).Infof("[kubic] installing configuration for %s in %s", cfg.HostPort, target.Name())
+		targetChanges, err := target.Apply(root, cfg)
+		changes = append(changes, targetChanges...)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	// install (or remove) the CA.crt in the system trust store
+	if len(cfg.Name) > 0 {
+		trustSwaps, trustRefresh, err := stageTrustStore(root, cfg)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		refresh = trustRefresh
+
+		trustChanges, err := commitSwaps(trustSwaps, nil)
+		changes = append(changes, trustChanges...)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	// verify the files we have installed
+	if InstalledHash(root, cfg.Name, cfg.HostPort, cfg.Targets...) != cfg.Hash() {
+		rollback()
+		return nil, fmt.Errorf("verification of the certificates installed for %s failed", cfg.HostPort)
+	}
+
+	if err := refreshTrustStores(root, refresh); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	return changedPaths(root, changes), nil
+}
+
+// RemoveHostConfig removes the configuration for the registry `name` at
+// `hostPort` from all the runtime targets (and its system trust store
+// anchor), keeping it as a backup
+func RemoveHostConfig(root string, name string, hostPort string) error {
+	_, err := removeHostConfig(root, name, hostPort)
+	return err
+}
+
+// removeHostConfig removes the configuration for a registry (see RemoveHostConfig),
+// returning the paths removed (or modified) in the root filesystem `root`
+func removeHostConfig(root string, name string, hostPort string) ([]string, error) {
+	if err := ValidateHostPort(hostPort); err != nil {
+		return nil, err
+	}
+	if len(name) > 0 {
+		if err := ValidateName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := lockNode(root)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	changes := []Change{}
+	for _, target := range RuntimeTargets() {
+		glog.V(5).Infof("[kubic] removing configuration for %s from %s", hostPort, target.Name())
+		targetChanges, err := target.Remove(root, name, hostPort)
+		changes = append(changes, targetChanges...)
+		if err != nil {
+			return changedPaths(root, changes), err
+		}
+	}
+
+	// remove the CA.crt from the system trust stores
+	if len(name) > 0 {
+		trustSwaps, refresh, err := stageTrustStore(root, HostConfig{Name: name, HostPort: hostPort})
+		if err != nil {
+			return changedPaths(root, changes), err
+		}
+		trustChanges, err := commitSwaps(trustSwaps, nil)
+		changes = append(changes, trustChanges...)
+		if err != nil {
+			return changedPaths(root, changes), err
+		}
+		if err := refreshTrustStores(root, refresh); err != nil {
+			return changedPaths(root, changes), err
+		}
+	}
+	return changedPaths(root, changes), nil
+}
+
+// changedPaths returns the paths (relative to the root filesystem `root`) modified
+// by some `changes` (only for the changes that know their path)
+func changedPaths(root string, changes []Change) []string {
+	res := []string{}
+	for _, c := range changes {
+		if p, ok := c.(interface {
+			Path() string
+		}); ok {
+			if rel, err := filepath.Rel(root, p.Path()); err == nil {
+				res = append(res, filepath.Join("/", rel))
+			}
+		}
+	}
+	return res
+}
+
+// InstalledHash returns the hash of the configuration installed for the registry
+// `name` at `hostPort` in some runtime `targets` (all the targets when none is
+// specified) (see HostConfig.Hash), or an empty string when it is missing in
+// some of them
+func InstalledHash(root string, name string, hostPort string, targets ...string) string {
+	ts, err := getRuntimeTargets(targets)
+	if err != nil {
+		return ""
+	}
+
+	dirs := TargetFiles{}
+	for _, target := range ts {
+		files, ok := target.Verify(root, name, hostPort)
+		if !ok {
+			return ""
+		}
+		for location, contents := range files {
+			dirs[location] = contents
+		}
+	}
+
+	if len(name) > 0 {
+		if crt := installedTrustAnchor(root, name); crt != nil {
+			dirs[trustStoreHashKey] = map[string][]byte{caFileName: crt}
+		}
+	}
+	return hashDirs(dirs)
+}
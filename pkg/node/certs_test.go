@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestInstallCertificate(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	crt := []byte("some certificate")
+	hostPort := "registry.suse.de:5000"
+
+	g.Expect(InstalledHash(root, "", hostPort)).Should(BeEmpty())
+
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: hostPort, CA: crt})).ShouldNot(HaveOccurred())
+	hash := HostConfig{HostPort: hostPort, CA: crt}.Hash()
+	g.Expect(InstalledHash(root, "", hostPort)).Should(Equal(hash))
+	for _, path := range CertificatePaths(root, hostPort) {
+		g.Expect(ioutil.ReadFile(path)).Should(Equal(crt))
+	}
+
+	// a modified copy means the certificate is not (correctly) installed
+	g.Expect(ioutil.WriteFile(filepath.Join(root, PodmanCertsDir, hostPort, "ca.crt"), []byte("other"), 0644)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, "", hostPort)).ShouldNot(Equal(hash))
+
+	// ... and so does a missing copy
+	g.Expect(os.Remove(filepath.Join(root, ContainerdCertsDir, hostPort, "ca.crt"))).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, "", hostPort)).Should(BeEmpty())
+
+	g.Expect(RemoveHostConfig(root, "", hostPort)).ShouldNot(HaveOccurred())
+	g.Expect(filepath.Join(root, DockerCertsDir, hostPort)).ShouldNot(BeADirectory())
+	g.Expect(filepath.Join(root, PodmanCertsDir, hostPort)).ShouldNot(BeADirectory())
+	g.Expect(filepath.Join(root, ContainerdCertsDir, hostPort)).ShouldNot(BeADirectory())
+
+	// removing again is not an error
+	g.Expect(RemoveHostConfig(root, "", hostPort)).ShouldNot(HaveOccurred())
+}
+
+func TestInstallCertificateBackup(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	hostPort := "registry.suse.de:5000"
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: hostPort, CA: []byte("old certificate")})).ShouldNot(HaveOccurred())
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: hostPort, CA: []byte("new certificate")})).ShouldNot(HaveOccurred())
+
+	// the previous version is kept as a backup
+	for _, path := range CertificatePaths(root, hostPort) {
+		g.Expect(ioutil.ReadFile(path)).Should(Equal([]byte("new certificate")))
+
+		backup := filepath.Join(getBackupDir(filepath.Dir(path)), "ca.crt")
+		g.Expect(ioutil.ReadFile(backup)).Should(Equal([]byte("old certificate")))
+	}
+
+	// no staging directories are left behind
+	for _, dir := range CertsDirs {
+		entries, err := ioutil.ReadDir(filepath.Join(root, dir))
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(entries).Should(HaveLen(2))
+	}
+
+	// the removed certificates are also kept as a backup
+	g.Expect(RemoveHostConfig(root, "", hostPort)).ShouldNot(HaveOccurred())
+	for _, path := range CertificatePaths(root, hostPort) {
+		g.Expect(path).ShouldNot(BeAnExistingFile())
+
+		backup := filepath.Join(getBackupDir(filepath.Dir(path)), "ca.crt")
+		g.Expect(ioutil.ReadFile(backup)).Should(Equal([]byte("new certificate")))
+	}
+}
+
+func TestInstallCertificateRollback(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	hostPort := "registry.suse.de:5000"
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: hostPort, CA: []byte("old certificate")})).ShouldNot(HaveOccurred())
+
+	// break the podman certificates directory, so the installation fails there
+	podmanDir := filepath.Join(root, PodmanCertsDir)
+	g.Expect(os.RemoveAll(podmanDir)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Clean(podmanDir), []byte("not a directory"), 0644)).ShouldNot(HaveOccurred())
+
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: hostPort, CA: []byte("new certificate")})).Should(HaveOccurred())
+
+	// the certificate installed for Docker must be rolled back
+	dockerCA := filepath.Join(root, DockerCertsDir, hostPort, "ca.crt")
+	g.Expect(ioutil.ReadFile(dockerCA)).Should(Equal([]byte("old certificate")))
+
+	entries, err := ioutil.ReadDir(filepath.Join(root, DockerCertsDir))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(entries).Should(HaveLen(1))
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// timeout for probing the registries from the Node once they are installed
+const convergeProbeTimeout = 10 * time.Second
+
+// NodeState is the desired state of a Node for all the registries (passed as JSON
+// to the `node converge` command)
+type NodeState struct {
+	// Install are the registries that must be installed in the Node
+	Install []InstallSpec `json:"install,omitempty"`
+
+	// Remove are the registries that must be removed from the Node
+	Remove []InstallSpec `json:"remove,omitempty"`
+
+	// RuntimeReload is the policy for reloading the runtimes once all the
+	// registries have been converged
+	RuntimeReload ReloadPolicy `json:"runtimeReload,omitempty"`
+}
+
+// RegistryResult is the result of converging a registry in a Node
+type RegistryResult struct {
+	// Name is the name of the Registry
+	Name string `json:"name"`
+
+	// Hash is the hash of the configuration installed in the Node after
+	// the convergence (empty when it is not installed)
+	Hash string `json:"hash,omitempty"`
+
+	// PreviousHash is the hash of the configuration found in the Node before
+	// the convergence (empty when it was not installed)
+	PreviousHash string `json:"previousHash,omitempty"`
+
+	// Reachable is the result of probing the registry from the Node (when requested)
+	Reachable *bool `json:"reachable,omitempty"`
+
+	// Error is the error found when converging the registry
+	Error string `json:"error,omitempty"`
+}
+
+// NodeResult is the result of converging a Node
+type NodeResult struct {
+	// Node is the name of the Node where the convergence was run
+	Node string `json:"node"`
+
+	// Runtimes are the container runtimes detected in the Node
+	Runtimes []string `json:"runtimes,omitempty"`
+
+	// Registries are the results for every registry in the NodeState
+	Registries []RegistryResult `json:"registries,omitempty"`
+}
+
+// Validate checks the state is valid
+func (state NodeState) Validate() error {
+	for _, spec := range append(state.Install, state.Remove...) {
+		if err := ValidateName(spec.Name); err != nil {
+			return err
+		}
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+	}
+	return ValidateReloadPolicy(state.RuntimeReload)
+}
+
+// Converge installs and removes the registries in `state` in the root filesystem
+// `root`, reloading the runtimes (once) after all the changes. Failures are not
+// fatal: they are reported in the result of the registry.
+func Converge(root string, nodeName string, state NodeState) NodeResult {
+	res := NodeResult{Node: nodeName, Runtimes: DetectRuntimes(root)}
+	changed := map[string]bool{}
+	modified := []int{}
+
+	converge := func(spec InstallSpec, action func() error) {
+		before := RuntimeConfigs(root, spec.Name, spec.HostPort)
+		previous := InstalledHash(root, spec.Name, spec.HostPort, spec.Targets...)
+		err := action()
+		units := changedRuntimes(before, RuntimeConfigs(root, spec.Name, spec.HostPort))
+		for unit := range units {
+			changed[unit] = true
+		}
+		if len(units) > 0 {
+			modified = append(modified, len(res.Registries))
+		}
+
+		rr := RegistryResult{
+			Name:         spec.Name,
+			Hash:         InstalledHash(root, spec.Name, spec.HostPort, spec.Targets...),
+			PreviousHash: previous,
+		}
+		if err != nil {
+			glog.V(1).Infof("[kubic] ERROR: when converging %s in %s: %s", spec.HostPort, nodeName, err)
+			rr.Error = err.Error()
+		} else if spec.Probe {
+			caFile := CertificatePath(root, spec.HostPort, spec.Targets)
+			probe := Probe(nodeName, spec.HostPort, caFile, convergeProbeTimeout)
+			rr.Reachable = &probe.Reachable
+			rr.Error = probe.Error
+		}
+		res.Registries = append(res.Registries, rr)
+	}
+
+	for _, spec := range state.Remove {
+		converge(spec, func() error {
+			if err := spec.Validate(); err != nil {
+				return err
+			}
+			glog.V(1).Infof("[kubic] removing CA.crt for %s", spec.HostPort)
+			return RemoveHostConfig(root, spec.Name, spec.HostPort)
+		})
+	}
+
+	for _, spec := range state.Install {
+		converge(spec, func() error {
+			if err := spec.Validate(); err != nil {
+				return err
+			}
+			cfg, err := spec.hostConfig()
+			if err != nil {
+				return err
+			}
+			if InstalledHash(root, spec.Name, spec.HostPort, spec.Targets...) == cfg.Hash() {
+				glog.V(3).Infof("[kubic] CA.crt for %s already installed", spec.HostPort)
+				return nil
+			}
+			glog.V(1).Infof("[kubic] installing CA.crt for %s", spec.HostPort)
+			return InstallHostConfig(root, cfg)
+		})
+	}
+
+	// a reload failure is reported in all the registries that needed it
+	if err := reloadChangedRuntimes(state.RuntimeReload, changed); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: when reloading the runtimes in %s: %s", nodeName, err)
+		for _, i := range modified {
+			res.Registries[i].Error = fmt.Sprintf("could not reload the runtimes: %s", err)
+		}
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestConverge(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	// a fake systemd, where only docker is running
+	commands := []string{}
+	runHostCommand = func(command []string) error {
+		if len(command) == 4 && command[1] == "is-active" {
+			if command[3] == "docker" {
+				return nil
+			}
+			return fmt.Errorf("inactive")
+		}
+		commands = append(commands, strings.Join(command, " "))
+		return nil
+	}
+	runtimeHealthInterval = time.Millisecond
+	runtimeHealthTimeout = 10 * time.Millisecond
+	defer func() { runHostCommand = runInHost }()
+
+	caFile := filepath.Join(root, "ca.crt")
+	g.Expect(ioutil.WriteFile(caFile, []byte("some certificate"), 0644)).ShouldNot(HaveOccurred())
+
+	suse := InstallSpec{Name: "suse-registry", HostPort: "registry.suse.de:5000", CAFile: caFile, Insecure: true}
+	other := InstallSpec{Name: "other-registry", HostPort: "registry.other.org", CAFile: caFile}
+	state := NodeState{Install: []InstallSpec{suse, other}, RuntimeReload: ReloadOnly}
+	g.Expect(state.Validate()).ShouldNot(HaveOccurred())
+
+	// all the registries are installed, reloading docker only once
+	res := Converge(root, "node0", state)
+	g.Expect(res.Node).Should(Equal("node0"))
+	g.Expect(res.Registries).Should(HaveLen(2))
+	for _, rr := range res.Registries {
+		g.Expect(rr.Error).Should(BeEmpty(), rr.Name)
+		g.Expect(rr.Hash).ShouldNot(BeEmpty(), rr.Name)
+		g.Expect(rr.PreviousHash).Should(BeEmpty(), rr.Name)
+	}
+	g.Expect(res.Registries[0].Hash).Should(Equal(InstalledHash(root, suse.Name, suse.HostPort)))
+	g.Expect(commands).Should(Equal([]string{"systemctl reload docker"}))
+
+	// converging again does not modify the node
+	commands = []string{}
+	again := Converge(root, "node0", state)
+	g.Expect(again.Registries).Should(HaveLen(2))
+	for i, rr := range again.Registries {
+		g.Expect(rr.Hash).Should(Equal(res.Registries[i].Hash), rr.Name)
+		g.Expect(rr.PreviousHash).Should(Equal(rr.Hash), rr.Name)
+	}
+	g.Expect(commands).Should(BeEmpty())
+
+	// the registries are removed, and the failures are reported per registry
+	state = NodeState{
+		Install:       []InstallSpec{{Name: "missing-ca", HostPort: "registry.missing.org", CAFile: filepath.Join(root, "missing")}},
+		Remove:        []InstallSpec{{Name: suse.Name, HostPort: suse.HostPort}, {Name: other.Name, HostPort: other.HostPort}},
+		RuntimeReload: ReloadOnly,
+	}
+	res = Converge(root, "node0", state)
+	g.Expect(res.Registries).Should(HaveLen(3))
+	g.Expect(res.Registries[0].Hash).Should(BeEmpty())
+	g.Expect(res.Registries[0].Error).Should(BeEmpty())
+	g.Expect(res.Registries[0].PreviousHash).ShouldNot(BeEmpty())
+	g.Expect(res.Registries[1].Hash).Should(BeEmpty())
+	g.Expect(res.Registries[2].Name).Should(Equal("missing-ca"))
+	g.Expect(res.Registries[2].Error).ShouldNot(BeEmpty())
+	g.Expect(InstalledHash(root, suse.Name, suse.HostPort)).Should(BeEmpty())
+	g.Expect(commands).Should(Equal([]string{"systemctl reload docker"}))
+
+	// all the registries in a state must have a name
+	g.Expect(NodeState{Install: []InstallSpec{{HostPort: suse.HostPort, CAFile: caFile}}}.Validate()).Should(HaveOccurred())
+}
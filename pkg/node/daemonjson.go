@@ -0,0 +1,349 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DockerDaemonJSON is the configuration file of the Docker daemon, shared with admins and other tools
+	DockerDaemonJSON = "/etc/docker/daemon.json"
+
+	// DockerDaemonJSONState is the sidecar file where we keep track of the entries
+	// in daemon.json that belong to each Registry
+	DockerDaemonJSONState = "/etc/docker/.kubic-registries.json"
+
+	// the keys in daemon.json managed by the operator
+	daemonJSONInsecureKey = "insecure-registries"
+	daemonJSONMirrorsKey  = "registry-mirrors"
+)
+
+// dockerHubHosts are the addresses of Docker Hub (the only registry where Docker supports mirrors)
+var dockerHubHosts = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// daemonJSONState is the contents of the DockerDaemonJSONState file
+type daemonJSONState struct {
+	// Registries are the entries for each Registry (by name)
+	Registries map[string]*daemonJSONRegistryState `json:"registries,omitempty"`
+}
+
+// daemonJSONRegistryState are the entries in daemon.json for a Registry
+type daemonJSONRegistryState struct {
+	// Entries are the values required by the Registry for each key (ie, "insecure-registries")
+	Entries map[string][]string `json:"entries,omitempty"`
+
+	// Owned are the values added by the operator for the Registry, so they can be removed
+	// (the values that were already in daemon.json are never removed)
+	Owned map[string][]string `json:"owned,omitempty"`
+}
+
+// daemonJSONEntries returns the values required in daemon.json for the registry
+func (cfg HostConfig) daemonJSONEntries() map[string][]string {
+	res := map[string][]string{}
+	if cfg.Insecure {
+		for _, hostPort := range append([]string{cfg.HostPort}, cfg.Mirrors...) {
+			res[daemonJSONInsecureKey] = appendUniqueString(res[daemonJSONInsecureKey], hostPort)
+		}
+	}
+	if len(cfg.Mirrors) > 0 && containsString(dockerHubHosts, cfg.HostPort) {
+		for _, mirror := range cfg.Mirrors {
+			res[daemonJSONMirrorsKey] = appendUniqueString(res[daemonJSONMirrorsKey], "https://"+mirror)
+		}
+	}
+	return res
+}
+
+// hashDaemonJSONEntries returns the entries in a format that can be used in hashDirs
+func hashDaemonJSONEntries(entries map[string][]string) map[string][]byte {
+	res := map[string][]byte{}
+	for key, values := range entries {
+		sorted := append([]string{}, values...)
+		sort.Strings(sorted)
+		res[key] = []byte(strings.Join(sorted, "\n"))
+	}
+	return res
+}
+
+// installedDaemonJSONEntries returns the values in daemon.json for the Registry `name`
+// (only the values that are really in daemon.json)
+func installedDaemonJSONEntries(root string, name string) map[string][]string {
+	state, err := readDaemonJSONState(root)
+	if err != nil || state.Registries[name] == nil {
+		return nil
+	}
+	config, err := readDaemonJSON(root)
+	if err != nil {
+		return nil
+	}
+
+	res := map[string][]string{}
+	for key, values := range state.Registries[name].Entries {
+		current, err := getDaemonJSONList(config, key)
+		if err != nil {
+			return nil
+		}
+		for _, value := range values {
+			if containsString(current, value) {
+				res[key] = append(res[key], value)
+			}
+		}
+	}
+	return res
+}
+
+// stageDaemonJSON stages the changes in daemon.json (and its state) for having the
+// values in `wanted` for the Registry `name` (nil when the Registry is removed).
+// Only the values owned by the Registry are removed from daemon.json, and all
+// the other keys are preserved.
+func stageDaemonJSON(root string, name string, wanted map[string][]string) ([]*dirSwap, error) {
+	state, err := readDaemonJSONState(root)
+	if err != nil {
+		return nil, err
+	}
+	prev := state.Registries[name]
+	if prev == nil {
+		if len(wanted) == 0 {
+			return nil, nil // nothing to do
+		}
+		prev = &daemonJSONRegistryState{}
+	}
+
+	config, err := readDaemonJSON(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// the values required by other Registries
+	others := map[string][]string{}
+	for other, otherState := range state.Registries {
+		if other == name {
+			continue
+		}
+		for key, values := range otherState.Entries {
+			others[key] = append(others[key], values...)
+		}
+	}
+
+	next := &daemonJSONRegistryState{Entries: map[string][]string{}, Owned: map[string][]string{}}
+	configChanged := false
+
+	keys := map[string]bool{}
+	for key := range wanted {
+		keys[key] = true
+	}
+	for key := range prev.Owned {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		current, err := getDaemonJSONList(config, key)
+		if err != nil {
+			return nil, err
+		}
+		updated := []string{}
+
+		// remove the values we own that are not required anymore
+		for _, value := range current {
+			if containsString(prev.Owned[key], value) && !containsString(wanted[key], value) {
+				if !containsString(others[key], value) {
+					glog.V(3).Infof("[kubic] removing '%s' from '%s' in daemon.json", value, key)
+					continue
+				}
+				// another Registry needs it: it will be the new owner
+				for _, other := range sortedRegistries(state) {
+					otherState := state.Registries[other]
+					if other != name && containsString(otherState.Entries[key], value) {
+						otherState.Owned[key] = appendUniqueString(otherState.Owned[key], value)
+						break
+					}
+				}
+			}
+			updated = append(updated, value)
+		}
+
+		// add the values we need
+		for _, value := range wanted[key] {
+			if containsString(prev.Owned[key], value) && containsString(updated, value) {
+				next.Owned[key] = appendUniqueString(next.Owned[key], value)
+			} else if !containsString(updated, value) {
+				glog.V(3).Infof("[kubic] adding '%s' to '%s' in daemon.json", value, key)
+				updated = append(updated, value)
+				next.Owned[key] = appendUniqueString(next.Owned[key], value)
+			}
+			next.Entries[key] = appendUniqueString(next.Entries[key], value)
+		}
+
+		if !reflect.DeepEqual(current, updated) {
+			configChanged = true
+			if len(updated) == 0 {
+				delete(config, key)
+			} else if err := setDaemonJSONList(config, key, updated); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(next.Entries) == 0 {
+		delete(state.Registries, name)
+	} else {
+		state.Registries[name] = next
+	}
+
+	swaps := []*dirSwap{}
+	if configChanged {
+		contents, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		s, err := stageFile(filepath.Join(root, DockerDaemonJSON), append(contents, '\n'))
+		if err != nil {
+			return nil, err
+		}
+		swaps = append(swaps, s)
+	}
+
+	statePath := filepath.Join(root, DockerDaemonJSONState)
+	if len(state.Registries) == 0 {
+		if _, err := os.Stat(statePath); err == nil {
+			swaps = append(swaps, stageRemoval(statePath))
+		}
+	} else {
+		contents, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			cleanupSwaps(swaps)
+			return nil, err
+		}
+		s, err := stageFile(statePath, append(contents, '\n'))
+		if err != nil {
+			cleanupSwaps(swaps)
+			return nil, err
+		}
+		swaps = append(swaps, s)
+	}
+	return swaps, nil
+}
+
+// readDaemonJSON reads daemon.json, keeping all the keys (an empty configuration when it does not exist)
+func readDaemonJSON(root string) (map[string]json.RawMessage, error) {
+	config := map[string]json.RawMessage{}
+	contents, err := ioutil.ReadFile(filepath.Join(root, DockerDaemonJSON))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return config, nil
+	}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", DockerDaemonJSON, err)
+	}
+	return config, nil
+}
+
+// readDaemonJSONState reads the state file (an empty state when it does not exist)
+func readDaemonJSONState(root string) (*daemonJSONState, error) {
+	state := &daemonJSONState{}
+	contents, err := ioutil.ReadFile(filepath.Join(root, DockerDaemonJSONState))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(contents, state); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", DockerDaemonJSONState, err)
+		}
+	}
+	if state.Registries == nil {
+		state.Registries = map[string]*daemonJSONRegistryState{}
+	}
+	for _, registryState := range state.Registries {
+		if registryState.Owned == nil {
+			registryState.Owned = map[string][]string{}
+		}
+	}
+	return state, nil
+}
+
+// getDaemonJSONList returns the list of strings for `key` in daemon.json
+func getDaemonJSONList(config map[string]json.RawMessage, key string) ([]string, error) {
+	res := []string{}
+	raw, found := config[key]
+	if !found {
+		return res, nil
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unexpected value for '%s' in %s: %s", key, DockerDaemonJSON, err)
+	}
+	return res, nil
+}
+
+// setDaemonJSONList sets the list of strings for `key` in daemon.json
+func setDaemonJSONList(config map[string]json.RawMessage, key string, values []string) error {
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	config[key] = raw
+	return nil
+}
+
+// sortedRegistries returns the names of the Registries in the state, sorted
+func sortedRegistries(state *daemonJSONState) []string {
+	res := []string{}
+	for name := range state.Registries {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// cleanupSwaps removes the staging files of some swaps that will not be committed
+func cleanupSwaps(swaps []*dirSwap) {
+	for _, s := range swaps {
+		s.cleanup()
+	}
+}
+
+// containsString returns true if `s` is in `list`
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUniqueString appends `s` to `list` (if it is not there yet)
+func appendUniqueString(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
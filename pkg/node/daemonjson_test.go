@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// readTestDaemonJSON reads the daemon.json in `root`
+func readTestDaemonJSON(g *GomegaWithT, root string) map[string]interface{} {
+	contents, err := ioutil.ReadFile(filepath.Join(root, DockerDaemonJSON))
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	res := map[string]interface{}{}
+	g.Expect(json.Unmarshal(contents, &res)).ShouldNot(HaveOccurred())
+	return res
+}
+
+func TestDaemonJSONMerge(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	// a daemon.json written by an admin
+	daemonJSON := filepath.Join(root, DockerDaemonJSON)
+	g.Expect(os.MkdirAll(filepath.Dir(daemonJSON), 0755)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(daemonJSON,
+		[]byte(`{"log-driver": "journald", "insecure-registries": ["admin.suse.de:5000"]}`), 0644)).ShouldNot(HaveOccurred())
+
+	foo := HostConfig{
+		Name:     "foo",
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Insecure: true,
+	}
+	g.Expect(InstallHostConfig(root, foo)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, foo.Name, foo.HostPort)).Should(Equal(foo.Hash()))
+
+	config := readTestDaemonJSON(g, root)
+	g.Expect(config["log-driver"]).Should(Equal("journald"))
+	g.Expect(config["insecure-registries"]).Should(ConsistOf("admin.suse.de:5000", "registry.suse.de:5000"))
+
+	// another registry that needs the same entry (and the one added by the admin)
+	bar := HostConfig{
+		Name:     "bar",
+		HostPort: "admin.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Insecure: true,
+		Mirrors:  []string{"registry.suse.de:5000"},
+	}
+	g.Expect(InstallHostConfig(root, bar)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, bar.Name, bar.HostPort)).Should(Equal(bar.Hash()))
+	g.Expect(readTestDaemonJSON(g, root)["insecure-registries"]).Should(ConsistOf("admin.suse.de:5000", "registry.suse.de:5000"))
+
+	// the entry is still needed by the other registry
+	g.Expect(RemoveHostConfig(root, foo.Name, foo.HostPort)).ShouldNot(HaveOccurred())
+	g.Expect(readTestDaemonJSON(g, root)["insecure-registries"]).Should(ConsistOf("admin.suse.de:5000", "registry.suse.de:5000"))
+
+	// an entry removed by hand is detected (and restored)
+	g.Expect(ioutil.WriteFile(daemonJSON,
+		[]byte(`{"log-driver": "journald", "insecure-registries": ["admin.suse.de:5000"]}`), 0644)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, bar.Name, bar.HostPort)).ShouldNot(Equal(bar.Hash()))
+	g.Expect(InstallHostConfig(root, bar)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, bar.Name, bar.HostPort)).Should(Equal(bar.Hash()))
+
+	// only the entries added by the operator are removed
+	g.Expect(RemoveHostConfig(root, bar.Name, bar.HostPort)).ShouldNot(HaveOccurred())
+	config = readTestDaemonJSON(g, root)
+	g.Expect(config["log-driver"]).Should(Equal("journald"))
+	g.Expect(config["insecure-registries"]).Should(ConsistOf("admin.suse.de:5000"))
+	g.Expect(filepath.Join(root, DockerDaemonJSONState)).ShouldNot(BeAnExistingFile())
+}
+
+func TestDaemonJSONMirrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// Docker only supports mirrors for Docker Hub
+	cfg := HostConfig{Name: "hub", HostPort: "docker.io", Mirrors: []string{"mirror.suse.de:5000"}}
+	g.Expect(cfg.daemonJSONEntries()).Should(Equal(map[string][]string{
+		"registry-mirrors": {"https://mirror.suse.de:5000"},
+	}))
+
+	cfg.HostPort = "registry.suse.de:5000"
+	g.Expect(cfg.daemonJSONEntries()).Should(BeEmpty())
+}
+
+func TestDaemonJSONInvalid(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	daemonJSON := filepath.Join(root, DockerDaemonJSON)
+	g.Expect(os.MkdirAll(filepath.Dir(daemonJSON), 0755)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(daemonJSON, []byte(`{"log-driver": `), 0644)).ShouldNot(HaveOccurred())
+
+	// a daemon.json we cannot parse is never overwritten
+	cfg := HostConfig{Name: "foo", HostPort: "registry.suse.de:5000", CA: []byte("some certificate"), Insecure: true}
+	g.Expect(InstallHostConfig(root, cfg)).Should(HaveOccurred())
+	g.Expect(ioutil.ReadFile(daemonJSON)).Should(Equal([]byte(`{"log-driver": `)))
+	g.Expect(filepath.Join(root, DockerCertsDir, cfg.HostPort)).ShouldNot(BeADirectory())
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// RuntimeTargetsLabel is a label for overriding the runtime targets detected
+	// in a Node, with a list of targets separated by "_" (ie, "docker_containerd")
+	RuntimeTargetsLabel = "registries.kubic.opensuse.org/runtime-targets"
+
+	// runtimeTargetsLabelSeparator is the separator of the targets in the RuntimeTargetsLabel
+	// (label values cannot contain commas)
+	runtimeTargetsLabelSeparator = "_"
+)
+
+// runtimesTargets are the runtime targets for the container runtimes reported
+// in `Node.Status.NodeInfo.ContainerRuntimeVersion` (ie, "docker://18.6.1")
+var runtimesTargets = map[string]string{
+	"docker":     TargetDocker,
+	"containerd": TargetContainerd,
+	"cri-o":      TargetPodman,
+}
+
+// runtimesSockets are the API sockets of the container runtimes (relative to the
+// root filesystem), used for detecting the runtimes running in a Node
+var runtimesSockets = map[string][]string{
+	"docker":     {"run/docker.sock", "var/run/docker.sock"},
+	"containerd": {"run/containerd/containerd.sock", "var/run/containerd/containerd.sock"},
+	"cri-o":      {"run/crio/crio.sock", "var/run/crio/crio.sock"},
+}
+
+// DetectRuntimes returns the (sorted) container runtimes whose sockets are found
+// in the root filesystem `root` (nil when none is found)
+func DetectRuntimes(root string) []string {
+	var res []string
+	for runtime, sockets := range runtimesSockets {
+		for _, socket := range sockets {
+			if _, err := os.Stat(filepath.Join(root, socket)); err == nil {
+				res = append(res, runtime)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// TargetsForContainerRuntime returns the runtime targets for the container
+// runtime `version` (as reported in the Node status), or nil when it is unknown
+func TargetsForContainerRuntime(version string) []string {
+	runtime := strings.ToLower(strings.SplitN(version, "://", 2)[0])
+	if target, found := runtimesTargets[runtime]; found {
+		return []string{target}
+	}
+	return nil
+}
+
+// TargetsForNode returns the runtime targets for the Node `n`, from (in order of preference):
+//
+// * the RuntimeTargetsLabel label in the Node
+// * the `defaults` (when not empty)
+// * the container runtime of the Node
+//
+// A nil result means all the targets.
+func TargetsForNode(n *corev1.Node, defaults []string) []string {
+	if value, found := n.Labels[RuntimeTargetsLabel]; found && len(value) > 0 {
+		targets := strings.Split(value, runtimeTargetsLabelSeparator)
+		if err := ValidateRuntimeTargets(targets); err == nil {
+			return targets
+		}
+		glog.V(1).Infof("[kubic] ERROR: ignoring invalid %s label in node %s: '%s'", RuntimeTargetsLabel, n.Name, value)
+	}
+
+	if len(defaults) > 0 {
+		return defaults
+	}
+
+	targets := TargetsForContainerRuntime(n.Status.NodeInfo.ContainerRuntimeVersion)
+	glog.V(5).Infof("[kubic] runtime targets for node %s: %v", n.Name, targets)
+	return targets
+}
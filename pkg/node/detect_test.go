@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTargetsForNode(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(TargetsForContainerRuntime("docker://18.6.1")).Should(Equal([]string{TargetDocker}))
+	g.Expect(TargetsForContainerRuntime("containerd://1.2.0")).Should(Equal([]string{TargetContainerd}))
+	g.Expect(TargetsForContainerRuntime("cri-o://1.13.0")).Should(Equal([]string{TargetPodman}))
+	g.Expect(TargetsForContainerRuntime("rkt://1.30.0")).Should(BeNil())
+	g.Expect(TargetsForContainerRuntime("")).Should(BeNil())
+
+	n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0", Labels: map[string]string{}}}
+	n.Status.NodeInfo.ContainerRuntimeVersion = "docker://18.6.1"
+	g.Expect(TargetsForNode(n, nil)).Should(Equal([]string{TargetDocker}))
+
+	// the defaults take precedence over the detection...
+	g.Expect(TargetsForNode(n, []string{TargetPodman})).Should(Equal([]string{TargetPodman}))
+
+	// ... and the label over everything (ie, in the middle of a migration to containerd)
+	n.Labels[RuntimeTargetsLabel] = "docker_containerd"
+	g.Expect(TargetsForNode(n, []string{TargetPodman})).Should(Equal([]string{TargetDocker, TargetContainerd}))
+
+	// invalid labels are ignored
+	n.Labels[RuntimeTargetsLabel] = "rkt"
+	g.Expect(TargetsForNode(n, nil)).Should(Equal([]string{TargetDocker}))
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	kubicv1beta1 "github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+const (
+	// SecretCAKey is the key for the CA.crt in the certificate Secret
+	SecretCAKey = "ca.crt"
+
+	// SecretClientCertKey is the key for the (optional) client certificate in the certificate Secret
+	SecretClientCertKey = corev1.TLSCertKey
+
+	// SecretClientKeyKey is the key for the (optional) client key in the certificate Secret
+	SecretClientKeyKey = corev1.TLSPrivateKeyKey
+
+	// names of the client certificate and key installed for a registry
+	clientCertFileName = "client.cert"
+	clientKeyFileName  = "client.key"
+
+	// hostsFileName is the containerd configuration file for a registry
+	hostsFileName = "hosts.toml"
+)
+
+// HostConfig is the configuration installed in the Nodes for a registry
+type HostConfig struct {
+	// Name is the name of the Registry
+	Name string
+
+	// HostPort is the registry HOST:PORT address
+	HostPort string
+
+	// CA is the CA.crt for the registry
+	CA []byte
+
+	// ClientCert and ClientKey are the (optional) client certificate and key
+	// used for authenticating with the registry
+	ClientCert []byte
+	ClientKey  []byte
+
+	// Insecure disables the verification of the registry certificate
+	Insecure bool
+
+	// Mirrors are the HOST:PORT addresses of the mirrors of the registry
+	// (Docker only supports mirrors for Docker Hub)
+	Mirrors []string
+
+	// Blocked forbids pulling images from the registry (only supported by CRI-O and podman)
+	Blocked bool
+
+	// SystemTrust installs the CA.crt in the system trust store too
+	SystemTrust bool
+
+	// TrustStore is the system trust store of the Node (see TrustStores)
+	TrustStore string
+
+	// Targets are the names of the runtime targets where the configuration
+	// is installed (all the targets registered when empty)
+	Targets []string
+}
+
+// NewHostConfig returns the configuration for `registry`, with the certificates in `secret`
+func NewHostConfig(registry *kubicv1beta1.Registry, secret *corev1.Secret) HostConfig {
+	return HostConfig{
+		Name:        registry.Name,
+		HostPort:    registry.Spec.HostPort,
+		CA:          secret.Data[SecretCAKey],
+		ClientCert:  secret.Data[SecretClientCertKey],
+		ClientKey:   secret.Data[SecretClientKeyKey],
+		Insecure:    registry.Spec.Insecure,
+		Mirrors:     registry.Spec.Mirrors,
+		Blocked:     registry.Spec.Blocked,
+		SystemTrust: registry.Spec.SystemTrust,
+	}
+}
+
+// Validate checks the configuration is valid
+func (cfg HostConfig) Validate() error {
+	if err := ValidateHostPort(cfg.HostPort); err != nil {
+		return err
+	}
+	if len(cfg.CA) == 0 {
+		return fmt.Errorf("no CA.crt provided for %s", cfg.HostPort)
+	}
+	if (len(cfg.ClientCert) == 0) != (len(cfg.ClientKey) == 0) {
+		return fmt.Errorf("both a client certificate and a key must be provided for %s", cfg.HostPort)
+	}
+	for _, mirror := range cfg.Mirrors {
+		if err := ValidateHostPort(mirror); err != nil {
+			return fmt.Errorf("invalid mirror for %s: %s", cfg.HostPort, err)
+		}
+	}
+	if cfg.needsRegistriesConf() || cfg.SystemTrust {
+		if err := ValidateName(cfg.Name); err != nil {
+			return err
+		}
+	}
+	if err := ValidateRuntimeTargets(cfg.Targets); err != nil {
+		return err
+	}
+	if cfg.SystemTrust {
+		if _, found := TrustStores[cfg.TrustStore]; !found {
+			return fmt.Errorf("no supported system trust store for %s in this node", cfg.HostPort)
+		}
+	}
+	return nil
+}
+
+// files returns the files installed for the registry in the certificates directory `certsDir`
+func (cfg HostConfig) files(certsDir string) map[string][]byte {
+	files := map[string][]byte{caFileName: cfg.CA}
+	if len(cfg.ClientCert) > 0 {
+		files[clientCertFileName] = cfg.ClientCert
+		files[clientKeyFileName] = cfg.ClientKey
+	}
+	if certsDir == ContainerdCertsDir {
+		files[hostsFileName] = cfg.containerdHosts()
+	}
+	return files
+}
+
+// containerdHosts returns the containerd `hosts.toml` for the registry
+// (see https://github.com/containerd/containerd/blob/main/docs/hosts.md)
+func (cfg HostConfig) containerdHosts() []byte {
+	dir := filepath.Join(ContainerdCertsDir, cfg.HostPort)
+
+	// the TLS settings, for the registry and its mirrors
+	tls := &bytes.Buffer{}
+	fmt.Fprintf(tls, "ca = %q\n", filepath.Join(dir, caFileName))
+	if len(cfg.ClientCert) > 0 {
+		fmt.Fprintf(tls, "client = [[%q, %q]]\n",
+			filepath.Join(dir, clientCertFileName), filepath.Join(dir, clientKeyFileName))
+	}
+	if cfg.Insecure {
+		fmt.Fprintf(tls, "skip_verify = true\n")
+	}
+
+	res := &bytes.Buffer{}
+	fmt.Fprintf(res, "server = %q\n", "https://"+cfg.HostPort)
+	res.Write(tls.Bytes())
+
+	// the mirrors are tried (in order) before the registry
+	for _, mirror := range cfg.Mirrors {
+		fmt.Fprintf(res, "\n[host.%q]\n", "https://"+mirror)
+		fmt.Fprintf(res, "capabilities = [\"pull\", \"resolve\"]\n")
+		res.Write(tls.Bytes())
+	}
+	return res.Bytes()
+}
+
+// Hash returns a hash of all the files installed for the registry in its runtime
+// targets (so any change in the configuration leads to a different hash)
+func (cfg HostConfig) Hash() string {
+	dirs, err := cfg.plan()
+	if err != nil {
+		return ""
+	}
+	return hashDirs(dirs)
+}
+
+// Covers returns true when the files installed for the registry with `cfg` include
+// all the files (with the same contents) that would be installed with `other`
+func (cfg HostConfig) Covers(other HostConfig) bool {
+	dirs, err := cfg.plan()
+	if err != nil {
+		return false
+	}
+	otherDirs, err := other.plan()
+	if err != nil {
+		return false
+	}
+
+	for location, otherFiles := range otherDirs {
+		files, found := dirs[location]
+		if !found {
+			return false
+		}
+		for name, contents := range otherFiles {
+			if installed, found := files[name]; !found || !bytes.Equal(installed, contents) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// plan returns all the files installed for the registry in its runtime targets
+func (cfg HostConfig) plan() (TargetFiles, error) {
+	targets, err := getRuntimeTargets(cfg.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := TargetFiles{}
+	for _, target := range targets {
+		for location, files := range target.Plan(cfg) {
+			dirs[location] = files
+		}
+	}
+	if cfg.SystemTrust {
+		// the trust store is not part of the hash, as it depends on the Node
+		dirs[trustStoreHashKey] = map[string][]byte{caFileName: cfg.CA}
+	}
+	return dirs, nil
+}
+
+// hashDirs returns a hash for the files in some certificates directories
+func hashDirs(dirs map[string]map[string][]byte) string {
+	h := &bytes.Buffer{}
+
+	certsDirs := []string{}
+	for certsDir := range dirs {
+		certsDirs = append(certsDirs, certsDir)
+	}
+	sort.Strings(certsDirs)
+
+	for _, certsDir := range certsDirs {
+		names := []string{}
+		for name := range dirs[certsDir] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			contents := dirs[certsDir][name]
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00", filepath.Clean(certsDir), name, len(contents))
+			h.Write(contents)
+		}
+	}
+	return kubicutil.CertificateHash(h.Bytes())
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestContainerdHosts(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cfg := HostConfig{HostPort: "registry.suse.de:5000", CA: []byte("some certificate")}
+	g.Expect(string(cfg.containerdHosts())).Should(Equal(`server = "https://registry.suse.de:5000"
+ca = "/etc/containerd/certs.d/registry.suse.de:5000/ca.crt"
+`))
+
+	cfg.ClientCert = []byte("client certificate")
+	cfg.ClientKey = []byte("client key")
+	cfg.Insecure = true
+	cfg.Mirrors = []string{"mirror.suse.de:5000"}
+	g.Expect(string(cfg.containerdHosts())).Should(Equal(`server = "https://registry.suse.de:5000"
+ca = "/etc/containerd/certs.d/registry.suse.de:5000/ca.crt"
+client = [["/etc/containerd/certs.d/registry.suse.de:5000/client.cert", "/etc/containerd/certs.d/registry.suse.de:5000/client.key"]]
+skip_verify = true
+
+[host."https://mirror.suse.de:5000"]
+capabilities = ["pull", "resolve"]
+ca = "/etc/containerd/certs.d/registry.suse.de:5000/ca.crt"
+client = [["/etc/containerd/certs.d/registry.suse.de:5000/client.cert", "/etc/containerd/certs.d/registry.suse.de:5000/client.key"]]
+skip_verify = true
+`))
+}
+
+func TestInstallHostConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	cfg := HostConfig{
+		HostPort:   "registry.suse.de:5000",
+		CA:         []byte("some certificate"),
+		ClientCert: []byte("client certificate"),
+		ClientKey:  []byte("client key"),
+	}
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+
+	// the client certificates are installed for all the runtimes...
+	for _, certsDir := range CertsDirs {
+		dir := filepath.Join(root, certsDir, cfg.HostPort)
+		g.Expect(ioutil.ReadFile(filepath.Join(dir, "client.cert"))).Should(Equal(cfg.ClientCert))
+		g.Expect(ioutil.ReadFile(filepath.Join(dir, "client.key"))).Should(Equal(cfg.ClientKey))
+	}
+
+	// ... but the hosts.toml is only for containerd
+	g.Expect(filepath.Join(root, ContainerdCertsDir, cfg.HostPort, "hosts.toml")).Should(BeAnExistingFile())
+	g.Expect(filepath.Join(root, DockerCertsDir, cfg.HostPort, "hosts.toml")).ShouldNot(BeAnExistingFile())
+
+	// any change in the configuration changes the hash
+	insecure := cfg
+	insecure.Insecure = true
+	g.Expect(insecure.Hash()).ShouldNot(Equal(cfg.Hash()))
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).ShouldNot(Equal(insecure.Hash()))
+
+	// invalid configurations are rejected
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: cfg.HostPort})).Should(HaveOccurred())
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: cfg.HostPort, CA: cfg.CA, ClientCert: cfg.ClientCert})).Should(HaveOccurred())
+	g.Expect(InstallHostConfig(root, HostConfig{HostPort: cfg.HostPort, CA: cfg.CA, Mirrors: []string{"../mirror"}})).Should(HaveOccurred())
+}
+
+func TestHostConfigCovers(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	legacy := HostConfig{
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Targets:  []string{TargetDocker, TargetPodman},
+	}
+
+	// the same CA.crt, installed for a subset of the targets
+	docker := legacy
+	docker.Name = "suse"
+	docker.Targets = []string{TargetDocker}
+	g.Expect(legacy.Covers(docker)).Should(BeTrue())
+	g.Expect(docker.Covers(legacy)).Should(BeFalse())
+
+	// files that are not in the legacy configuration
+	containerd := docker
+	containerd.Targets = []string{TargetDocker, TargetContainerd}
+	g.Expect(legacy.Covers(containerd)).Should(BeFalse())
+
+	client := docker
+	client.ClientCert = []byte("client certificate")
+	client.ClientKey = []byte("client key")
+	g.Expect(legacy.Covers(client)).Should(BeFalse())
+
+	// different contents
+	other := docker
+	other.CA = []byte("other certificate")
+	g.Expect(legacy.Covers(other)).Should(BeFalse())
+}
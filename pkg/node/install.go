@@ -0,0 +1,253 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// InstallSpec is the specification of the certificate installation (or removal)
+// for a registry in a Node (passed as JSON to the `node install|remove` commands)
+type InstallSpec struct {
+	// Name is the name of the Registry
+	Name string `json:"name,omitempty"`
+
+	// HostPort is the registry HOST:PORT address
+	HostPort string `json:"hostPort"`
+
+	// CAFile is the CA.crt to install (only for installations)
+	CAFile string `json:"caFile,omitempty"`
+
+	// ClientCertFile and ClientKeyFile are the (optional) client certificate
+	// and key to install (only for installations)
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+
+	// Insecure disables the verification of the registry certificate (only for installations)
+	Insecure bool `json:"insecure,omitempty"`
+
+	// Mirrors are the mirrors of the registry (only for installations)
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// Blocked forbids pulling images from the registry (only for installations)
+	Blocked bool `json:"blocked,omitempty"`
+
+	// SystemTrust installs the CA.crt in the system trust store too (only for installations)
+	SystemTrust bool `json:"systemTrust,omitempty"`
+
+	// TrustStore is the system trust store of the Node (see TrustStores)
+	TrustStore string `json:"trustStore,omitempty"`
+
+	// Targets are the runtime targets where the configuration is installed
+	// (all the targets when empty)
+	Targets []string `json:"targets,omitempty"`
+
+	// RuntimeReload is the policy for reloading the runtimes after the changes
+	RuntimeReload ReloadPolicy `json:"runtimeReload,omitempty"`
+
+	// Probe probes the registry from the Node once installed (only for `node converge`)
+	Probe bool `json:"probe,omitempty"`
+}
+
+// ValidateHostPort checks `hostPort` is a valid registry address, so it is safe to
+// use it as a directory name (ie, "registry.suse.de:5000")
+func ValidateHostPort(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// no port specified
+		host, port = hostPort, ""
+	}
+
+	if net.ParseIP(host) == nil {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(errs) > 0 {
+			return fmt.Errorf("invalid registry host '%s': %v", host, errs)
+		}
+	}
+
+	if len(port) > 0 {
+		if p, err := strconv.Atoi(port); err != nil || len(validation.IsValidPortNum(p)) > 0 {
+			return fmt.Errorf("invalid registry port '%s'", port)
+		}
+	}
+
+	return nil
+}
+
+// ValidateName checks `name` is a valid Registry name, so it is safe to use it as a file name
+func ValidateName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("no registry name provided")
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid registry name '%s': %v", name, errs)
+	}
+	return nil
+}
+
+// Validate checks the spec is valid
+func (spec InstallSpec) Validate() error {
+	if len(spec.HostPort) == 0 {
+		return fmt.Errorf("no registry address provided")
+	}
+	if len(spec.Name) > 0 {
+		if err := ValidateName(spec.Name); err != nil {
+			return err
+		}
+	}
+	for _, mirror := range spec.Mirrors {
+		if err := ValidateHostPort(mirror); err != nil {
+			return fmt.Errorf("invalid mirror for %s: %s", spec.HostPort, err)
+		}
+	}
+	if err := ValidateReloadPolicy(spec.RuntimeReload); err != nil {
+		return err
+	}
+	if err := ValidateRuntimeTargets(spec.Targets); err != nil {
+		return err
+	}
+	return ValidateHostPort(spec.HostPort)
+}
+
+// InstallResult is the result of installing (or removing) the configuration of a
+// registry in a Node (reported by the `node install|remove` commands to the controller)
+type InstallResult struct {
+	// Node is the name of the Node where the configuration was installed
+	Node string `json:"node"`
+
+	// HostPort is the address of the registry
+	HostPort string `json:"hostPort"`
+
+	// Hash is the hash of the configuration found in the Node after the
+	// change (empty when it is not installed)
+	Hash string `json:"hash,omitempty"`
+
+	// ExpectedHash is the hash of the configuration we tried to install
+	// (only for installations)
+	ExpectedHash string `json:"expectedHash,omitempty"`
+
+	// Runtimes are the container runtimes detected in the Node
+	Runtimes []string `json:"runtimes,omitempty"`
+
+	// Targets are the runtime targets configured (all the targets when empty)
+	Targets []string `json:"targets,omitempty"`
+
+	// Files are the files (and directories) written in the Node
+	Files []string `json:"files,omitempty"`
+
+	// Error is the error found when installing the configuration
+	Error string `json:"error,omitempty"`
+}
+
+// newInstallResult returns the result for `spec` in the root filesystem `root`
+// after a change that wrote `files` and returned `err`
+func newInstallResult(root string, nodeName string, spec InstallSpec, files []string, err error) InstallResult {
+	res := InstallResult{
+		Node:     nodeName,
+		HostPort: spec.HostPort,
+		Hash:     InstalledHash(root, spec.Name, spec.HostPort, spec.Targets...),
+		Runtimes: DetectRuntimes(root),
+		Targets:  spec.Targets,
+		Files:    files,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Install installs the CA.crt (and the rest of the configuration) in `spec`
+// in the root filesystem `root` of the Node `nodeName`. The result is
+// returned even when the installation fails.
+func Install(root string, nodeName string, spec InstallSpec) (InstallResult, error) {
+	if err := spec.Validate(); err != nil {
+		return InstallResult{Node: nodeName, HostPort: spec.HostPort, Error: err.Error()}, err
+	}
+	cfg, err := spec.hostConfig()
+	if err != nil {
+		return newInstallResult(root, nodeName, spec, nil, err), err
+	}
+
+	glog.V(1).Infof("[kubic] installing CA.crt for %s", spec.HostPort)
+	before := RuntimeConfigs(root, spec.Name, spec.HostPort)
+	files, err := installHostConfig(root, cfg)
+	if err == nil {
+		err = ReloadRuntimes(root, spec.RuntimeReload, spec.Name, spec.HostPort, before)
+	}
+
+	res := newInstallResult(root, nodeName, spec, files, err)
+	res.ExpectedHash = cfg.Hash()
+	return res, err
+}
+
+// hostConfig returns the configuration for the registry in `spec`, reading
+// the certificates from their files
+func (spec InstallSpec) hostConfig() (HostConfig, error) {
+	if len(spec.CAFile) == 0 {
+		return HostConfig{}, fmt.Errorf("no CA.crt provided for %s", spec.HostPort)
+	}
+
+	cfg := HostConfig{
+		Name:        spec.Name,
+		HostPort:    spec.HostPort,
+		Insecure:    spec.Insecure,
+		Mirrors:     spec.Mirrors,
+		Blocked:     spec.Blocked,
+		SystemTrust: spec.SystemTrust,
+		TrustStore:  spec.TrustStore,
+		Targets:     spec.Targets,
+	}
+
+	var err error
+	if cfg.CA, err = ioutil.ReadFile(spec.CAFile); err != nil {
+		return HostConfig{}, err
+	}
+	if len(spec.ClientCertFile) > 0 {
+		if cfg.ClientCert, err = ioutil.ReadFile(spec.ClientCertFile); err != nil {
+			return HostConfig{}, err
+		}
+	}
+	if len(spec.ClientKeyFile) > 0 {
+		if cfg.ClientKey, err = ioutil.ReadFile(spec.ClientKeyFile); err != nil {
+			return HostConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// Remove removes the CA.crt for the registry in `spec` from the root filesystem
+// `root` of the Node `nodeName`. The result is returned even when the removal fails.
+func Remove(root string, nodeName string, spec InstallSpec) (InstallResult, error) {
+	if err := spec.Validate(); err != nil {
+		return InstallResult{Node: nodeName, HostPort: spec.HostPort, Error: err.Error()}, err
+	}
+
+	glog.V(1).Infof("[kubic] removing CA.crt for %s", spec.HostPort)
+	before := RuntimeConfigs(root, spec.Name, spec.HostPort)
+	files, err := removeHostConfig(root, spec.Name, spec.HostPort)
+	if err == nil {
+		err = ReloadRuntimes(root, spec.RuntimeReload, spec.Name, spec.HostPort, before)
+	}
+	return newInstallResult(root, nodeName, spec, files, err), err
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestValidateHostPort(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	for _, hostPort := range []string{
+		"registry.suse.de",
+		"registry.suse.de:5000",
+		"Registry.SUSE.de:5000",
+		"10.0.0.1:5000",
+		"[fd00::1]:5000",
+	} {
+		g.Expect(ValidateHostPort(hostPort)).ShouldNot(HaveOccurred(), hostPort)
+	}
+
+	for _, hostPort := range []string{
+		"",
+		"registry.suse.de:port",
+		"registry.suse.de:99999",
+		"../../etc",
+		"registry.suse.de/../../etc:5000",
+		"registry.suse.de:5000'; rm -rf /; '",
+		"$(reboot):5000",
+	} {
+		g.Expect(ValidateHostPort(hostPort)).Should(HaveOccurred(), hostPort)
+	}
+}
+
+func TestInstallAndRemove(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	caFile := filepath.Join(root, "ca.crt")
+	g.Expect(ioutil.WriteFile(caFile, []byte("some certificate"), 0644)).ShouldNot(HaveOccurred())
+
+	// a fake docker running in the node
+	g.Expect(os.MkdirAll(filepath.Join(root, "run"), 0755)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(filepath.Join(root, "run", "docker.sock"), nil, 0644)).ShouldNot(HaveOccurred())
+
+	spec := InstallSpec{HostPort: "registry.suse.de:5000", CAFile: caFile}
+	res, err := Install(root, "node0", spec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	for _, path := range CertificatePaths(root, spec.HostPort) {
+		g.Expect(ioutil.ReadFile(path)).Should(Equal([]byte("some certificate")))
+	}
+
+	// the result reports what has been done in the node
+	g.Expect(res.Node).Should(Equal("node0"))
+	g.Expect(res.Error).Should(BeEmpty())
+	g.Expect(res.Hash).ShouldNot(BeEmpty())
+	g.Expect(res.Hash).Should(Equal(res.ExpectedHash))
+	g.Expect(res.Runtimes).Should(Equal([]string{"docker"}))
+	g.Expect(res.Files).Should(ContainElement(filepath.Join(DockerCertsDir, spec.HostPort)))
+
+	res, err = Remove(root, "node0", InstallSpec{HostPort: spec.HostPort})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res.Hash).Should(BeEmpty())
+	g.Expect(res.Files).Should(HaveLen(len(CertsDirs)))
+	g.Expect(InstalledHash(root, spec.Name, spec.HostPort)).Should(BeEmpty())
+
+	// nothing can be installed outside the certificates directories
+	res, err = Install(root, "node0", InstallSpec{HostPort: "../../registry.suse.de", CAFile: caFile})
+	g.Expect(err).Should(HaveOccurred())
+	g.Expect(res.Error).Should(Equal(err.Error()))
+	g.Expect(filepath.Join(root, "etc", "registry.suse.de")).ShouldNot(BeADirectory())
+
+	// an installation without a CA.crt is an error
+	_, err = Install(root, "node0", InstallSpec{HostPort: spec.HostPort})
+	g.Expect(err).Should(HaveOccurred())
+	res, err = Install(root, "node0", InstallSpec{HostPort: spec.HostPort, CAFile: filepath.Join(root, "missing")})
+	g.Expect(err).Should(HaveOccurred())
+	g.Expect(res.Error).ShouldNot(BeEmpty())
+}
+
+func TestVerify(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	caFile := filepath.Join(root, "ca.crt")
+	g.Expect(ioutil.WriteFile(caFile, []byte("some certificate"), 0644)).ShouldNot(HaveOccurred())
+
+	spec := InstallSpec{HostPort: "registry.suse.de:5000", CAFile: caFile}
+	_, err = Install(root, "node0", spec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	res, err := Verify(root, "node0", spec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res.Node).Should(Equal("node0"))
+	g.Expect(res.Hash).Should(Equal(HostConfig{HostPort: spec.HostPort, CA: []byte("some certificate")}.Hash()))
+
+	// a CA.crt removed by hand is detected
+	g.Expect(os.Remove(CertificatePaths(root, spec.HostPort)[0])).ShouldNot(HaveOccurred())
+	res, err = Verify(root, "node0", spec)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(res.Hash).Should(BeEmpty())
+
+	_, err = Verify(root, "node0", InstallSpec{HostPort: "../../registry.suse.de"})
+	g.Expect(err).Should(HaveOccurred())
+}
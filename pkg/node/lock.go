@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// LockDir is the directory of the node lock file. It is in a runtime-neutral
+	// location, so no directories of runtimes that are not in the node are created.
+	LockDir = "/run/kubic-registries"
+
+	// nodeLockFile is the file locked while the configuration of the node is modified,
+	// as the installers for different registries can run at the same time and some
+	// files (ie, daemon.json) are shared between registries.
+	nodeLockFile = LockDir + "/node.lock"
+)
+
+// lockNode takes an exclusive lock on the node configuration, returning
+// the function that releases it
+func lockNode(root string) (func(), error) {
+	path := filepath.Join(root, nodeLockFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.V(5).Infof("[kubic] locking %s", path)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
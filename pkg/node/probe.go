@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+
+	kubicutil "github.com/kubic-project/registries-operator/pkg/util"
+)
+
+// ProbeResult is the result of probing a registry from a Node
+type ProbeResult struct {
+	// Node is the name of the Node where the probe was run
+	Node string `json:"node"`
+
+	// HostPort is the address of the registry
+	HostPort string `json:"hostPort"`
+
+	// Reachable is true when the TLS handshake with the registry succeeded
+	Reachable bool `json:"reachable"`
+
+	// Error is the error found when probing the registry
+	Error string `json:"error,omitempty"`
+}
+
+// Probe performs a TLS handshake with the registry at `hostPort`,
+// verifying it with the CA.crt installed at `caFile`
+func Probe(nodeName string, hostPort string, caFile string, timeout time.Duration) ProbeResult {
+	res := ProbeResult{
+		Node:     nodeName,
+		HostPort: hostPort,
+	}
+
+	crt, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		glog.V(1).Infof("[kubic] ERROR: could not read CA.crt at %s: %s", caFile, err)
+		res.Error = err.Error()
+		return res
+	}
+
+	glog.V(3).Infof("[kubic] probing %s with the CA.crt at %s", hostPort, caFile)
+	if err := kubicutil.VerifyTLS(hostPort, crt, timeout); err != nil {
+		glog.V(1).Infof("[kubic] ERROR: could not verify %s: %s", hostPort, err)
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Reachable = true
+	return res
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestProbe(t *testing.T) {
+
+	g := NewGomegaWithT(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	hostPort := strings.TrimPrefix(server.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "node-probe")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	g.Expect(ioutil.WriteFile(caFile, crt, 0644)).ShouldNot(HaveOccurred())
+
+	res := Probe("node0", hostPort, caFile, time.Second)
+	g.Expect(res.Reachable).Should(BeTrue())
+	g.Expect(res.Node).Should(Equal("node0"))
+
+	//the CA.crt has not been installed
+	res = Probe("node0", hostPort, filepath.Join(dir, "missing.crt"), time.Second)
+	g.Expect(res.Reachable).Should(BeFalse())
+	g.Expect(res.Error).ShouldNot(BeEmpty())
+
+	//the result can be written and read as a termination message
+	msgFile := filepath.Join(dir, "termination-log")
+	g.Expect(WriteTerminationMessage(msgFile, res)).ShouldNot(HaveOccurred())
+	msg, err := ioutil.ReadFile(msgFile)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	read := ProbeResult{}
+	g.Expect(ReadTerminationMessage(string(msg), &read)).ShouldNot(HaveOccurred())
+	g.Expect(read).Should(Equal(res))
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// RegistriesConfDir is the drop-in directory for the CRI-O and podman
+	// registries configuration (the main registries.conf is never modified)
+	RegistriesConfDir = "/etc/containers/registries.conf.d/"
+
+	// a prefix for the drop-in files installed by the operator
+	registriesConfPrefix = "kubic-registry-"
+)
+
+// RegistriesConfPath returns the path of the drop-in for the Registry `name`,
+// relative to the root filesystem `root`
+func RegistriesConfPath(root string, name string) string {
+	return filepath.Join(root, RegistriesConfDir, registriesConfPrefix+name+".conf")
+}
+
+// needsRegistriesConf returns true when the registry needs a drop-in (the
+// CA.crt and client certificates are found in the certificates directories)
+func (cfg HostConfig) needsRegistriesConf() bool {
+	return cfg.Insecure || cfg.Blocked || len(cfg.Mirrors) > 0
+}
+
+// registriesConf returns the drop-in for the registry, in the registries.conf v2 format
+// (see https://github.com/containers/image/blob/main/docs/containers-registries.conf.5.md)
+func (cfg HostConfig) registriesConf() []byte {
+	res := &bytes.Buffer{}
+	fmt.Fprintf(res, "# generated by the registries operator for the Registry %q: do not edit\n", cfg.Name)
+	fmt.Fprintf(res, "[[registry]]\n")
+	fmt.Fprintf(res, "prefix = %q\n", cfg.HostPort)
+	fmt.Fprintf(res, "location = %q\n", cfg.HostPort)
+	if cfg.Insecure {
+		fmt.Fprintf(res, "insecure = true\n")
+	}
+	if cfg.Blocked {
+		fmt.Fprintf(res, "blocked = true\n")
+	}
+
+	for _, mirror := range cfg.Mirrors {
+		fmt.Fprintf(res, "\n[[registry.mirror]]\n")
+		fmt.Fprintf(res, "location = %q\n", mirror)
+		if cfg.Insecure {
+			fmt.Fprintf(res, "insecure = true\n")
+		}
+	}
+	return res.Bytes()
+}
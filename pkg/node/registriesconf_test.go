@@ -0,0 +1,110 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRegistriesConf(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	cfg := HostConfig{
+		Name:     "suse-registry",
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Insecure: true,
+		Blocked:  true,
+		Mirrors:  []string{"mirror.suse.de:5000"},
+	}
+	g.Expect(string(cfg.registriesConf())).Should(Equal(`# generated by the registries operator for the Registry "suse-registry": do not edit
+[[registry]]
+prefix = "registry.suse.de:5000"
+location = "registry.suse.de:5000"
+insecure = true
+blocked = true
+
+[[registry.mirror]]
+location = "mirror.suse.de:5000"
+insecure = true
+`))
+}
+
+func TestInstallRegistriesConf(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	// some files that are not managed by the operator
+	mainConf := filepath.Join(root, "/etc/containers/registries.conf")
+	otherConf := filepath.Join(root, RegistriesConfDir, "other.conf")
+	g.Expect(os.MkdirAll(filepath.Dir(otherConf), 0755)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(mainConf, []byte("main"), 0644)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.WriteFile(otherConf, []byte("other"), 0644)).ShouldNot(HaveOccurred())
+
+	cfg := HostConfig{
+		Name:     "suse-registry",
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+	}
+	path := RegistriesConfPath(root, cfg.Name)
+
+	// no drop-in is necessary for just a CA.crt
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(path).ShouldNot(BeAnExistingFile())
+
+	cfg.Mirrors = []string{"mirror.suse.de:5000"}
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(path)).Should(Equal(cfg.registriesConf()))
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+
+	// a modified drop-in is detected
+	g.Expect(ioutil.WriteFile(path, []byte("modified"), 0644)).ShouldNot(HaveOccurred())
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).ShouldNot(Equal(cfg.Hash()))
+
+	// the drop-in is removed once it is not necessary
+	cfg.Mirrors = nil
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(path).ShouldNot(BeAnExistingFile())
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+
+	// ... and when the registry is removed
+	cfg.Blocked = true
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(path).Should(BeAnExistingFile())
+	g.Expect(RemoveHostConfig(root, cfg.Name, cfg.HostPort)).ShouldNot(HaveOccurred())
+	g.Expect(path).ShouldNot(BeAnExistingFile())
+
+	// the files not managed by the operator are never modified
+	g.Expect(ioutil.ReadFile(mainConf)).Should(Equal([]byte("main")))
+	g.Expect(ioutil.ReadFile(otherConf)).Should(Equal([]byte("other")))
+	entries, err := filepath.Glob(filepath.Join(root, RegistriesConfDir, "*.conf"))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(entries).Should(Equal([]string{otherConf}))
+
+	// a drop-in needs a valid registry name
+	cfg.Name = "../registries"
+	g.Expect(InstallHostConfig(root, cfg)).Should(HaveOccurred())
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReloadPolicy is the policy for reloading the container runtimes once
+// their configuration has been modified
+type ReloadPolicy string
+
+const (
+	// ReloadNever never reloads the runtimes (the changes are applied in the next restart)
+	ReloadNever ReloadPolicy = "Never"
+
+	// ReloadOnly reloads the runtimes that support it without a restart (Docker and CRI-O)
+	ReloadOnly ReloadPolicy = "Reload"
+
+	// ReloadRestart reloads the runtimes, restarting the ones that cannot be reloaded (containerd)
+	ReloadRestart ReloadPolicy = "Restart"
+)
+
+// RuntimeHook is the action that makes a runtime pick up its new configuration
+type RuntimeHook struct {
+	// Unit is the systemd unit of the runtime
+	Unit string
+
+	// Restart is true when the runtime must be restarted (instead of reloaded)
+	Restart bool
+
+	// configFile returns the configuration read by the runtime for a registry
+	configFile func(root string, name string, hostPort string) string
+}
+
+// RuntimeHooks are the hooks for the runtimes, in the order they are run
+var RuntimeHooks = []RuntimeHook{
+	{
+		// dockerd reloads the insecure registries and mirrors on a SIGHUP
+		Unit: "docker",
+		configFile: func(root string, name string, hostPort string) string {
+			return filepath.Join(root, DockerDaemonJSON)
+		},
+	},
+	{
+		// CRI-O reloads the registries configuration on a SIGHUP
+		Unit: "crio",
+		configFile: func(root string, name string, hostPort string) string {
+			return RegistriesConfPath(root, name)
+		},
+	},
+	{
+		// containerd does not support reloads (some versions only read the
+		// hosts.toml on startup)
+		Unit:    "containerd",
+		Restart: true,
+		configFile: func(root string, name string, hostPort string) string {
+			return filepath.Join(root, ContainerdCertsDir, hostPort, hostsFileName)
+		},
+	},
+}
+
+var (
+	// runHostCommand runs a command in the host namespaces (it can be replaced in tests)
+	runHostCommand = runInHost
+
+	// runtimeHealthTimeout is the maximum time we wait for a runtime to be active after a reload
+	runtimeHealthTimeout = 60 * time.Second
+
+	// runtimeHealthInterval is the time between checks of the runtime health
+	runtimeHealthInterval = 2 * time.Second
+)
+
+// ValidateReloadPolicy checks `policy` is a known policy (an empty policy means ReloadNever)
+func ValidateReloadPolicy(policy ReloadPolicy) error {
+	switch policy {
+	case "", ReloadNever, ReloadOnly, ReloadRestart:
+		return nil
+	}
+	return fmt.Errorf("unknown reload policy '%s'", policy)
+}
+
+// RuntimeConfigs returns the current configuration read by every runtime for the
+// registry `name` at `hostPort`, so changes can be detected with ReloadRuntimes
+func RuntimeConfigs(root string, name string, hostPort string) map[string][]byte {
+	res := map[string][]byte{}
+	for _, hook := range RuntimeHooks {
+		if contents, err := ioutil.ReadFile(hook.configFile(root, name, hostPort)); err == nil {
+			res[hook.Unit] = contents
+		}
+	}
+	return res
+}
+
+// ReloadRuntimes reloads (or restarts, depending on `policy`) the runtimes whose
+// configuration has changed since `before` (see RuntimeConfigs), and waits until
+// they are active again. Runtimes that are not running in the node are ignored.
+func ReloadRuntimes(root string, policy ReloadPolicy, name string, hostPort string, before map[string][]byte) error {
+	return reloadChangedRuntimes(policy, changedRuntimes(before, RuntimeConfigs(root, name, hostPort)))
+}
+
+// changedRuntimes returns the units of the runtimes whose configuration is
+// different in `before` and `after` (see RuntimeConfigs)
+func changedRuntimes(before map[string][]byte, after map[string][]byte) map[string]bool {
+	res := map[string]bool{}
+	for _, hook := range RuntimeHooks {
+		if !bytes.Equal(before[hook.Unit], after[hook.Unit]) {
+			res[hook.Unit] = true
+		}
+	}
+	return res
+}
+
+// reloadChangedRuntimes reloads (or restarts, depending on `policy`) the runtimes
+// in `changed`, waiting until they are active again
+func reloadChangedRuntimes(policy ReloadPolicy, changed map[string]bool) error {
+	if len(policy) == 0 || policy == ReloadNever {
+		return nil
+	}
+
+	for _, hook := range RuntimeHooks {
+		if !changed[hook.Unit] {
+			continue
+		}
+		if hook.Restart && policy != ReloadRestart {
+			glog.V(3).Infof("[kubic] configuration for %s modified: it will be applied when it is restarted", hook.Unit)
+			continue
+		}
+		if !runtimeActive(hook.Unit) {
+			glog.V(5).Infof("[kubic] %s is not running in this node: skipping reload", hook.Unit)
+			continue
+		}
+
+		action := "reload"
+		if hook.Restart {
+			action = "restart"
+		}
+		glog.V(1).Infof("[kubic] configuration for %s modified: %s", hook.Unit, action)
+		if err := runHostCommand([]string{"systemctl", action, hook.Unit}); err != nil {
+			return fmt.Errorf("could not %s %s: %s", action, hook.Unit, err)
+		}
+
+		if err := waitRuntimeActive(hook.Unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runtimeActive returns true if the systemd unit `unit` is active
+func runtimeActive(unit string) bool {
+	return runHostCommand([]string{"systemctl", "is-active", "--quiet", unit}) == nil
+}
+
+// waitRuntimeActive waits until the systemd unit `unit` is active
+func waitRuntimeActive(unit string) error {
+	deadline := time.Now().Add(runtimeHealthTimeout)
+	for {
+		if runtimeActive(unit) {
+			glog.V(3).Infof("[kubic] %s is active", unit)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is not active after %s", unit, runtimeHealthTimeout)
+		}
+		time.Sleep(runtimeHealthInterval)
+	}
+}
+
+// runInHost runs a command in the namespaces of the host (so it can talk to
+// the host's systemd). It needs the host PID namespace and a privileged container.
+func runInHost(command []string) error {
+	return runInRoot("/", append([]string{"nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "--"}, command...))
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestReloadRuntimes(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	// a fake systemd, where only docker and containerd are running
+	active := map[string]bool{"docker": true, "containerd": true}
+	commands := []string{}
+	runHostCommand = func(command []string) error {
+		if len(command) == 4 && command[1] == "is-active" {
+			if active[command[3]] {
+				return nil
+			}
+			return fmt.Errorf("inactive")
+		}
+		commands = append(commands, strings.Join(command, " "))
+		return nil
+	}
+	runtimeHealthInterval = time.Millisecond
+	runtimeHealthTimeout = 10 * time.Millisecond
+	defer func() { runHostCommand = runInHost }()
+
+	cfg := HostConfig{
+		Name:     "suse-registry",
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Insecure: true,
+	}
+
+	// nothing is reloaded with the default policy
+	before := RuntimeConfigs(root, cfg.Name, cfg.HostPort)
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ReloadRuntimes(root, ReloadNever, cfg.Name, cfg.HostPort, before)).ShouldNot(HaveOccurred())
+	g.Expect(commands).Should(BeEmpty())
+
+	// only docker is reloaded (CRI-O is not running and containerd needs a restart)
+	cfg.Insecure = false
+	before = RuntimeConfigs(root, cfg.Name, cfg.HostPort)
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ReloadRuntimes(root, ReloadOnly, cfg.Name, cfg.HostPort, before)).ShouldNot(HaveOccurred())
+	g.Expect(commands).Should(Equal([]string{"systemctl reload docker"}))
+
+	// containerd is restarted with the Restart policy (docker is not
+	// reloaded, as the mirrors are not for Docker Hub)
+	commands = []string{}
+	cfg.Mirrors = []string{"mirror.suse.de:5000"}
+	before = RuntimeConfigs(root, cfg.Name, cfg.HostPort)
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ReloadRuntimes(root, ReloadRestart, cfg.Name, cfg.HostPort, before)).ShouldNot(HaveOccurred())
+	g.Expect(commands).Should(Equal([]string{"systemctl restart containerd"}))
+
+	// nothing is done when nothing has changed
+	commands = []string{}
+	before = RuntimeConfigs(root, cfg.Name, cfg.HostPort)
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ReloadRuntimes(root, ReloadRestart, cfg.Name, cfg.HostPort, before)).ShouldNot(HaveOccurred())
+	g.Expect(commands).Should(BeEmpty())
+
+	// a runtime that does not come back is an error
+	before = RuntimeConfigs(root, cfg.Name, cfg.HostPort)
+	g.Expect(RemoveHostConfig(root, cfg.Name, cfg.HostPort)).ShouldNot(HaveOccurred())
+	runHostCommand = func(command []string) error {
+		if command[1] == "is-active" && len(commands) > 0 {
+			return fmt.Errorf("inactive")
+		}
+		commands = append(commands, strings.Join(command, " "))
+		return nil
+	}
+	g.Expect(ReloadRuntimes(root, ReloadOnly, cfg.Name, cfg.HostPort, before)).Should(HaveOccurred())
+
+	g.Expect(ValidateReloadPolicy("Sometimes")).Should(HaveOccurred())
+}
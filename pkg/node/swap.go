@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// errExchangeNotSupported is returned when two paths cannot be exchanged atomically
+var errExchangeNotSupported = errors.New("atomic exchange not supported")
+
+// dirSwap replaces the contents of a directory: the new files are staged in a
+// temporary directory (next to the final directory, so they are in the same
+// filesystem) and then exchanged atomically with the current directory, keeping
+// the previous version as a backup. The final path exists at any time.
+// The same mechanism is used for replacing single files (see stageFile), where the
+// staged file is renamed over the current one (keeping a hard link as the backup),
+// and for removing directories and files (see stageRemoval).
+type dirSwap struct {
+	// dir is the final directory (or file)
+	dir string
+
+	// staging is the temporary directory with the new contents
+	// (empty when `dir` is removed)
+	staging string
+
+	// backup is where the previous version of `dir` is kept
+	backup string
+
+	// swapped is true once `dir` has been replaced
+	swapped bool
+
+	// hadBackup is true when `dir` existed (and was moved to `backup`)
+	hadBackup bool
+}
+
+// getBackupDir returns the directory where the previous version of `dir` is kept
+func getBackupDir(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".backup")
+}
+
+// stageDir writes `files` in a temporary directory that can be swapped with `dir`
+func stageDir(dir string, files map[string][]byte) (*dirSwap, error) {
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+
+	staging, err := ioutil.TempDir(parent, "."+filepath.Base(dir)+".staging")
+	if err != nil {
+		return nil, err
+	}
+	s := &dirSwap{dir: dir, staging: staging, backup: getBackupDir(dir)}
+
+	if err := os.Chmod(staging, 0755); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+	for name, contents := range files {
+		if err := writeFileSync(filepath.Join(staging, name), contents, 0644); err != nil {
+			s.cleanup()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// stageFile writes `contents` in a temporary file that can be swapped with `path`
+func stageFile(path string, contents []byte) (*dirSwap, error) {
+	parent := filepath.Dir(path)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(parent, "."+filepath.Base(path)+".staging")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	s := &dirSwap{dir: path, staging: f.Name(), backup: getBackupDir(path)}
+	if err := writeFileSync(s.staging, contents, 0644); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+	if err := os.Chmod(s.staging, 0644); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+	return s, nil
+}
+
+// stageRemoval returns a swap that removes `path` (keeping it as a backup)
+func stageRemoval(path string) *dirSwap {
+	return &dirSwap{dir: path, backup: getBackupDir(path)}
+}
+
+// commit swaps the staging directory with the final directory
+func (s *dirSwap) commit() error {
+	if err := os.RemoveAll(s.backup); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if len(s.staging) == 0 {
+			return nil
+		}
+		if err := os.Rename(s.staging, s.dir); err != nil {
+			return err
+		}
+		s.swapped = true
+		return nil
+	}
+
+	glog.V(5).Infof("[kubic] keeping a backup of %s at %s", s.dir, s.backup)
+	switch {
+	case len(s.staging) == 0:
+		if err := os.Rename(s.dir, s.backup); err != nil {
+			return err
+		}
+		s.hadBackup = true
+
+	case !info.IsDir():
+		// the staged file replaces the current one with a single rename
+		if err := os.Link(s.dir, s.backup); err != nil {
+			return err
+		}
+		s.hadBackup = true
+		if err := os.Rename(s.staging, s.dir); err != nil {
+			s.rollback()
+			return err
+		}
+		s.swapped = true
+
+	default:
+		if err := exchangePaths(s.staging, s.dir); err != nil {
+			if err != errExchangeNotSupported {
+				return err
+			}
+			// (the final directory is missing for a moment)
+			glog.V(3).Infof("[kubic] atomic exchange not supported: renaming %s", s.dir)
+			if err := os.Rename(s.dir, s.backup); err != nil {
+				return err
+			}
+			s.hadBackup = true
+			if err := os.Rename(s.staging, s.dir); err != nil {
+				s.rollback()
+				return err
+			}
+			s.swapped = true
+			return nil
+		}
+
+		// the previous version is now in the staging directory
+		s.swapped = true
+		s.hadBackup = true
+		if err := os.Rename(s.staging, s.backup); err != nil {
+			s.rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores the previous version of the final directory
+func (s *dirSwap) rollback() error {
+	glog.V(3).Infof("[kubic] rolling back %s", s.dir)
+	s.cleanup()
+
+	// the previous version of a directory is exchanged with the current one
+	backup := s.backup
+	if s.swapped && s.hadBackup {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			// (it was exchanged, but it could not be renamed to the backup)
+			backup = s.staging
+		}
+		if info, err := os.Stat(s.dir); err == nil && info.IsDir() {
+			if err := exchangePaths(backup, s.dir); err == nil {
+				s.swapped = false
+				s.hadBackup = false
+				return os.RemoveAll(backup)
+			}
+		}
+	}
+
+	if s.swapped {
+		if info, err := os.Stat(s.dir); err == nil && (info.IsDir() || !s.hadBackup) {
+			if err := os.RemoveAll(s.dir); err != nil {
+				return err
+			}
+		}
+		s.swapped = false
+	}
+	if s.hadBackup {
+		// (a file is replaced with a single rename)
+		if err := os.Rename(backup, s.dir); err != nil {
+			return err
+		}
+		s.hadBackup = false
+	}
+	return nil
+}
+
+// cleanup removes the staging directory (if it has not been swapped)
+func (s *dirSwap) cleanup() {
+	if !s.swapped && len(s.staging) > 0 {
+		os.RemoveAll(s.staging)
+	}
+}
+
+// writeFileSync writes a file, making sure the contents are in the disk
+func writeFileSync(path string, contents []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestDirSwap(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "certs.d", "registry.suse.de:5000")
+	s, err := stageDir(dir, map[string][]byte{"ca.crt": []byte("old certificate")})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(s.commit()).ShouldNot(HaveOccurred())
+
+	// the directory is replaced, keeping the previous version as a backup
+	s, err = stageDir(dir, map[string][]byte{"ca.crt": []byte("new certificate")})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(s.commit()).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(filepath.Join(dir, "ca.crt"))).Should(Equal([]byte("new certificate")))
+	g.Expect(ioutil.ReadFile(filepath.Join(s.backup, "ca.crt"))).Should(Equal([]byte("old certificate")))
+	g.Expect(s.staging).ShouldNot(BeADirectory())
+
+	// ... that is restored on a rollback
+	g.Expect(s.rollback()).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(filepath.Join(dir, "ca.crt"))).Should(Equal([]byte("old certificate")))
+	g.Expect(s.backup).ShouldNot(BeADirectory())
+}
+
+func TestFileSwap(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "daemon.json")
+	g.Expect(ioutil.WriteFile(path, []byte("{}"), 0644)).ShouldNot(HaveOccurred())
+	before, err := os.Stat(path)
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	// the file is renamed over the current one, that is kept (linked) as a backup
+	s, err := stageFile(path, []byte(`{"insecure-registries": []}`))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(s.commit()).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(path)).Should(Equal([]byte(`{"insecure-registries": []}`)))
+
+	backup, err := os.Stat(s.backup)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(os.SameFile(before, backup)).Should(BeTrue())
+
+	g.Expect(s.rollback()).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(path)).Should(Equal([]byte("{}")))
+
+	// a new file is removed on a rollback
+	newPath := filepath.Join(root, "new.conf")
+	s, err = stageFile(newPath, []byte("contents"))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(s.commit()).ShouldNot(HaveOccurred())
+	g.Expect(s.rollback()).ShouldNot(HaveOccurred())
+	g.Expect(newPath).ShouldNot(BeAnExistingFile())
+}
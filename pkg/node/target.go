@@ -0,0 +1,443 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// TargetDocker is the runtime target for Docker
+	TargetDocker = "docker"
+
+	// TargetPodman is the runtime target for podman and CRI-O
+	TargetPodman = "podman"
+
+	// TargetContainerd is the runtime target for containerd
+	TargetContainerd = "containerd"
+)
+
+// TargetFiles are the contents installed by a RuntimeTarget for a registry, by
+// location (a directory or a configuration file) and name. They are only used
+// for computing the hashes, so two TargetFiles must be equal if and only if the
+// same configuration is installed.
+type TargetFiles map[string]map[string][]byte
+
+// Change is a modification done in the node by a RuntimeTarget, that can be rolled back
+type Change interface {
+	// Rollback restores the previous state of the node
+	Rollback() error
+}
+
+// RuntimeTarget is a container runtime (or any other program) that must be
+// configured with the registries.
+type RuntimeTarget interface {
+	// Name is the (unique) name of the target
+	Name() string
+
+	// Plan returns the contents that must be installed for `cfg`
+	Plan(cfg HostConfig) TargetFiles
+
+	// Apply installs the configuration `cfg` in the root filesystem `root`,
+	// returning the changes done. When something fails, the changes already
+	// done must be returned too, so they can be rolled back.
+	Apply(root string, cfg HostConfig) ([]Change, error)
+
+	// Remove removes the configuration installed for the registry `name` at
+	// `hostPort` from the root filesystem `root`
+	Remove(root string, name string, hostPort string) ([]Change, error)
+
+	// Verify returns the contents installed for the registry `name` at `hostPort`
+	// (in the same format as Plan), or false when it is not installed
+	Verify(root string, name string, hostPort string) (TargetFiles, bool)
+}
+
+var (
+	runtimeTargetsMutex sync.RWMutex
+
+	// runtimeTargets are the targets registered, in the order they are applied
+	runtimeTargets = []RuntimeTarget{}
+)
+
+// RegisterRuntimeTarget registers a new target, so it can be used in the
+// HostConfig.Targets (and where all the targets are used by default)
+func RegisterRuntimeTarget(target RuntimeTarget) {
+	runtimeTargetsMutex.Lock()
+	defer runtimeTargetsMutex.Unlock()
+
+	for i, t := range runtimeTargets {
+		if t.Name() == target.Name() {
+			runtimeTargets[i] = target
+			return
+		}
+	}
+	runtimeTargets = append(runtimeTargets, target)
+}
+
+// RuntimeTargets returns all the targets registered
+func RuntimeTargets() []RuntimeTarget {
+	runtimeTargetsMutex.RLock()
+	defer runtimeTargetsMutex.RUnlock()
+
+	return append([]RuntimeTarget{}, runtimeTargets...)
+}
+
+// RuntimeTargetNames returns the names of all the targets registered
+func RuntimeTargetNames() []string {
+	res := []string{}
+	for _, t := range RuntimeTargets() {
+		res = append(res, t.Name())
+	}
+	return res
+}
+
+// ValidateRuntimeTargets checks all the `names` are registered targets
+func ValidateRuntimeTargets(names []string) error {
+	_, err := getRuntimeTargets(names)
+	return err
+}
+
+// getRuntimeTargets returns the targets with some `names` (all the targets when empty)
+func getRuntimeTargets(names []string) ([]RuntimeTarget, error) {
+	all := RuntimeTargets()
+	if len(names) == 0 {
+		return all, nil
+	}
+
+	res := []RuntimeTarget{}
+	for _, t := range all {
+		if containsString(names, t.Name()) {
+			res = append(res, t)
+		}
+	}
+	if len(res) != len(names) {
+		return nil, fmt.Errorf("unknown runtime targets in %v (known targets: %v)", names, RuntimeTargetNames())
+	}
+	return res, nil
+}
+
+// CertificatePath returns the path of the CA.crt installed for `hostPort` in
+// the first of the `targets` that installs it in a certificates directory
+// (relative to the root filesystem `root`)
+func CertificatePath(root string, hostPort string, targets []string) string {
+	ts, err := getRuntimeTargets(targets)
+	if err == nil {
+		for _, t := range ts {
+			if c, ok := t.(interface {
+				caPath(root string, hostPort string) string
+			}); ok {
+				return c.caPath(root, hostPort)
+			}
+		}
+	}
+	return CertificatePaths(root, hostPort)[0]
+}
+
+// InstallDir replaces the directory `dir` (in the root filesystem `root`) by
+// a directory with `files`, atomically (see dirSwap)
+func InstallDir(root string, dir string, files map[string][]byte) (Change, error) {
+	path := filepath.Join(root, dir)
+	s, err := stageDir(path, files)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.commit(); err != nil {
+		s.rollback()
+		return nil, err
+	}
+	return s, nil
+}
+
+// InstallFile replaces the file `path` (in the root filesystem `root`), atomically
+func InstallFile(root string, path string, contents []byte) (Change, error) {
+	s, err := stageFile(filepath.Join(root, path), contents)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.commit(); err != nil {
+		s.rollback()
+		return nil, err
+	}
+	return s, nil
+}
+
+// RemovePath removes the file (or directory) `path` in the root filesystem `root`,
+// keeping it as a backup. It returns a nil Change when it does not exist.
+func RemovePath(root string, path string) (Change, error) {
+	fullPath := filepath.Join(root, path)
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	glog.V(3).Infof("[kubic] removing %s", fullPath)
+	s := stageRemoval(fullPath)
+	if err := s.commit(); err != nil {
+		s.rollback()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadInstalledDir returns the regular files in the directory `dir` (in the
+// root filesystem `root`)
+func ReadInstalledDir(root string, dir string) (map[string][]byte, error) {
+	path := filepath.Join(root, dir)
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = contents
+	}
+	return files, nil
+}
+
+// Rollback restores the previous version of the directory (or file)
+func (s *dirSwap) Rollback() error {
+	return s.rollback()
+}
+
+// Path returns the directory (or file) modified
+func (s *dirSwap) Path() string {
+	return s.dir
+}
+
+// appendChange appends `c` to `changes` (if it is not nil)
+func appendChange(changes []Change, c Change) []Change {
+	if c == nil {
+		return changes
+	}
+	return append(changes, c)
+}
+
+// certsDirTarget is a target that reads the certificates from a `certs.d` directory
+type certsDirTarget struct {
+	certsDir string
+}
+
+func (t certsDirTarget) plan(cfg HostConfig) TargetFiles {
+	return TargetFiles{t.certsDir: cfg.files(t.certsDir)}
+}
+
+func (t certsDirTarget) apply(root string, cfg HostConfig) ([]Change, error) {
+	dir := filepath.Join(t.certsDir, cfg.HostPort)
+	glog.V(3).Infof("[kubic] installing certificates for %s at %s", cfg.HostPort, filepath.Join(root, dir))
+	c, err := InstallDir(root, dir, cfg.files(t.certsDir))
+	if err != nil {
+		return nil, err
+	}
+	return []Change{c}, nil
+}
+
+func (t certsDirTarget) remove(root string, hostPort string) ([]Change, error) {
+	c, err := RemovePath(root, filepath.Join(t.certsDir, hostPort))
+	return appendChange(nil, c), err
+}
+
+func (t certsDirTarget) caPath(root string, hostPort string) string {
+	return filepath.Join(root, t.certsDir, hostPort, caFileName)
+}
+
+func (t certsDirTarget) verify(root string, hostPort string) (TargetFiles, bool) {
+	files, err := ReadInstalledDir(root, filepath.Join(t.certsDir, hostPort))
+	if err != nil {
+		return nil, false
+	}
+	if _, found := files[caFileName]; !found {
+		return nil, false
+	}
+	return TargetFiles{t.certsDir: files}, true
+}
+
+// dockerTarget installs the certificates in `/etc/docker/certs.d` and
+// merges the insecure registries and mirrors in the `daemon.json`
+type dockerTarget struct {
+	certsDirTarget
+}
+
+func (t dockerTarget) Name() string {
+	return TargetDocker
+}
+
+func (t dockerTarget) Plan(cfg HostConfig) TargetFiles {
+	res := t.plan(cfg)
+	if entries := cfg.daemonJSONEntries(); len(entries) > 0 {
+		res[DockerDaemonJSON] = hashDaemonJSONEntries(entries)
+	}
+	return res
+}
+
+func (t dockerTarget) Apply(root string, cfg HostConfig) ([]Change, error) {
+	changes, err := t.apply(root, cfg)
+	if err != nil || len(cfg.Name) == 0 {
+		return changes, err
+	}
+
+	// merge the entries for this registry in the Docker daemon.json
+	daemonChanges, err := commitSwaps(stageDaemonJSON(root, cfg.Name, cfg.daemonJSONEntries()))
+	return append(changes, daemonChanges...), err
+}
+
+func (t dockerTarget) Remove(root string, name string, hostPort string) ([]Change, error) {
+	changes, err := t.remove(root, hostPort)
+	if err != nil || len(name) == 0 {
+		return changes, err
+	}
+
+	// remove the entries for this registry from the Docker daemon.json
+	daemonChanges, err := commitSwaps(stageDaemonJSON(root, name, nil))
+	return append(changes, daemonChanges...), err
+}
+
+func (t dockerTarget) Verify(root string, name string, hostPort string) (TargetFiles, bool) {
+	res, ok := t.verify(root, hostPort)
+	if !ok {
+		return nil, false
+	}
+	if len(name) > 0 {
+		if entries := installedDaemonJSONEntries(root, name); len(entries) > 0 {
+			res[DockerDaemonJSON] = hashDaemonJSONEntries(entries)
+		}
+	}
+	return res, true
+}
+
+// podmanTarget installs the certificates in `/etc/containers/certs.d` and
+// a drop-in in `/etc/containers/registries.conf.d` (for podman and CRI-O)
+type podmanTarget struct {
+	certsDirTarget
+}
+
+func (t podmanTarget) Name() string {
+	return TargetPodman
+}
+
+func (t podmanTarget) Plan(cfg HostConfig) TargetFiles {
+	res := t.plan(cfg)
+	if cfg.needsRegistriesConf() {
+		res[RegistriesConfDir] = map[string][]byte{
+			filepath.Base(RegistriesConfPath("", cfg.Name)): cfg.registriesConf(),
+		}
+	}
+	return res
+}
+
+func (t podmanTarget) Apply(root string, cfg HostConfig) ([]Change, error) {
+	changes, err := t.apply(root, cfg)
+	if err != nil || len(cfg.Name) == 0 {
+		return changes, err
+	}
+
+	// install (or remove, when it is not necessary anymore) the drop-in
+	path := RegistriesConfPath("", cfg.Name)
+	var c Change
+	if cfg.needsRegistriesConf() {
+		glog.V(3).Infof("[kubic] installing registries configuration for %s at %s", cfg.HostPort, filepath.Join(root, path))
+		c, err = InstallFile(root, path, cfg.registriesConf())
+	} else {
+		c, err = RemovePath(root, path)
+	}
+	return appendChange(changes, c), err
+}
+
+func (t podmanTarget) Remove(root string, name string, hostPort string) ([]Change, error) {
+	changes, err := t.remove(root, hostPort)
+	if err != nil || len(name) == 0 {
+		return changes, err
+	}
+
+	c, err := RemovePath(root, RegistriesConfPath("", name))
+	return appendChange(changes, c), err
+}
+
+func (t podmanTarget) Verify(root string, name string, hostPort string) (TargetFiles, bool) {
+	res, ok := t.verify(root, hostPort)
+	if !ok {
+		return nil, false
+	}
+	if len(name) > 0 {
+		path := RegistriesConfPath(root, name)
+		if contents, err := ioutil.ReadFile(path); err == nil {
+			res[RegistriesConfDir] = map[string][]byte{filepath.Base(path): contents}
+		}
+	}
+	return res, true
+}
+
+// containerdTarget installs the certificates and a `hosts.toml` in `/etc/containerd/certs.d`
+type containerdTarget struct {
+	certsDirTarget
+}
+
+func (t containerdTarget) Name() string {
+	return TargetContainerd
+}
+
+func (t containerdTarget) Plan(cfg HostConfig) TargetFiles {
+	return t.plan(cfg)
+}
+
+func (t containerdTarget) Apply(root string, cfg HostConfig) ([]Change, error) {
+	return t.apply(root, cfg)
+}
+
+func (t containerdTarget) Remove(root string, name string, hostPort string) ([]Change, error) {
+	return t.remove(root, hostPort)
+}
+
+func (t containerdTarget) Verify(root string, name string, hostPort string) (TargetFiles, bool) {
+	return t.verify(root, hostPort)
+}
+
+// commitSwaps commits some staged swaps, returning the ones committed
+func commitSwaps(swaps []*dirSwap, err error) ([]Change, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	for i, s := range swaps {
+		changes = append(changes, s)
+		if err := s.commit(); err != nil {
+			cleanupSwaps(swaps[i+1:])
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+func init() {
+	RegisterRuntimeTarget(dockerTarget{certsDirTarget{DockerCertsDir}})
+	RegisterRuntimeTarget(podmanTarget{certsDirTarget{PodmanCertsDir}})
+	RegisterRuntimeTarget(containerdTarget{certsDirTarget{ContainerdCertsDir}})
+}
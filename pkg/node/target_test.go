@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// a third party target, that installs the CA.crt in a single file
+type testTarget struct{}
+
+func (t testTarget) Name() string { return "test" }
+
+func (t testTarget) Plan(cfg HostConfig) TargetFiles {
+	return TargetFiles{"/etc/test": {cfg.HostPort + ".crt": cfg.CA}}
+}
+
+func (t testTarget) Apply(root string, cfg HostConfig) ([]Change, error) {
+	c, err := InstallFile(root, filepath.Join("/etc/test", cfg.HostPort+".crt"), cfg.CA)
+	return appendChange(nil, c), err
+}
+
+func (t testTarget) Remove(root string, name string, hostPort string) ([]Change, error) {
+	c, err := RemovePath(root, filepath.Join("/etc/test", hostPort+".crt"))
+	return appendChange(nil, c), err
+}
+
+func (t testTarget) Verify(root string, name string, hostPort string) (TargetFiles, bool) {
+	crt, err := ioutil.ReadFile(filepath.Join(root, "/etc/test", hostPort+".crt"))
+	if err != nil {
+		return nil, false
+	}
+	return TargetFiles{"/etc/test": {hostPort + ".crt": crt}}, true
+}
+
+func TestRuntimeTargets(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	g.Expect(RuntimeTargetNames()).Should(Equal([]string{TargetDocker, TargetPodman, TargetContainerd}))
+
+	RegisterRuntimeTarget(testTarget{})
+	defer func() { runtimeTargets = runtimeTargets[:3] }()
+
+	cfg := HostConfig{
+		Name:     "suse-registry",
+		HostPort: "registry.suse.de:5000",
+		CA:       []byte("some certificate"),
+		Targets:  []string{TargetContainerd, "test"},
+	}
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(filepath.Join(root, "/etc/test", cfg.HostPort+".crt"))).Should(Equal(cfg.CA))
+	g.Expect(filepath.Join(root, ContainerdCertsDir, cfg.HostPort)).Should(BeADirectory())
+
+	// the other targets are not touched (not even their directories are created)
+	g.Expect(filepath.Join(root, "/etc/docker")).ShouldNot(BeADirectory())
+	g.Expect(filepath.Join(root, DockerCertsDir, cfg.HostPort)).ShouldNot(BeADirectory())
+	g.Expect(filepath.Join(root, PodmanCertsDir, cfg.HostPort)).ShouldNot(BeADirectory())
+
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort, cfg.Targets...)).Should(Equal(cfg.Hash()))
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(BeEmpty())
+
+	// the hash depends on the targets
+	all := cfg
+	all.Targets = nil
+	g.Expect(all.Hash()).ShouldNot(Equal(cfg.Hash()))
+
+	// the registry is removed from all the targets
+	g.Expect(RemoveHostConfig(root, cfg.Name, cfg.HostPort)).ShouldNot(HaveOccurred())
+	g.Expect(filepath.Join(root, "/etc/test", cfg.HostPort+".crt")).ShouldNot(BeAnExistingFile())
+	g.Expect(filepath.Join(root, ContainerdCertsDir, cfg.HostPort)).ShouldNot(BeADirectory())
+
+	// unknown targets are rejected
+	cfg.Targets = []string{"rkt"}
+	g.Expect(InstallHostConfig(root, cfg)).Should(HaveOccurred())
+}
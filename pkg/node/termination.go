@@ -0,0 +1,44 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultTerminationMessagePath is the file where Kubernetes reads the termination message from
+const DefaultTerminationMessagePath = corev1.TerminationMessagePathDefault
+
+// WriteTerminationMessage writes `v` (encoded as JSON) in the termination message file,
+// so it can be read by the controller in the status of the Pod
+func WriteTerminationMessage(path string, v interface{}) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+// ReadTerminationMessage decodes a termination message (as written by
+// WriteTerminationMessage) into `v`
+func ReadTerminationMessage(message string, v interface{}) error {
+	return json.Unmarshal([]byte(message), v)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// TrustStoreSUSE is the system trust store in SUSE distributions
+	TrustStoreSUSE = "suse"
+
+	// TrustStoreDebian is the system trust store in Debian and Ubuntu
+	TrustStoreDebian = "debian"
+
+	// TrustStoreRHEL is the system trust store in Red Hat, CentOS and Fedora
+	TrustStoreRHEL = "rhel"
+
+	// the key used for the system trust store in the hashes
+	trustStoreHashKey = "system-trust"
+)
+
+// TrustStore is a system trust store (where tools like curl or skopeo look for CAs)
+type TrustStore struct {
+	// AnchorsDir is the directory where the CAs are installed
+	AnchorsDir string
+
+	// UpdateCommand is the command that refreshes the trust store once the anchors are modified
+	UpdateCommand []string
+}
+
+// TrustStores are the system trust stores supported
+var TrustStores = map[string]TrustStore{
+	TrustStoreSUSE: {
+		AnchorsDir:    "/etc/pki/trust/anchors/",
+		UpdateCommand: []string{"update-ca-certificates"},
+	},
+	TrustStoreDebian: {
+		AnchorsDir:    "/usr/local/share/ca-certificates/",
+		UpdateCommand: []string{"update-ca-certificates"},
+	},
+	TrustStoreRHEL: {
+		AnchorsDir:    "/etc/pki/ca-trust/source/anchors/",
+		UpdateCommand: []string{"update-ca-trust", "extract"},
+	},
+}
+
+// runCommand runs a command in the root filesystem `root`
+// (it can be replaced in tests)
+var runCommand = runInRoot
+
+// TrustStoreForOSImage returns the system trust store for a Node with
+// the OS image `osImage` (as reported in the Node status), or an empty
+// string when the OS is not supported
+func TrustStoreForOSImage(osImage string) string {
+	osImage = strings.ToLower(osImage)
+	switch {
+	case strings.Contains(osImage, "suse"):
+		return TrustStoreSUSE
+	case strings.Contains(osImage, "debian"), strings.Contains(osImage, "ubuntu"):
+		return TrustStoreDebian
+	case strings.Contains(osImage, "red hat"), strings.Contains(osImage, "centos"), strings.Contains(osImage, "fedora"):
+		return TrustStoreRHEL
+	}
+	return ""
+}
+
+// trustAnchorPath returns the path of the CA.crt for the Registry `name` in a trust store
+func trustAnchorPath(root string, store TrustStore, name string) string {
+	return filepath.Join(root, store.AnchorsDir, registriesConfPrefix+name+".crt")
+}
+
+// sortedTrustStores returns the names of the trust stores, sorted
+func sortedTrustStores() []string {
+	res := []string{}
+	for name := range TrustStores {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// installedTrustAnchor returns the CA.crt installed for the Registry `name`
+// in the system trust store (or nil if it is not installed)
+func installedTrustAnchor(root string, name string) []byte {
+	for _, storeName := range sortedTrustStores() {
+		if crt, err := ioutil.ReadFile(trustAnchorPath(root, TrustStores[storeName], name)); err == nil {
+			return crt
+		}
+	}
+	return nil
+}
+
+// stageTrustStore stages the changes in the system trust stores for the configuration
+// `cfg`: the CA.crt is installed in the trust store of the Node (when enabled) and
+// removed from any other trust store. It returns the trust stores that must be refreshed.
+func stageTrustStore(root string, cfg HostConfig) ([]*dirSwap, []string, error) {
+	swaps := []*dirSwap{}
+	refresh := []string{}
+
+	for _, storeName := range sortedTrustStores() {
+		path := trustAnchorPath(root, TrustStores[storeName], cfg.Name)
+		current, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			cleanupSwaps(swaps)
+			return nil, nil, err
+		}
+
+		if cfg.SystemTrust && storeName == cfg.TrustStore {
+			if err == nil && bytes.Equal(current, cfg.CA) {
+				continue
+			}
+			glog.V(3).Infof("[kubic] installing CA.crt for %s in the system trust store at %s", cfg.HostPort, path)
+			s, err := stageFile(path, cfg.CA)
+			if err != nil {
+				cleanupSwaps(swaps)
+				return nil, nil, err
+			}
+			swaps = append(swaps, s)
+			refresh = append(refresh, storeName)
+		} else if err == nil {
+			glog.V(3).Infof("[kubic] removing CA.crt for %s from the system trust store at %s", cfg.HostPort, path)
+			swaps = append(swaps, stageRemoval(path))
+			refresh = append(refresh, storeName)
+		}
+	}
+
+	return swaps, refresh, nil
+}
+
+// refreshTrustStores runs the update command of some trust stores
+func refreshTrustStores(root string, stores []string) error {
+	for _, storeName := range stores {
+		store := TrustStores[storeName]
+		glog.V(3).Infof("[kubic] refreshing the system trust store with '%s'", strings.Join(store.UpdateCommand, " "))
+		if err := runCommand(root, store.UpdateCommand); err != nil {
+			return fmt.Errorf("could not refresh the system trust store: %s", err)
+		}
+	}
+	return nil
+}
+
+// runInRoot runs a command in the root filesystem `root` (with a chroot
+// when it is not the current root filesystem)
+func runInRoot(root string, command []string) error {
+	if filepath.Clean(root) != "/" {
+		command = append([]string{"chroot", root}, command...)
+	}
+
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
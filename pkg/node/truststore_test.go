@@ -0,0 +1,113 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestTrustStoreForOSImage(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	g.Expect(TrustStoreForOSImage("openSUSE Tumbleweed")).Should(Equal(TrustStoreSUSE))
+	g.Expect(TrustStoreForOSImage("SUSE Linux Enterprise Server 15 SP1")).Should(Equal(TrustStoreSUSE))
+	g.Expect(TrustStoreForOSImage("Ubuntu 18.04.1 LTS")).Should(Equal(TrustStoreDebian))
+	g.Expect(TrustStoreForOSImage("Debian GNU/Linux 9 (stretch)")).Should(Equal(TrustStoreDebian))
+	g.Expect(TrustStoreForOSImage("CentOS Linux 7 (Core)")).Should(Equal(TrustStoreRHEL))
+	g.Expect(TrustStoreForOSImage("Container-Optimized OS from Google")).Should(BeEmpty())
+}
+
+func TestInstallTrustStore(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "registries-operator")
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer os.RemoveAll(root)
+
+	// record the refreshes instead of running the commands
+	refreshed := []string{}
+	failRefresh := false
+	runCommand = func(r string, command []string) error {
+		g.Expect(r).Should(Equal(root))
+		if failRefresh {
+			return fmt.Errorf("refresh failed")
+		}
+		refreshed = append(refreshed, strings.Join(command, " "))
+		return nil
+	}
+	defer func() { runCommand = runInRoot }()
+
+	cfg := HostConfig{
+		Name:        "suse-registry",
+		HostPort:    "registry.suse.de:5000",
+		CA:          []byte("some certificate"),
+		SystemTrust: true,
+		TrustStore:  TrustStoreSUSE,
+	}
+	suseAnchor := trustAnchorPath(root, TrustStores[TrustStoreSUSE], cfg.Name)
+	debianAnchor := trustAnchorPath(root, TrustStores[TrustStoreDebian], cfg.Name)
+
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(ioutil.ReadFile(suseAnchor)).Should(Equal(cfg.CA))
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+	g.Expect(refreshed).Should(Equal([]string{"update-ca-certificates"}))
+
+	// nothing is refreshed when the anchor has not changed
+	refreshed = []string{}
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(refreshed).Should(BeEmpty())
+
+	// a failed refresh rolls back the new CA.crt
+	failRefresh = true
+	newCfg := cfg
+	newCfg.CA = []byte("some other certificate")
+	g.Expect(InstallHostConfig(root, newCfg)).Should(HaveOccurred())
+	g.Expect(ioutil.ReadFile(suseAnchor)).Should(Equal(cfg.CA))
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+	failRefresh = false
+
+	// the anchor is moved when the trust store changes...
+	cfg.TrustStore = TrustStoreDebian
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(suseAnchor).ShouldNot(BeAnExistingFile())
+	g.Expect(ioutil.ReadFile(debianAnchor)).Should(Equal(cfg.CA))
+
+	// ... and removed when it is disabled
+	cfg.SystemTrust = false
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	g.Expect(debianAnchor).ShouldNot(BeAnExistingFile())
+	g.Expect(InstalledHash(root, cfg.Name, cfg.HostPort)).Should(Equal(cfg.Hash()))
+
+	// the anchor is removed (and the trust store refreshed) with the registry
+	cfg.SystemTrust = true
+	g.Expect(InstallHostConfig(root, cfg)).ShouldNot(HaveOccurred())
+	refreshed = []string{}
+	g.Expect(RemoveHostConfig(root, cfg.Name, cfg.HostPort)).ShouldNot(HaveOccurred())
+	g.Expect(debianAnchor).ShouldNot(BeAnExistingFile())
+	g.Expect(refreshed).Should(Equal([]string{"update-ca-certificates"}))
+
+	// the system trust store must be known
+	cfg.TrustStore = ""
+	g.Expect(InstallHostConfig(root, cfg)).Should(HaveOccurred())
+}
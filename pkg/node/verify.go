@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package node
+
+import (
+	"github.com/golang/glog"
+)
+
+// VerifyResult is the result of verifying the certificate installed for a registry in a Node
+type VerifyResult struct {
+	// Node is the name of the Node where the verification was run
+	Node string `json:"node"`
+
+	// HostPort is the address of the registry
+	HostPort string `json:"hostPort"`
+
+	// Hash is the hash of the configuration found in the Node (empty when
+	// it is missing in some of the certificates directories)
+	Hash string `json:"hash,omitempty"`
+}
+
+// Verify computes the hash of the CA.crt installed for the registry in `spec`
+// in the root filesystem `root`
+func Verify(root string, nodeName string, spec InstallSpec) (VerifyResult, error) {
+	if err := spec.Validate(); err != nil {
+		return VerifyResult{}, err
+	}
+
+	res := VerifyResult{
+		Node:     nodeName,
+		HostPort: spec.HostPort,
+		Hash:     InstalledHash(root, spec.Name, spec.HostPort, spec.Targets...),
+	}
+	glog.V(3).Infof("[kubic] CA.crt for %s in %s: '%s'", spec.HostPort, nodeName, res.Hash)
+	return res, nil
+}
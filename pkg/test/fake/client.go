@@ -21,7 +21,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/kubic-project/registries-operator/pkg/apis/kubic/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -91,7 +93,34 @@ func (c *testClient) List(ctx context.Context, opts *client.ListOptions, list ru
 
 	opts.Raw = &metav1.ListOptions{TypeMeta: metav1.TypeMeta{APIVersion: gvk.Group + "/" + gvk.Version, Kind: gvk.Kind}}
 
-	return c.fake.List(ctx, opts, list)
+	if err := c.fake.List(ctx, opts, list); err != nil {
+		return err
+	}
+	return filterListByLabels(opts, list)
+}
+
+// filterListByLabels removes the elements of the list that do not match the label
+// selector in the options (the fakeClient v0.1.4 ignores it)
+func filterListByLabels(opts *client.ListOptions, list runtime.Object) error {
+	if opts.LabelSelector == nil || opts.LabelSelector.Empty() {
+		return nil
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	filtered := []runtime.Object{}
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		if opts.LabelSelector.Matches(labels.Set(accessor.GetLabels())) {
+			filtered = append(filtered, item)
+		}
+	}
+	return meta.SetList(list, filtered)
 }
 
 //This function is copied from the fakeClient v0.1.8
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+)
+
+// hashEncoding is the encoding used for the certificates hashes: only lowercase
+// letters and digits, so the result is always a valid label value
+// (a SHA-256 is encoded in 52 characters, below the 63 characters limit)
+var hashEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// CertificateHash gets the hash for a CA.crt
+// (a printable string that can be used in labels)
+func CertificateHash(crt []byte) string {
+	b := sha256.Sum256(crt)
+	return hashEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018 SUSE LINUX GmbH, Nuernberg, Germany..
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultRegistryPort is the port used by registries when no port is specified
+const DefaultRegistryPort = "443"
+
+// VerifyTLS performs a TLS handshake with `hostPort`, verifying the certificate
+// presented by the server with the CA bundle in `crt`
+func VerifyTLS(hostPort string, crt []byte, timeout time.Duration) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(crt) {
+		return fmt.Errorf("no valid certificates found in CA.crt")
+	}
+
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// no port specified: use the default one
+		host = hostPort
+		hostPort = net.JoinHostPort(host, DefaultRegistryPort)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", hostPort, &tls.Config{
+		RootCAs:    pool,
+		ServerName: host,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}